@@ -0,0 +1,49 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"bethos/internal/model"
+)
+
+// FileSource reads a dump with one model.Payload JSON per line (e.g. kcat output of the compacted topic).
+// Empty lines are skipped; a line that is not a valid payload fails the load.
+type FileSource struct {
+	Path string
+}
+
+func (s FileSource) Load(ctx context.Context, fn func(model.Payload) error) error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	buf := make([]byte, 0, 64*1024)
+	sc.Buffer(buf, 16*1024*1024)
+
+	line := 0
+	for sc.Scan() {
+		line++
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		b := sc.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		var p model.Payload
+		if err := json.Unmarshal(b, &p); err != nil {
+			return fmt.Errorf("bootstrap file %s line %d: %w", s.Path, line, err)
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,47 @@
+package bootstrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bethos/internal/model"
+)
+
+func TestFileSource_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.ndjson")
+	dump := `{"num_of_data":1,"data":{"id":"VIN1","sensor_a":{"value":"1","received_at":100}},"produced_at":1}
+
+{"num_of_data":1,"data":{"id":"VIN2","sensor_a":{"value":"2","received_at":200}},"produced_at":2}
+`
+	if err := os.WriteFile(path, []byte(dump), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]model.Payload{}
+	err := FileSource{Path: path}.Load(context.Background(), func(p model.Payload) error {
+		got[p.Data.ID] = p
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("loaded %d payloads, want 2", len(got))
+	}
+	if got["VIN2"].Data.Metrics["sensor_a"].ReceivedAt != 200 {
+		t.Errorf("VIN2 sensor_a = %+v", got["VIN2"].Data.Metrics["sensor_a"])
+	}
+}
+
+func TestFileSource_Load_InvalidLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.ndjson")
+	if err := os.WriteFile(path, []byte("not json\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	err := FileSource{Path: path}.Load(context.Background(), func(model.Payload) error { return nil })
+	if err == nil {
+		t.Error("expected error for invalid line")
+	}
+}
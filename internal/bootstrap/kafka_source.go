@@ -0,0 +1,213 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"bethos/internal/model"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// KafkaSource reads a compacted topic (key = vincode, value = model.Payload) from the earliest offset up to
+// the end offsets observed at start, without a consumer group. The last record per key wins and a tombstone
+// (nil or empty value) removes the key, mirroring what log compaction keeps. Each partition is handed to fn
+// as soon as it has been read to its end, so a Load cut short (e.g. by its context) still seeds the complete
+// partitions. A record is decoded with model.DecodePayloads, so batched records (model.PayloadBatch under a
+// bucket key) seed each of their devices; records it cannot decode (Avro, Protobuf, diff patches) and
+// payloads without a device are skipped and counted in one log line per partition.
+type KafkaSource struct {
+	Brokers []string
+	Topic   string
+	// Partitions limits the read to these partitions; empty = all partitions of Topic.
+	Partitions []int32
+}
+
+func (s KafkaSource) Load(ctx context.Context, fn func(model.Payload) error) error {
+	// Control records (transaction markers) are kept so a partition ending with one is seen to reach its end.
+	cl, err := kgo.NewClient(kgo.SeedBrokers(s.Brokers...), kgo.KeepControlRecords())
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+
+	partitions, err := s.partitions(ctx, cl)
+	if err != nil {
+		return err
+	}
+	starts, err := s.listOffsets(ctx, cl, partitions, -2)
+	if err != nil {
+		return err
+	}
+	ends, err := s.listOffsets(ctx, cl, partitions, -1)
+	if err != nil {
+		return err
+	}
+
+	start := make(map[int32]kgo.Offset, len(ends))
+	for p, end := range ends {
+		if end > starts[p] {
+			start[p] = kgo.NewOffset().AtStart()
+		}
+	}
+	if len(start) == 0 {
+		return nil
+	}
+	cl.AddConsumePartitions(map[string]map[int32]kgo.Offset{s.Topic: start})
+
+	latest := make(map[int32]map[string][]byte, len(start)) // partition -> key -> value, until the partition is done
+	for len(start) > 0 {
+		fetches := cl.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, fe := range fetches.Errors() {
+			return fmt.Errorf("bootstrap kafka %s[%d]: %w", fe.Topic, fe.Partition, fe.Err)
+		}
+		var complete []int32
+		fetches.EachPartition(func(fp kgo.FetchTopicPartition) {
+			if _, reading := start[fp.Partition]; !reading || len(fp.Records) == 0 {
+				return
+			}
+			keys := latest[fp.Partition]
+			if keys == nil {
+				keys = make(map[string][]byte)
+				latest[fp.Partition] = keys
+			}
+			for _, r := range fp.Records {
+				if r.Attrs.IsControl() {
+					continue
+				}
+				if len(r.Value) == 0 {
+					delete(keys, string(r.Key))
+				} else {
+					keys[string(r.Key)] = r.Value
+				}
+			}
+			// Done at the end offset listed at start, or earlier if the partition has since been truncated.
+			end := ends[fp.Partition]
+			if fp.HighWatermark >= 0 && fp.HighWatermark < end {
+				end = fp.HighWatermark
+			}
+			if fp.Records[len(fp.Records)-1].Offset+1 >= end {
+				complete = append(complete, fp.Partition)
+			}
+		})
+		for _, p := range complete {
+			delete(start, p)
+			cl.RemoveConsumePartitions(map[string][]int32{s.Topic: {p}})
+			err := seed(p, latest[p], fn)
+			delete(latest, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seed hands every device of the records of partition to fn. A single payload without an id takes the
+// record key as its VIN.
+func seed(partition int32, latest map[string][]byte, fn func(model.Payload) error) error {
+	skipped := 0
+	var firstKey string
+	var firstErr error
+	skip := func(key string, err error) {
+		if skipped == 0 {
+			firstKey, firstErr = key, err
+		}
+		skipped++
+	}
+	for key, raw := range latest {
+		if len(raw) == 0 {
+			continue // tombstone
+		}
+		ps, err := model.DecodePayloads(raw)
+		if err != nil {
+			skip(key, err)
+			continue
+		}
+		if len(ps) == 1 && ps[0].Data.ID == "" {
+			ps[0].Data.ID = key
+		}
+		for _, p := range ps {
+			if p.Data.ID == "" || len(p.Data.Metrics) == 0 {
+				skip(key, errors.New("no device"))
+				continue
+			}
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+	}
+	if skipped > 0 {
+		log.Printf("[latest_merger] event=bootstrap_skip partition=%d record_count=%d first_key=%s error=%v",
+			partition, skipped, firstKey, firstErr)
+	}
+	return nil
+}
+
+// LoadPartition is Load restricted to one partition of Topic.
+func (s KafkaSource) LoadPartition(ctx context.Context, partition int32, fn func(model.Payload) error) error {
+	s.Partitions = []int32{partition}
+	return s.Load(ctx, fn)
+}
+
+// partitions returns s.Partitions, or every partition of the topic when none are configured.
+func (s KafkaSource) partitions(ctx context.Context, cl *kgo.Client) ([]int32, error) {
+	if len(s.Partitions) > 0 {
+		return s.Partitions, nil
+	}
+	req := kmsg.NewPtrMetadataRequest()
+	topic := kmsg.NewMetadataRequestTopic()
+	topic.Topic = kmsg.StringPtr(s.Topic)
+	req.Topics = append(req.Topics, topic)
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Topics) != 1 {
+		return nil, fmt.Errorf("bootstrap kafka: topic %s not found", s.Topic)
+	}
+	if err := kerr.ErrorForCode(resp.Topics[0].ErrorCode); err != nil {
+		return nil, fmt.Errorf("bootstrap kafka: topic %s: %w", s.Topic, err)
+	}
+	var out []int32
+	for _, p := range resp.Topics[0].Partitions {
+		out = append(out, p.Partition)
+	}
+	return out, nil
+}
+
+// listOffsets returns the offset per partition for ts (-2 = earliest, -1 = latest / high watermark).
+func (s KafkaSource) listOffsets(ctx context.Context, cl *kgo.Client, partitions []int32, ts int64) (map[int32]int64, error) {
+	req := kmsg.NewPtrListOffsetsRequest()
+	reqTopic := kmsg.NewListOffsetsRequestTopic()
+	reqTopic.Topic = s.Topic
+	for _, p := range partitions {
+		rp := kmsg.NewListOffsetsRequestTopicPartition()
+		rp.Partition = p
+		rp.Timestamp = ts
+		reqTopic.Partitions = append(reqTopic.Partitions, rp)
+	}
+	req.Topics = append(req.Topics, reqTopic)
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[int32]int64, len(partitions))
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return nil, fmt.Errorf("bootstrap kafka: list offsets %s[%d]: %w", t.Topic, p.Partition, err)
+			}
+			out[p.Partition] = p.Offset
+		}
+	}
+	return out, nil
+}
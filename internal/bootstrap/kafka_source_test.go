@@ -0,0 +1,34 @@
+package bootstrap
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"bethos/internal/model"
+)
+
+func TestSeed_DecodesEveryRecordShape(t *testing.T) {
+	latest := map[string][]byte{
+		"VIN1":         []byte(`{"num_of_data":1,"data":{"id":"VIN1","a":{"value":"1","received_at":1}},"produced_at":1}`),
+		"VIN2":         []byte(`{"num_of_data":1,"data":{"a":{"value":"2","received_at":1}},"produced_at":1}`), // id from the key
+		"bucket-0-0":   []byte(`{"num_of_data":2,"data":[{"id":"VIN3","a":{"value":"3","received_at":1}},{"id":"VIN4","a":{"value":"4","received_at":1}}],"produced_at":1}`),
+		"VIN5":         []byte("\x00\x00\x00\x00\x01avro"),
+		"VIN6":         []byte(`[{"op":"replace","path":"/data/a","value":{"value":"6"}},{"op":"replace","path":"/produced_at","value":1}]`),
+		"VIN7":         []byte(`{"id":"VIN7","changed":{"a":{"value":"7"}},"produced_at":1}`),
+		"VIN8":         {}, // tombstone
+		"bucket-0-999": nil,
+	}
+
+	var got []string
+	if err := seed(0, latest, func(p model.Payload) error {
+		got = append(got, p.Data.ID)
+		return nil
+	}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	sort.Strings(got)
+	if want := "VIN1,VIN2,VIN3,VIN4"; strings.Join(got, ",") != want {
+		t.Errorf("seeded %v, want %s (undecodable records and tombstones skipped)", got, want)
+	}
+}
@@ -0,0 +1,26 @@
+package bootstrap
+
+import (
+	"context"
+
+	"bethos/internal/model"
+)
+
+const (
+	SourceKafka = "kafka"
+	SourceFile  = "file"
+)
+
+// Source yields the current latest-per-VIN payloads (e.g. the compacted output topic) used to seed
+// LatestMerger before normal consumption starts. fn is called once per payload; returning an error stops Load.
+type Source interface {
+	Load(ctx context.Context, fn func(model.Payload) error) error
+}
+
+// PartitionSource is a Source that can also be read one partition at a time, to rebuild the devices of a
+// Kafka partition newly assigned to this instance. It assumes the source topic is keyed by vincode and has
+// the same partition count as the input topic, so both map a VIN to the same partition.
+type PartitionSource interface {
+	Source
+	LoadPartition(ctx context.Context, partition int32, fn func(model.Payload) error) error
+}
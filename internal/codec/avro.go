@@ -0,0 +1,298 @@
+package codec
+
+import (
+	"bethos/internal/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hamba/avro/v2"
+)
+
+// avroRecordDef and avroFieldDef build the Avro schema JSON, keeping the field order.
+type avroRecordDef struct {
+	Type      string         `json:"type"`
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace,omitempty"`
+	Fields    []avroFieldDef `json:"fields"`
+}
+
+type avroFieldDef struct {
+	Name    string          `json:"name"`
+	Type    any             `json:"type"`
+	Default json.RawMessage `json:"default,omitempty"`
+	Sensor  string          `json:"sensor,omitempty"` // the sensor a Data field holds, when its name differs
+}
+
+var (
+	avroNull  = json.RawMessage("null")
+	avroZero  = json.RawMessage("0")
+	avroEmpty = json.RawMessage("{}")
+)
+
+// metricValueFullName is the union branch name of a MetricValue in an optional sensor field.
+const metricValueFullName = Namespace + ".MetricValue"
+
+func avroMetricValueDef() avroRecordDef {
+	return avroRecordDef{Type: "record", Name: "MetricValue", Fields: []avroFieldDef{
+		{Name: "value", Type: []string{"null", "boolean", "long", "double", "string"}, Default: avroNull},
+		{Name: "received_at", Type: "long"},
+		{Name: "received_at_ns", Type: "long", Default: avroZero},
+	}}
+}
+
+// avroDataDef is Data: id, extra (sensors not in the schema; defines MetricValue) and one optional field
+// per sensor.
+func avroDataDef(sensors []sensorField) avroRecordDef {
+	def := avroRecordDef{Type: "record", Name: "Data", Fields: []avroFieldDef{
+		{Name: "id", Type: "string"},
+		{Name: "extra", Type: map[string]any{"type": "map", "values": avroMetricValueDef()}, Default: avroEmpty},
+	}}
+	for _, f := range sensors {
+		field := avroFieldDef{Name: f.Field, Type: []string{"null", "MetricValue"}, Default: avroNull}
+		if f.Field != f.Sensor {
+			field.Sensor = f.Sensor
+		}
+		def.Fields = append(def.Fields, field)
+	}
+	return def
+}
+
+func avroRecordDefs(sensors []sensorField) map[string]avroRecordDef {
+	data := avroDataDef(sensors)
+	payload := func(name string, dataType any) avroRecordDef {
+		return avroRecordDef{Type: "record", Name: name, Namespace: Namespace, Fields: []avroFieldDef{
+			{Name: "num_of_data", Type: "long"},
+			{Name: "data", Type: dataType},
+			{Name: "produced_at", Type: "long"},
+		}}
+	}
+	top := data
+	top.Namespace = Namespace
+	return map[string]avroRecordDef{
+		RecordPayload:      payload("Payload", data),
+		RecordPayloadBatch: payload("PayloadBatch", map[string]any{"type": "array", "items": data}),
+		RecordData:         top,
+		RecordCSVRow: {Type: "record", Name: "CSVRow", Namespace: Namespace, Fields: []avroFieldDef{
+			{Name: "id", Type: "string"},
+			{Name: "vincode", Type: "string"},
+			{Name: "resource_id", Type: "string"},
+			{Name: "resource_name", Type: "string"},
+			{Name: "value", Type: "string"},
+			{Name: "captured_ts", Type: "long"},
+			{Name: "ts", Type: "long"},
+			{Name: "source", Type: "string"},
+			{Name: "ns_ts", Type: "long"},
+		}},
+	}
+}
+
+// avroSchemas holds the Avro schema of each record.
+type avroSchemas struct {
+	text     map[string]string
+	writers  map[string]*avroWriter
+	bySensor map[string]sensorField
+}
+
+func newAvroSchemas(sensors []sensorField) (*avroSchemas, error) {
+	s := &avroSchemas{
+		text:     make(map[string]string),
+		writers:  make(map[string]*avroWriter),
+		bySensor: make(map[string]sensorField, len(sensors)),
+	}
+	for _, f := range sensors {
+		s.bySensor[f.Sensor] = f
+	}
+	for record, def := range avroRecordDefs(sensors) {
+		b, err := json.Marshal(def)
+		if err != nil {
+			return nil, err
+		}
+		w, err := parseAvroWriter(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", record, err)
+		}
+		s.text[record] = string(b)
+		s.writers[record] = w
+	}
+	return s, nil
+}
+
+func (s *avroSchemas) encode(record string, v any) ([]byte, error) {
+	var native any
+	var err error
+	switch x := payloadOf(v).(type) {
+	case model.Payload:
+		var data map[string]any
+		if data, err = s.dataMap(x.Data); err == nil {
+			native = map[string]any{"num_of_data": int64(x.NumOfData), "data": data, "produced_at": x.ProducedAt}
+		}
+	case model.PayloadBatch:
+		list := make([]any, len(x.Data))
+		for i, d := range x.Data {
+			if list[i], err = s.dataMap(d); err != nil {
+				break
+			}
+		}
+		native = map[string]any{"num_of_data": int64(x.NumOfData), "data": list, "produced_at": x.ProducedAt}
+	case model.Data:
+		native, err = s.dataMap(x)
+	case model.CSVRow:
+		native = map[string]any{
+			"id": x.ID, "vincode": x.Vincode, "resource_id": x.ResourceID, "resource_name": x.ResourceName,
+			"value": x.Value, "captured_ts": x.CapturedTS, "ts": x.TS, "source": x.Source, "ns_ts": x.NsTS,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return avro.Marshal(s.writers[record].schema, native)
+}
+
+func (s *avroSchemas) dataMap(d model.Data) (map[string]any, error) {
+	m := make(map[string]any, len(d.Metrics)+2) // sensors left out are null (their default)
+	extra := make(map[string]any)
+	for sensor, mv := range d.Metrics {
+		value, err := metricValue(mv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", d.ID, sensor, err)
+		}
+		native := map[string]any{"value": value, "received_at": mv.ReceivedAt, "received_at_ns": mv.ReceivedAtNs}
+		if f, ok := s.bySensor[sensor]; ok {
+			m[f.Field] = map[string]any{metricValueFullName: native}
+		} else {
+			extra[sensor] = native
+		}
+	}
+	m["id"] = d.ID
+	m["extra"] = extra
+	return m, nil
+}
+
+// avroWriter decodes messages written with one Avro schema (from the Registry or local).
+type avroWriter struct {
+	record   string
+	schema   avro.Schema
+	sensorOf map[string]string // Data field -> sensor
+}
+
+func parseAvroWriter(text string) (*avroWriter, error) {
+	// A cache per schema: writer schemas from the Registry redefine the same names.
+	schema, err := avro.ParseWithCache(text, "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := schema.(*avro.RecordSchema)
+	if !ok {
+		return nil, errors.New("not a record schema")
+	}
+	w := &avroWriter{schema: schema, sensorOf: make(map[string]string)}
+	for record, name := range recordNames {
+		if rec.Name() == name {
+			w.record = record
+		}
+	}
+	if w.record == "" {
+		return nil, fmt.Errorf("unknown record %s", rec.FullName())
+	}
+
+	data := rec
+	if w.record == RecordPayload || w.record == RecordPayloadBatch {
+		data = nil
+		for _, f := range rec.Fields() {
+			if f.Name() != "data" {
+				continue
+			}
+			t := f.Type()
+			if arr, ok := t.(*avro.ArraySchema); ok {
+				t = arr.Items()
+			}
+			data, _ = t.(*avro.RecordSchema)
+		}
+		if data == nil {
+			return nil, fmt.Errorf("%s without a data record", rec.FullName())
+		}
+	}
+	if w.record != RecordCSVRow {
+		for _, f := range data.Fields() {
+			if sensor, ok := f.Prop("sensor").(string); ok && sensor != "" {
+				w.sensorOf[f.Name()] = sensor
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *avroWriter) decode(b []byte) (any, error) {
+	var m map[string]any
+	if err := avro.Unmarshal(w.schema, b, &m); err != nil {
+		return nil, err
+	}
+	switch w.record {
+	case RecordPayload:
+		data, _ := m["data"].(map[string]any)
+		return model.Payload{NumOfData: int(asInt64(m["num_of_data"])), Data: w.data(data), ProducedAt: asInt64(m["produced_at"])}, nil
+	case RecordPayloadBatch:
+		list, _ := m["data"].([]any)
+		p := model.PayloadBatch{NumOfData: int(asInt64(m["num_of_data"])), Data: make([]model.Data, 0, len(list)), ProducedAt: asInt64(m["produced_at"])}
+		for _, d := range list {
+			data, _ := d.(map[string]any)
+			p.Data = append(p.Data, w.data(data))
+		}
+		return p, nil
+	case RecordData:
+		return w.data(m), nil
+	}
+	str := func(k string) string { s, _ := m[k].(string); return s }
+	return model.CSVRow{
+		ID: str("id"), Vincode: str("vincode"), ResourceID: str("resource_id"), ResourceName: str("resource_name"),
+		Value: str("value"), CapturedTS: asInt64(m["captured_ts"]), TS: asInt64(m["ts"]), Source: str("source"), NsTS: asInt64(m["ns_ts"]),
+	}, nil
+}
+
+func (w *avroWriter) data(m map[string]any) model.Data {
+	d := model.Data{Metrics: make(map[string]model.MetricValue)}
+	d.ID, _ = m["id"].(string)
+	for field, v := range m {
+		switch field {
+		case "id":
+		case "extra":
+			extra, _ := v.(map[string]any)
+			for sensor, native := range extra {
+				nm, _ := native.(map[string]any)
+				d.Metrics[sensor] = avroMetricValue(nm)
+			}
+		default:
+			// An optional field is nil or the union branch {"bethos.MetricValue": {...}}.
+			branch, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			for _, native := range branch {
+				nm, _ := native.(map[string]any)
+				sensor := field
+				if s, ok := w.sensorOf[field]; ok {
+					sensor = s
+				}
+				d.Metrics[sensor] = avroMetricValue(nm)
+			}
+		}
+	}
+	return d
+}
+
+func avroMetricValue(m map[string]any) model.MetricValue {
+	return model.MetricValue{Value: m["value"], ReceivedAt: asInt64(m["received_at"]), ReceivedAtNs: asInt64(m["received_at_ns"])}
+}
+
+func asInt64(v any) int64 {
+	switch x := v.(type) {
+	case int64:
+		return x
+	case int:
+		return int64(x)
+	case int32:
+		return int64(x)
+	}
+	return 0
+}
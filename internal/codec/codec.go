@@ -0,0 +1,398 @@
+// Package codec encodes model.Payload, model.PayloadBatch, model.Data and model.CSVRow as JSON, Avro or
+// Protobuf. The Avro and Protobuf schemas are derived from the sensor list of the resource matrix: each known
+// sensor is a field of Data, other sensors go in its extra map. With a Registry, schemas are registered under
+// their record name (e.g. bethos.Payload) and messages are framed in the Confluent wire format.
+package codec
+
+import (
+	"bethos/internal/model"
+	"bethos/internal/resource"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Encodings.
+const (
+	EncodingJSON     = "json"
+	EncodingAvro     = "avro"
+	EncodingProtobuf = "protobuf"
+)
+
+var Encodings = []string{EncodingJSON, EncodingAvro, EncodingProtobuf}
+
+// Records: the model types with a schema, by their config name.
+const (
+	RecordPayload      = "payload"
+	RecordPayloadBatch = "payload_batch"
+	RecordData         = "data"
+	RecordCSVRow       = "csv_row"
+)
+
+var Records = []string{RecordPayload, RecordPayloadBatch, RecordData, RecordCSVRow}
+
+// Namespace of the Avro records and package of the Protobuf messages.
+const Namespace = "bethos"
+
+// recordNames are the schema names of Records (without Namespace).
+var recordNames = map[string]string{
+	RecordPayload:      "Payload",
+	RecordPayloadBatch: "PayloadBatch",
+	RecordData:         "Data",
+	RecordCSVRow:       "CSVRow",
+}
+
+// RecordOf returns the record of a model value (by value or pointer), false if it has no schema.
+func RecordOf(v any) (string, bool) {
+	switch v.(type) {
+	case model.Payload, *model.Payload:
+		return RecordPayload, true
+	case model.PayloadBatch, *model.PayloadBatch:
+		return RecordPayloadBatch, true
+	case model.Data, *model.Data:
+		return RecordData, true
+	case model.CSVRow, *model.CSVRow:
+		return RecordCSVRow, true
+	}
+	return "", false
+}
+
+// Sensors returns the sensor names of the resource matrix (resource_name), without duplicates, in matrix
+// order. Protobuf field numbers follow this order, so new resources must be appended to the matrix.
+func Sensors(resources []resource.Resource) []string {
+	seen := make(map[string]bool, len(resources))
+	var sensors []string
+	for _, r := range resources {
+		if r.ResourceName == "" || seen[r.ResourceName] {
+			continue
+		}
+		seen[r.ResourceName] = true
+		sensors = append(sensors, r.ResourceName)
+	}
+	return sensors
+}
+
+// sensorField is a sensor of the schema and the Data field holding it.
+type sensorField struct {
+	Sensor string
+	Field  string // a valid Avro and Protobuf name
+	Number int32  // Protobuf field number
+}
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// firstSensorNumber is the Protobuf field number of the first sensor; 1 and 2 are id and extra.
+const firstSensorNumber = 16
+
+// sensorFields names the field of each sensor: invalid characters become _, a leading digit gets a _ prefix
+// and a name already used (including id and extra) gets a _<n> suffix.
+func sensorFields(sensors []string) []sensorField {
+	used := map[string]bool{"id": true, "extra": true}
+	fields := make([]sensorField, 0, len(sensors))
+	for i, sensor := range sensors {
+		base := invalidNameChars.ReplaceAllString(sensor, "_")
+		if base == "" || (base[0] >= '0' && base[0] <= '9') {
+			base = "_" + base
+		}
+		name := base
+		for n := 2; used[name]; n++ {
+			name = base + "_" + strconv.Itoa(n)
+		}
+		used[name] = true
+		fields = append(fields, sensorField{Sensor: sensor, Field: name, Number: int32(firstSensorNumber + i)})
+	}
+	return fields
+}
+
+// Codec encodes and decodes the Records in one Encoding. Safe for concurrent use.
+type Codec struct {
+	Encoding string
+	Registry *Registry // nil = messages are not framed and no schema is registered
+
+	sensors []sensorField
+	avro    *avroSchemas
+	proto   *protoSchemas
+
+	mu      sync.Mutex
+	ids     map[string]int    // record -> schema id registered
+	writers map[int]writerRef // schema id -> schema read from the Registry
+}
+
+// writerRef is a schema read from the Registry for decoding.
+type writerRef struct {
+	record string
+	avro   *avroWriter // Avro only
+}
+
+// New returns a codec for encoding with the given sensors (see Sensors); reg is optional.
+func New(encoding string, sensors []string, reg *Registry) (*Codec, error) {
+	c := &Codec{Encoding: encoding, Registry: reg, sensors: sensorFields(sensors)}
+	var err error
+	switch encoding {
+	case EncodingJSON:
+	case EncodingAvro:
+		c.avro, err = newAvroSchemas(c.sensors)
+	case EncodingProtobuf:
+		c.proto, err = newProtoSchemas(c.sensors)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q (want one of %v)", encoding, Encodings)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s schema: %w", encoding, err)
+	}
+	return c, nil
+}
+
+// Schema returns the schema text of record: Avro JSON or a .proto file; empty for JSON.
+func (c *Codec) Schema(record string) string {
+	switch c.Encoding {
+	case EncodingAvro:
+		return c.avro.text[record]
+	case EncodingProtobuf:
+		return c.proto.text[record]
+	}
+	return ""
+}
+
+// Encode encodes v (a model.Payload, PayloadBatch, Data or CSVRow). With a Registry, its schema is
+// registered on first use and the returned schema id (0 otherwise) is the one framing the message.
+func (c *Codec) Encode(ctx context.Context, v any) ([]byte, int, error) {
+	record, ok := RecordOf(v)
+	if !ok {
+		return nil, 0, fmt.Errorf("no schema for %T", v)
+	}
+	var body []byte
+	var err error
+	switch c.Encoding {
+	case EncodingJSON:
+		b, err := json.Marshal(v)
+		return b, 0, err
+	case EncodingAvro:
+		body, err = c.avro.encode(record, v)
+	case EncodingProtobuf:
+		body, err = c.proto.encode(record, v)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s %s: %w", c.Encoding, record, err)
+	}
+	if c.Registry == nil {
+		return body, 0, nil
+	}
+	id, err := c.schemaID(ctx, record)
+	if err != nil {
+		return nil, 0, err
+	}
+	return frame(id, c.Encoding == EncodingProtobuf, body), id, nil
+}
+
+// schemaID registers the schema of record under its subject, once.
+func (c *Codec) schemaID(ctx context.Context, record string) (int, error) {
+	c.mu.Lock()
+	id, ok := c.ids[record]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	id, err := c.Registry.Register(ctx, Subject(record), c.schemaType(), c.Schema(record))
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	if c.ids == nil {
+		c.ids = make(map[string]int)
+	}
+	c.ids[record] = id
+	c.mu.Unlock()
+	return id, nil
+}
+
+// Subject is the registry subject of record: its full name (record name strategy).
+func Subject(record string) string {
+	return Namespace + "." + recordNames[record]
+}
+
+func (c *Codec) schemaType() string {
+	if c.Encoding == EncodingProtobuf {
+		return SchemaTypeProtobuf
+	}
+	return SchemaTypeAvro
+}
+
+// Decode decodes b into a model.Payload, PayloadBatch, Data or CSVRow. A framed message (Registry set) is
+// decoded as the record of its schema id, with the Avro writer schema; otherwise as record.
+func (c *Codec) Decode(ctx context.Context, b []byte, record string) (any, error) {
+	if c.Encoding == EncodingJSON {
+		return DecodeJSON(b, record)
+	}
+	var avroWriter *avroWriter
+	if c.Registry != nil {
+		id, body, err := unframe(b, c.Encoding == EncodingProtobuf)
+		if err != nil {
+			return nil, err
+		}
+		w, err := c.writer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		b, record, avroWriter = body, w.record, w.avro
+	}
+	if _, ok := recordNames[record]; !ok {
+		return nil, fmt.Errorf("unknown record %q (want one of %v)", record, Records)
+	}
+
+	var v any
+	var err error
+	if c.Encoding == EncodingAvro {
+		if avroWriter == nil {
+			avroWriter = c.avro.writers[record]
+		}
+		v, err = avroWriter.decode(b)
+	} else {
+		v, err = c.proto.decode(record, b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", c.Encoding, record, err)
+	}
+	return v, nil
+}
+
+// writer returns the schema registered as id, read from the Registry once.
+func (c *Codec) writer(ctx context.Context, id int) (writerRef, error) {
+	c.mu.Lock()
+	w, ok := c.writers[id]
+	c.mu.Unlock()
+	if ok {
+		return w, nil
+	}
+	schemaType, text, err := c.Registry.Schema(ctx, id)
+	if err != nil {
+		return writerRef{}, err
+	}
+	if schemaType != c.schemaType() {
+		return writerRef{}, fmt.Errorf("schema %d is %s, want %s", id, schemaType, c.schemaType())
+	}
+	if c.Encoding == EncodingAvro {
+		aw, err := parseAvroWriter(text)
+		if err != nil {
+			return writerRef{}, fmt.Errorf("schema %d: %w", id, err)
+		}
+		w = writerRef{record: aw.record, avro: aw}
+	} else if w.record, err = protoRecord(text); err != nil {
+		return writerRef{}, fmt.Errorf("schema %d: %w", id, err)
+	}
+	c.mu.Lock()
+	if c.writers == nil {
+		c.writers = make(map[int]writerRef)
+	}
+	c.writers[id] = w
+	c.mu.Unlock()
+	return w, nil
+}
+
+// DetectRecord returns the record a JSON message holds: payload_batch if its data is an array, payload if
+// data is an object, csv_row if it has resource_name, data if it has id.
+func DetectRecord(b []byte) (string, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return "", err
+	}
+	if data, ok := keys["data"]; ok {
+		if d := bytes.TrimSpace(data); len(d) > 0 && d[0] == '[' {
+			return RecordPayloadBatch, nil
+		}
+		return RecordPayload, nil
+	}
+	if _, ok := keys["resource_name"]; ok {
+		return RecordCSVRow, nil
+	}
+	if _, ok := keys["id"]; ok {
+		return RecordData, nil
+	}
+	return "", errors.New("not a payload, payload batch, data or csv row")
+}
+
+// DecodeJSON decodes a JSON message holding record.
+func DecodeJSON(b []byte, record string) (any, error) {
+	var err error
+	switch record {
+	case RecordPayload:
+		var v model.Payload
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case RecordPayloadBatch:
+		var v model.PayloadBatch
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case RecordData:
+		var v model.Data
+		err = json.Unmarshal(b, &v)
+		return v, err
+	case RecordCSVRow:
+		var v model.CSVRow
+		err = json.Unmarshal(b, &v)
+		return v, err
+	}
+	return nil, fmt.Errorf("unknown record %q (want one of %v)", record, Records)
+}
+
+// metricValue is the value of a model.MetricValue as encoded: nil, bool, int64, float64 or string.
+func metricValue(v any) (any, error) {
+	switch x := v.(type) {
+	case nil, bool, int64, float64, string:
+		return x, nil
+	case int:
+		return int64(x), nil
+	case int8:
+		return int64(x), nil
+	case int16:
+		return int64(x), nil
+	case int32:
+		return int64(x), nil
+	case uint:
+		return uintValue(uint64(x))
+	case uint8:
+		return int64(x), nil
+	case uint16:
+		return int64(x), nil
+	case uint32:
+		return int64(x), nil
+	case uint64:
+		return uintValue(x)
+	case float32:
+		return float64(x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		return x.Float64()
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+func uintValue(u uint64) (any, error) {
+	if u > math.MaxInt64 {
+		return nil, errors.New("value overflows int64")
+	}
+	return int64(u), nil
+}
+
+// payloadOf returns v as a model value of its record, dereferenced.
+func payloadOf(v any) any {
+	switch x := v.(type) {
+	case *model.Payload:
+		return *x
+	case *model.PayloadBatch:
+		return *x
+	case *model.Data:
+		return *x
+	case *model.CSVRow:
+		return *x
+	}
+	return v
+}
@@ -0,0 +1,181 @@
+package codec
+
+import (
+	"bethos/internal/model"
+	"bethos/internal/resource"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testSensors = []string{"speed", "l/r_hd", "odometer", "door_open"}
+
+func testValues() []any {
+	data := model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+		"speed":    {Value: 12.5, ReceivedAt: 1000, ReceivedAtNs: 7},
+		"l/r_hd":   {Value: "L", ReceivedAt: 1001},
+		"odometer": {Value: int64(123456), ReceivedAt: 1002},
+		"unknown":  {Value: true, ReceivedAt: 1003}, // not in the schema: extra
+	}}
+	empty := model.Data{ID: "VIN2", Metrics: map[string]model.MetricValue{"door_open": {Value: nil, ReceivedAt: 5}}}
+	return []any{
+		model.Payload{NumOfData: 1, Data: data, ProducedAt: 2000},
+		model.PayloadBatch{NumOfData: 2, Data: []model.Data{data, empty}, ProducedAt: 2000},
+		data,
+		model.CSVRow{ID: "1", Vincode: "VIN1", ResourceID: "content.1", ResourceName: "speed", Value: "12.5", CapturedTS: 1, TS: 2, Source: "csv", NsTS: 3},
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for _, encoding := range Encodings {
+		c, err := New(encoding, testSensors, nil)
+		if err != nil {
+			t.Fatalf("New(%s): %v", encoding, err)
+		}
+		for _, v := range testValues() {
+			record, _ := RecordOf(v)
+			b, id, err := c.Encode(ctx, v)
+			if err != nil || id != 0 {
+				t.Fatalf("%s %s: Encode = id %d, %v", encoding, record, id, err)
+			}
+			got, err := c.Decode(ctx, b, record)
+			if err != nil {
+				t.Fatalf("%s %s: Decode: %v", encoding, record, err)
+			}
+			want, _ := json.Marshal(v)
+			gotJSON, _ := json.Marshal(got)
+			if string(gotJSON) != string(want) {
+				t.Errorf("%s %s round trip:\n got %s\nwant %s", encoding, record, gotJSON, want)
+			}
+		}
+	}
+}
+
+func TestCodec_CompactAndTyped(t *testing.T) {
+	ctx := context.Background()
+	p := testValues()[0]
+	jsonBytes, _ := json.Marshal(p)
+	for _, encoding := range []string{EncodingAvro, EncodingProtobuf} {
+		c, _ := New(encoding, testSensors, nil)
+		b, _, err := c.Encode(ctx, p)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if len(b) >= len(jsonBytes)/2 {
+			t.Errorf("%s: %d bytes, JSON %d: want less than half", encoding, len(b), len(jsonBytes))
+		}
+		got, _ := c.Decode(ctx, b, RecordPayload)
+		if v := got.(model.Payload).Data.Metrics["odometer"].Value; v != int64(123456) {
+			t.Errorf("%s: odometer = %#v, want int64", encoding, v)
+		}
+
+		bad := model.Payload{Data: model.Data{ID: "V", Metrics: map[string]model.MetricValue{"speed": {Value: []int{1}}}}}
+		if _, _, err := c.Encode(ctx, bad); err == nil || !strings.Contains(err.Error(), "unsupported value type") {
+			t.Errorf("%s: slice value: want unsupported value type error, got %v", encoding, err)
+		}
+	}
+}
+
+func TestCodec_Registry(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(&MemoryRegistry{})
+	defer srv.Close()
+
+	for _, encoding := range []string{EncodingAvro, EncodingProtobuf} {
+		enc, _ := New(encoding, testSensors, NewRegistry(srv.URL))
+		ids := make(map[string]int)
+		var framed [][]byte
+		for _, v := range testValues() {
+			record, _ := RecordOf(v)
+			b, id, err := enc.Encode(ctx, v)
+			if err != nil {
+				t.Fatalf("%s %s: %v", encoding, record, err)
+			}
+			if id == 0 || b[0] != 0 {
+				t.Errorf("%s %s: id %d, magic %d: want a framed message", encoding, record, id, b[0])
+			}
+			if again, id2, _ := enc.Encode(ctx, v); id2 != id || string(again) != string(b) {
+				t.Errorf("%s %s: second encode differs (id %d, %d)", encoding, record, id2, id)
+			}
+			ids[record] = id
+			framed = append(framed, b)
+		}
+		if len(ids) != len(Records) {
+			t.Errorf("%s: ids %v: want one per record", encoding, ids)
+		}
+
+		// A consumer with a different sensor list decodes with the writer's record (and Avro schema).
+		dec, _ := New(encoding, []string{"speed"}, NewRegistry(srv.URL))
+		for i, v := range testValues() {
+			got, err := dec.Decode(ctx, framed[i], "")
+			if err != nil {
+				t.Fatalf("%s: Decode: %v", encoding, err)
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(v) {
+				t.Errorf("%s: decoded %T, want %T", encoding, got, v)
+			}
+			if p, ok := got.(model.Payload); ok {
+				_, hasLR := p.Data.Metrics["l/r_hd"]
+				if encoding == EncodingAvro && !hasLR {
+					t.Errorf("avro: writer schema field l/r_hd lost: %v", p.Data.Metrics)
+				}
+				if p.Data.Metrics["speed"].Value != 12.5 {
+					t.Errorf("%s: speed = %v", encoding, p.Data.Metrics["speed"].Value)
+				}
+			}
+		}
+
+		if _, err := dec.Decode(ctx, []byte("{}"), RecordPayload); err == nil {
+			t.Errorf("%s: unframed message with a registry: want error", encoding)
+		}
+	}
+
+	reg := NewRegistry(srv.URL)
+	if _, _, err := reg.Schema(ctx, 999); err == nil || !strings.Contains(err.Error(), "40403") {
+		t.Errorf("unknown id: want error 40403, got %v", err)
+	}
+}
+
+func TestCodec_ResourceMatrixSchema(t *testing.T) {
+	resources, err := resource.LoadResourceList("../../config/resource_matrix.json")
+	if err != nil {
+		t.Fatalf("LoadResourceList: %v", err)
+	}
+	sensors := Sensors(resources)
+	for _, encoding := range []string{EncodingAvro, EncodingProtobuf} {
+		c, err := New(encoding, sensors, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		schema := c.Schema(RecordData)
+		if !strings.Contains(schema, "l_r_hd") || !strings.Contains(schema, `"l/r_hd"`) {
+			t.Errorf("%s: want field l_r_hd mapped to sensor l/r_hd in\n%s", encoding, schema)
+		}
+		d := model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+			"l/r_hd":                                {Value: "R", ReceivedAt: 1},
+			"average_power_consumption_(non-vfe34)": {Value: 1.5, ReceivedAt: 1},
+		}}
+		b, _, err := c.Encode(context.Background(), d)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		got, _ := c.Decode(context.Background(), b, RecordData)
+		if !reflect.DeepEqual(got, d) {
+			t.Errorf("%s: round trip = %v, want %v", encoding, got, d)
+		}
+	}
+}
+
+func TestSensorFields(t *testing.T) {
+	got := sensorFields([]string{"speed", "l/r_hd", "l_r_hd", "9volt", "id"})
+	want := []string{"speed", "l_r_hd", "l_r_hd_2", "_9volt", "id_2"}
+	for i, f := range got {
+		if f.Field != want[i] || f.Number != int32(firstSensorNumber+i) {
+			t.Errorf("%s: field %s #%d, want %s #%d", f.Sensor, f.Field, f.Number, want[i], firstSensorNumber+i)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryRegistry is an in-process stand-in for a schema registry, serving the endpoints Registry uses
+// (POST /subjects/{subject}/versions, GET /schemas/ids/{id}). Serve it with httptest.NewServer in tests or
+// http.ListenAndServe for a local run without a registry.
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	schemas  []registrySchema          // index = id - 1
+	subjects map[string]map[string]int // subject -> schema text -> id
+}
+
+func (m *MemoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", registryContentType)
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/subjects/") && strings.HasSuffix(r.URL.Path, "/versions"):
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		var s registrySchema
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Schema == "" {
+			writeRegistryError(w, http.StatusUnprocessableEntity, 42201, "Invalid schema")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(registrySchema{ID: m.register(subject, s)})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if id < 1 || id > len(m.schemas) {
+			writeRegistryError(w, http.StatusNotFound, 40403, "Schema not found")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(m.schemas[id-1])
+	default:
+		writeRegistryError(w, http.StatusNotFound, 404, "Not found")
+	}
+}
+
+// register returns the id of s under subject, adding it if new. The same text under another subject gets
+// the same id, as in the Confluent registry.
+func (m *MemoryRegistry) register(subject string, s registrySchema) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subjects == nil {
+		m.subjects = make(map[string]map[string]int)
+	}
+	if id, ok := m.subjects[subject][s.Schema]; ok {
+		return id
+	}
+	id := 0
+	for i, known := range m.schemas {
+		if known.Schema == s.Schema && known.SchemaType == s.SchemaType {
+			id = i + 1
+			break
+		}
+	}
+	if id == 0 {
+		m.schemas = append(m.schemas, registrySchema{Schema: s.Schema, SchemaType: s.SchemaType})
+		id = len(m.schemas)
+	}
+	if m.subjects[subject] == nil {
+		m.subjects[subject] = make(map[string]int)
+	}
+	m.subjects[subject][s.Schema] = id
+	return id
+}
+
+func writeRegistryError(w http.ResponseWriter, status, code int, msg string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(registryError{ErrorCode: code, Message: msg})
+}
@@ -0,0 +1,395 @@
+package codec
+
+import (
+	"bethos/internal/model"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoMessageDef and protoFieldDef describe the Protobuf messages, rendered both as a descriptor and as
+// .proto text for the Registry.
+type protoMessageDef struct {
+	Name   string
+	Oneof  string // name of the oneof of the fields with InOneof
+	Fields []protoFieldDef
+}
+
+type protoFieldDef struct {
+	Name     string
+	Number   int32
+	Type     string // string, int64, double, bool or a message name
+	Repeated bool
+	MapValue string // set for map<string, MapValue>
+	InOneof  bool
+	JSONName string // the sensor, when it differs from Name
+}
+
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+// MetricValue.value oneof fields.
+const (
+	protoBoolValue   = "bool_value"
+	protoLongValue   = "long_value"
+	protoDoubleValue = "double_value"
+	protoStringValue = "string_value"
+)
+
+func protoMetricValueDef() protoMessageDef {
+	return protoMessageDef{Name: "MetricValue", Oneof: "value", Fields: []protoFieldDef{
+		{Name: protoBoolValue, Number: 1, Type: "bool", InOneof: true},
+		{Name: protoLongValue, Number: 2, Type: "int64", InOneof: true},
+		{Name: protoDoubleValue, Number: 3, Type: "double", InOneof: true},
+		{Name: protoStringValue, Number: 4, Type: "string", InOneof: true},
+		{Name: "received_at", Number: 5, Type: "int64"},
+		{Name: "received_at_ns", Number: 6, Type: "int64"},
+	}}
+}
+
+func protoDataDef(sensors []sensorField) protoMessageDef {
+	def := protoMessageDef{Name: "Data", Fields: []protoFieldDef{
+		{Name: "id", Number: 1, Type: "string"},
+		{Name: "extra", Number: 2, MapValue: "MetricValue"},
+	}}
+	for _, f := range sensors {
+		field := protoFieldDef{Name: f.Field, Number: f.Number, Type: "MetricValue"}
+		if f.Field != f.Sensor {
+			field.JSONName = f.Sensor
+		}
+		def.Fields = append(def.Fields, field)
+	}
+	return def
+}
+
+// protoFileDefs returns the messages of each record's schema, the record's message first.
+func protoFileDefs(sensors []sensorField) map[string][]protoMessageDef {
+	data, metric := protoDataDef(sensors), protoMetricValueDef()
+	payload := func(name string, repeated bool) protoMessageDef {
+		return protoMessageDef{Name: name, Fields: []protoFieldDef{
+			{Name: "num_of_data", Number: 1, Type: "int64"},
+			{Name: "data", Number: 2, Type: "Data", Repeated: repeated},
+			{Name: "produced_at", Number: 3, Type: "int64"},
+		}}
+	}
+	return map[string][]protoMessageDef{
+		RecordPayload:      {payload("Payload", false), data, metric},
+		RecordPayloadBatch: {payload("PayloadBatch", true), data, metric},
+		RecordData:         {data, metric},
+		RecordCSVRow: {{Name: "CSVRow", Fields: []protoFieldDef{
+			{Name: "id", Number: 1, Type: "string"},
+			{Name: "vincode", Number: 2, Type: "string"},
+			{Name: "resource_id", Number: 3, Type: "string"},
+			{Name: "resource_name", Number: 4, Type: "string"},
+			{Name: "value", Number: 5, Type: "string"},
+			{Name: "captured_ts", Number: 6, Type: "int64"},
+			{Name: "ts", Number: 7, Type: "int64"},
+			{Name: "source", Number: 8, Type: "string"},
+			{Name: "ns_ts", Number: 9, Type: "int64"},
+		}}},
+	}
+}
+
+func protoText(msgs []protoMessageDef) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "syntax = \"proto3\";\npackage %s;\n", Namespace)
+	for _, m := range msgs {
+		fmt.Fprintf(&b, "\nmessage %s {\n", m.Name)
+		inOneof := false
+		for _, f := range m.Fields {
+			if f.InOneof && !inOneof {
+				fmt.Fprintf(&b, "  oneof %s {\n", m.Oneof)
+			} else if !f.InOneof && inOneof {
+				b.WriteString("  }\n")
+			}
+			inOneof = f.InOneof
+			indent := "  "
+			if f.InOneof {
+				indent = "    "
+			}
+			typ := f.Type
+			if f.MapValue != "" {
+				typ = "map<string, " + f.MapValue + ">"
+			} else if f.Repeated {
+				typ = "repeated " + typ
+			}
+			opts := ""
+			if f.JSONName != "" {
+				opts = " [json_name = " + strconv.Quote(f.JSONName) + "]"
+			}
+			fmt.Fprintf(&b, "%s%s %s = %d%s;\n", indent, typ, f.Name, f.Number, opts)
+		}
+		if inOneof {
+			b.WriteString("  }\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func protoFileDescriptor(record string, msgs []protoMessageDef) (protoreflect.FileDescriptor, error) {
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	message := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+	typeName := func(name string) *string { return proto.String("." + Namespace + "." + name) }
+
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(Namespace + "/" + record + ".proto"),
+		Package: proto.String(Namespace),
+		Syntax:  proto.String("proto3"),
+	}
+	for _, m := range msgs {
+		dp := &descriptorpb.DescriptorProto{Name: proto.String(m.Name)}
+		if m.Oneof != "" {
+			dp.OneofDecl = []*descriptorpb.OneofDescriptorProto{{Name: proto.String(m.Oneof)}}
+		}
+		for _, f := range m.Fields {
+			field := &descriptorpb.FieldDescriptorProto{Name: proto.String(f.Name), Number: proto.Int32(f.Number), Label: optional}
+			switch {
+			case f.MapValue != "":
+				entry := strings.ToUpper(f.Name[:1]) + f.Name[1:] + "Entry"
+				dp.NestedType = append(dp.NestedType, &descriptorpb.DescriptorProto{
+					Name: proto.String(entry),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("key"), Number: proto.Int32(1), Label: optional, Type: protoScalars["string"].Enum(), JsonName: proto.String("key")},
+						{Name: proto.String("value"), Number: proto.Int32(2), Label: optional, Type: message, TypeName: typeName(f.MapValue), JsonName: proto.String("value")},
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				})
+				field.Label, field.Type, field.TypeName = repeated, message, typeName(m.Name+"."+entry)
+			case protoScalars[f.Type] != 0:
+				field.Type = protoScalars[f.Type].Enum()
+			default:
+				field.Type, field.TypeName = message, typeName(f.Type)
+			}
+			if f.Repeated {
+				field.Label = repeated
+			}
+			if f.InOneof {
+				field.OneofIndex = proto.Int32(0)
+			}
+			if f.JSONName != "" {
+				field.JsonName = proto.String(f.JSONName)
+			}
+			dp.Field = append(dp.Field, field)
+		}
+		fd.MessageType = append(fd.MessageType, dp)
+	}
+	return protodesc.NewFile(fd, nil)
+}
+
+// protoSchemas holds the Protobuf schema of each record.
+type protoSchemas struct {
+	text     map[string]string
+	desc     map[string]protoreflect.MessageDescriptor
+	bySensor map[string]sensorField
+	byNumber map[protoreflect.FieldNumber]string // Data field number -> sensor
+}
+
+func newProtoSchemas(sensors []sensorField) (*protoSchemas, error) {
+	s := &protoSchemas{
+		text:     make(map[string]string),
+		desc:     make(map[string]protoreflect.MessageDescriptor),
+		bySensor: make(map[string]sensorField, len(sensors)),
+		byNumber: make(map[protoreflect.FieldNumber]string, len(sensors)),
+	}
+	for _, f := range sensors {
+		s.bySensor[f.Sensor] = f
+		s.byNumber[protoreflect.FieldNumber(f.Number)] = f.Sensor
+	}
+	for record, msgs := range protoFileDefs(sensors) {
+		file, err := protoFileDescriptor(record, msgs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", record, err)
+		}
+		s.text[record] = protoText(msgs)
+		s.desc[record] = file.Messages().Get(0)
+	}
+	return s, nil
+}
+
+var protoMessageName = regexp.MustCompile(`(?m)^message (\w+) \{`)
+
+// protoRecord returns the record of the first message of a .proto schema.
+func protoRecord(text string) (string, error) {
+	m := protoMessageName.FindStringSubmatch(text)
+	if m == nil {
+		return "", errors.New("no message in schema")
+	}
+	for record, name := range recordNames {
+		if name == m[1] {
+			return record, nil
+		}
+	}
+	return "", fmt.Errorf("unknown message %s", m[1])
+}
+
+func (s *protoSchemas) encode(record string, v any) ([]byte, error) {
+	md := s.desc[record]
+	msg := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+	var err error
+	switch x := payloadOf(v).(type) {
+	case model.Payload:
+		msg.Set(fields.ByName("num_of_data"), protoreflect.ValueOfInt64(int64(x.NumOfData)))
+		var data protoreflect.Message
+		if data, err = s.dataMessage(fields.ByName("data").Message(), x.Data); err == nil {
+			msg.Set(fields.ByName("data"), protoreflect.ValueOfMessage(data))
+		}
+		msg.Set(fields.ByName("produced_at"), protoreflect.ValueOfInt64(x.ProducedAt))
+	case model.PayloadBatch:
+		msg.Set(fields.ByName("num_of_data"), protoreflect.ValueOfInt64(int64(x.NumOfData)))
+		list := msg.Mutable(fields.ByName("data")).List()
+		for _, d := range x.Data {
+			data, dErr := s.dataMessage(fields.ByName("data").Message(), d)
+			if dErr != nil {
+				err = dErr
+				break
+			}
+			list.Append(protoreflect.ValueOfMessage(data))
+		}
+		msg.Set(fields.ByName("produced_at"), protoreflect.ValueOfInt64(x.ProducedAt))
+	case model.Data:
+		var data protoreflect.Message
+		if data, err = s.dataMessage(md, x); err == nil {
+			msg = data.(*dynamicpb.Message)
+		}
+	case model.CSVRow:
+		for name, val := range map[string]protoreflect.Value{
+			"id": protoreflect.ValueOfString(x.ID), "vincode": protoreflect.ValueOfString(x.Vincode),
+			"resource_id": protoreflect.ValueOfString(x.ResourceID), "resource_name": protoreflect.ValueOfString(x.ResourceName),
+			"value": protoreflect.ValueOfString(x.Value), "captured_ts": protoreflect.ValueOfInt64(x.CapturedTS),
+			"ts": protoreflect.ValueOfInt64(x.TS), "source": protoreflect.ValueOfString(x.Source), "ns_ts": protoreflect.ValueOfInt64(x.NsTS),
+		} {
+			msg.Set(fields.ByName(protoreflect.Name(name)), val)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
+
+func (s *protoSchemas) dataMessage(md protoreflect.MessageDescriptor, d model.Data) (protoreflect.Message, error) {
+	msg := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+	msg.Set(fields.ByName("id"), protoreflect.ValueOfString(d.ID))
+	extraFD := fields.ByName("extra")
+	metricMD := extraFD.MapValue().Message()
+	for sensor, mv := range d.Metrics {
+		metric, err := protoMetricValue(metricMD, mv)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", d.ID, sensor, err)
+		}
+		if f, ok := s.bySensor[sensor]; ok {
+			msg.Set(fields.ByNumber(protoreflect.FieldNumber(f.Number)), protoreflect.ValueOfMessage(metric))
+		} else {
+			msg.Mutable(extraFD).Map().Set(protoreflect.ValueOfString(sensor).MapKey(), protoreflect.ValueOfMessage(metric))
+		}
+	}
+	return msg, nil
+}
+
+func protoMetricValue(md protoreflect.MessageDescriptor, mv model.MetricValue) (protoreflect.Message, error) {
+	msg := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+	value, err := metricValue(mv.Value)
+	if err != nil {
+		return nil, err
+	}
+	switch x := value.(type) {
+	case bool:
+		msg.Set(fields.ByName(protoBoolValue), protoreflect.ValueOfBool(x))
+	case int64:
+		msg.Set(fields.ByName(protoLongValue), protoreflect.ValueOfInt64(x))
+	case float64:
+		msg.Set(fields.ByName(protoDoubleValue), protoreflect.ValueOfFloat64(x))
+	case string:
+		msg.Set(fields.ByName(protoStringValue), protoreflect.ValueOfString(x))
+	}
+	msg.Set(fields.ByName("received_at"), protoreflect.ValueOfInt64(mv.ReceivedAt))
+	msg.Set(fields.ByName("received_at_ns"), protoreflect.ValueOfInt64(mv.ReceivedAtNs))
+	return msg, nil
+}
+
+func (s *protoSchemas) decode(record string, b []byte) (any, error) {
+	md := s.desc[record]
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	fields := md.Fields()
+	switch record {
+	case RecordPayload:
+		return model.Payload{
+			NumOfData:  int(msg.Get(fields.ByName("num_of_data")).Int()),
+			Data:       s.data(msg.Get(fields.ByName("data")).Message()),
+			ProducedAt: msg.Get(fields.ByName("produced_at")).Int(),
+		}, nil
+	case RecordPayloadBatch:
+		list := msg.Get(fields.ByName("data")).List()
+		p := model.PayloadBatch{
+			NumOfData:  int(msg.Get(fields.ByName("num_of_data")).Int()),
+			Data:       make([]model.Data, 0, list.Len()),
+			ProducedAt: msg.Get(fields.ByName("produced_at")).Int(),
+		}
+		for i := 0; i < list.Len(); i++ {
+			p.Data = append(p.Data, s.data(list.Get(i).Message()))
+		}
+		return p, nil
+	case RecordData:
+		return s.data(msg), nil
+	}
+	str := func(name string) string { return msg.Get(fields.ByName(protoreflect.Name(name))).String() }
+	i64 := func(name string) int64 { return msg.Get(fields.ByName(protoreflect.Name(name))).Int() }
+	return model.CSVRow{
+		ID: str("id"), Vincode: str("vincode"), ResourceID: str("resource_id"), ResourceName: str("resource_name"),
+		Value: str("value"), CapturedTS: i64("captured_ts"), TS: i64("ts"), Source: str("source"), NsTS: i64("ns_ts"),
+	}, nil
+}
+
+// data converts a Data message; fields unknown to this schema (a writer with more sensors) are skipped.
+func (s *protoSchemas) data(msg protoreflect.Message) model.Data {
+	d := model.Data{Metrics: make(map[string]model.MetricValue)}
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.Name() == "id":
+			d.ID = v.String()
+		case fd.IsMap():
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				d.Metrics[k.String()] = fromProtoMetricValue(mv.Message())
+				return true
+			})
+		default:
+			if sensor, ok := s.byNumber[fd.Number()]; ok {
+				d.Metrics[sensor] = fromProtoMetricValue(v.Message())
+			}
+		}
+		return true
+	})
+	return d
+}
+
+func fromProtoMetricValue(msg protoreflect.Message) model.MetricValue {
+	fields := msg.Descriptor().Fields()
+	mv := model.MetricValue{
+		ReceivedAt:   msg.Get(fields.ByName("received_at")).Int(),
+		ReceivedAtNs: msg.Get(fields.ByName("received_at_ns")).Int(),
+	}
+	if fd := msg.WhichOneof(msg.Descriptor().Oneofs().ByName("value")); fd != nil {
+		mv.Value = msg.Get(fd).Interface()
+	}
+	return mv
+}
@@ -0,0 +1,146 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Schema types of the registry.
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+const registryContentType = "application/vnd.schemaregistry.v1+json"
+
+// Registry is a client of the subset of the Confluent Schema Registry REST API the codec uses: register a
+// schema under a subject and read a schema by id.
+type Registry struct {
+	URL    string
+	Client *http.Client // nil = a client with a 10s timeout
+}
+
+// NewRegistry returns a client of the registry at baseURL (e.g. http://localhost:8081).
+func NewRegistry(baseURL string) *Registry {
+	return &Registry{URL: strings.TrimRight(baseURL, "/")}
+}
+
+// registrySchema is the body of a schema in requests and responses.
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"` // empty = AVRO
+	ID         int    `json:"id,omitempty"`
+}
+
+type registryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Register registers schema under subject (a no-op returning the same id if it already is) and returns its id.
+func (r *Registry) Register(ctx context.Context, subject, schemaType, schema string) (int, error) {
+	req := registrySchema{Schema: schema}
+	if schemaType != SchemaTypeAvro {
+		req.SchemaType = schemaType
+	}
+	var resp registrySchema
+	if err := r.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", req, &resp); err != nil {
+		return 0, fmt.Errorf("schema registry: register %s: %w", subject, err)
+	}
+	return resp.ID, nil
+}
+
+// Schema returns the type and text of the schema registered as id.
+func (r *Registry) Schema(ctx context.Context, id int) (string, string, error) {
+	var resp registrySchema
+	if err := r.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return "", "", fmt.Errorf("schema registry: schema %d: %w", id, err)
+	}
+	if resp.SchemaType == "" {
+		resp.SchemaType = SchemaTypeAvro
+	}
+	return resp.SchemaType, resp.Schema, nil
+}
+
+func (r *Registry) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", registryContentType)
+	if in != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e registryError
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("status %d: error_code=%d %s", resp.StatusCode, e.ErrorCode, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// frame prefixes body with the Confluent wire format header: magic byte 0 and the schema id (big endian),
+// then for Protobuf the message indexes, here always the first message of the schema (a single 0).
+func frame(id int, protobuf bool, body []byte) []byte {
+	out := make([]byte, 5, 6+len(body))
+	binary.BigEndian.PutUint32(out[1:], uint32(id))
+	if protobuf {
+		out = append(out, 0)
+	}
+	return append(out, body...)
+}
+
+// unframe returns the schema id and the body of a framed message.
+func unframe(b []byte, protobuf bool) (int, []byte, error) {
+	if len(b) < 5 || b[0] != 0 {
+		return 0, nil, errors.New("not in the schema registry wire format (magic byte 0, schema id)")
+	}
+	id := int(binary.BigEndian.Uint32(b[1:5]))
+	body := b[5:]
+	if !protobuf {
+		return id, body, nil
+	}
+	// Message indexes: a zigzag varint count then the indexes; 0 alone means [0].
+	n, k := binary.Varint(body)
+	if k <= 0 {
+		return 0, nil, errors.New("invalid message indexes")
+	}
+	body = body[k:]
+	for i := int64(0); i < n; i++ {
+		idx, k := binary.Varint(body)
+		if k <= 0 {
+			return 0, nil, errors.New("invalid message indexes")
+		}
+		if idx != 0 {
+			return 0, nil, fmt.Errorf("message index %d: only the first message of the schema is supported", idx)
+		}
+		body = body[k:]
+	}
+	return id, body, nil
+}
@@ -0,0 +1,126 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"bethos/internal/merger"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+const (
+	defaultInterval  = 30 * time.Second
+	defaultBatchSize = 100
+)
+
+// Publisher implements service.BatchInput for the latest_state_publisher input: every interval it reads the
+// VIN index written by latest_merger's state_store strategy and emits the cached payload of each VIN (meta
+// vincode), in batches of up to batch_size. VINs listed in the index whose key has expired are skipped.
+type Publisher struct {
+	resources *service.Resources
+	cacheName string
+	indexKey  string
+	prefix    string
+	interval  time.Duration
+	batchSize int
+
+	pending service.MessageBatch
+	nextAt  time.Time // zero: read right away
+}
+
+// Config for the publisher input (parsed from Bento config).
+type Config struct {
+	CacheName string
+	IndexKey  string        // merger.DefaultStateIndexKey if empty
+	Prefix    string        // merger.DefaultStatePrefix if empty
+	Interval  time.Duration // between two reads of the whole state
+	BatchSize int
+}
+
+func New(res *service.Resources, cfg Config) (*Publisher, error) {
+	if cfg.CacheName == "" {
+		return nil, fmt.Errorf("latest_state_publisher: cache is required")
+	}
+	if cfg.IndexKey == "" {
+		cfg.IndexKey = merger.DefaultStateIndexKey
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = merger.DefaultStatePrefix
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	return &Publisher{
+		resources: res,
+		cacheName: cfg.CacheName,
+		indexKey:  cfg.IndexKey,
+		prefix:    cfg.Prefix,
+		interval:  cfg.Interval,
+		batchSize: cfg.BatchSize,
+	}, nil
+}
+
+func (p *Publisher) Connect(ctx context.Context) error {
+	return nil
+}
+
+func (p *Publisher) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	for len(p.pending) == 0 {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(time.Until(p.nextAt)):
+		}
+		p.nextAt = time.Now().Add(p.interval)
+
+		msgs, err := p.readState(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.pending = msgs
+	}
+
+	n := min(p.batchSize, len(p.pending))
+	batch := p.pending[:n]
+	p.pending = p.pending[n:]
+	return batch, func(context.Context, error) error { return nil }, nil
+}
+
+// readState reads the index, then the payload of every VIN it lists.
+func (p *Publisher) readState(ctx context.Context) (service.MessageBatch, error) {
+	var msgs service.MessageBatch
+	var err error
+	accessErr := p.resources.AccessCache(ctx, p.cacheName, func(c service.Cache) {
+		var vins []string
+		if vins, err = merger.ReadStateIndex(ctx, c, p.indexKey); err != nil {
+			return
+		}
+		for _, vin := range vins {
+			b, gErr := c.Get(ctx, p.prefix+vin)
+			if errors.Is(gErr, service.ErrKeyNotFound) {
+				continue
+			}
+			if gErr != nil {
+				err = fmt.Errorf("latest_state_publisher: get %s: %w", p.prefix+vin, gErr)
+				return
+			}
+			msg := service.NewMessage(b)
+			msg.MetaSet("vincode", vin)
+			msgs = append(msgs, msg)
+		}
+	})
+	if accessErr != nil {
+		return nil, fmt.Errorf("latest_state_publisher: cache %s: %w", p.cacheName, accessErr)
+	}
+	return msgs, err
+}
+
+func (p *Publisher) Close(ctx context.Context) error {
+	return nil
+}
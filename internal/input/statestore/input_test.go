@@ -0,0 +1,99 @@
+package statestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bethos/internal/merger"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func TestPublisher_ReadsStateWrittenByStrategy(t *testing.T) {
+	ctx := context.Background()
+	res := service.MockResources(service.MockResourcesOptAddCache("state"))
+	strat := &merger.StateStoreFlushStrategy{CacheName: "state", Resources: res}
+	state := merger.FlushState{
+		"VIN1": {"a": {Value: "1", ReceivedAt: 100}},
+		"VIN2": {"a": {Value: "2", ReceivedAt: 100}},
+		"VIN3": {"a": {Value: "3", ReceivedAt: 100}},
+	}
+	if _, err := strat.OnFlush(ctx, state); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	// Listed in the index but expired: skipped.
+	if err := res.AccessCache(ctx, "state", func(c service.Cache) {
+		_ = c.Delete(ctx, merger.DefaultStatePrefix+"VIN2")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(res, Config{CacheName: "state", Interval: time.Hour, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var got []string
+	for range 2 {
+		batch, ack, err := p.ReadBatch(ctx)
+		if err != nil {
+			t.Fatalf("ReadBatch: %v", err)
+		}
+		if len(batch) != 1 {
+			t.Fatalf("batch of %d, want batch_size 1", len(batch))
+		}
+		_ = ack(ctx, nil)
+		vin, _ := batch[0].MetaGet("vincode")
+		obj, err := batch[0].AsStructured()
+		if err != nil {
+			t.Fatalf("AsStructured: %v", err)
+		}
+		if id := obj.(map[string]any)["data"].(map[string]any)["id"]; id != vin {
+			t.Errorf("payload id %v, meta vincode %s", id, vin)
+		}
+		got = append(got, vin)
+	}
+	if len(got) != 2 || got[0] != "VIN1" || got[1] != "VIN3" {
+		t.Errorf("emitted %v, want [VIN1 VIN3]", got)
+	}
+
+	// Next read waits for the interval.
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := p.ReadBatch(waitCtx); err == nil {
+		t.Error("ReadBatch returned before the interval elapsed")
+	}
+}
+
+func TestPublisher_EmptyIndexWaits(t *testing.T) {
+	res := service.MockResources(service.MockResourcesOptAddCache("state"))
+	p, err := New(res, Config{CacheName: "state", Interval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		strat := &merger.StateStoreFlushStrategy{CacheName: "state", Resources: res}
+		_, _ = strat.OnFlush(context.Background(), merger.FlushState{"VIN1": {"a": {Value: "1"}}})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	batch, _, err := p.ReadBatch(ctx)
+	if err != nil {
+		t.Fatalf("ReadBatch: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("batch of %d, want 1", len(batch))
+	}
+	if vin, _ := batch[0].MetaGet("vincode"); vin != "VIN1" {
+		t.Errorf("vincode = %q, want VIN1", vin)
+	}
+}
+
+func TestNew_RequiresCache(t *testing.T) {
+	if _, err := New(service.MockResources(), Config{}); err == nil {
+		t.Fatal("New without cache returned nil error")
+	}
+}
@@ -2,6 +2,13 @@ package merger
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"bethos/internal/model"
@@ -10,67 +17,296 @@ import (
 )
 
 // LogCompactedFlushStrategy flushes merged state to Kafka. BatchSize controls how many devices per message (1 = one message per device).
+// With Tombstones, a device evicted for exceeding the TTL and not seen again within TombstoneGrace is
+// deleted from the compacted topic with a null-value message keyed by its vincode; a device back in the
+// merger's state (HasDevice) is not, even if the flush does not carry it (changed_* flush mode, scoped
+// trigger). A device evicted by a flush trigger's evict option is deleted on that flush, without grace.
+//
+// Batched (BatchSize > 1), devices are grouped into KeyBuckets buckets by VIN hash and each bucket is split,
+// in VIN order, into messages of at most BatchSize devices and MaxMessageBytes bytes. A message is keyed
+// bucket-<bucket>-<chunk> (meta vincode and batch_key) and lists its devices in meta vincodes, comma
+// separated. The strategy keeps the devices last emitted per bucket, so a bucket with any device in the
+// flush is emitted whole and the latest message per key stays complete in every flush mode. Keys a bucket no
+// longer fills get a tombstone; an evicted device (any reason) is removed from its bucket, without grace.
+// With several replicas writing one topic, their buckets share keys: give each replica its own topic.
 type LogCompactedFlushStrategy struct {
-	BatchSize int // if > 1, emit PayloadBatch with up to BatchSize devices per message to reduce network I/O
+	BatchSize       int // if > 1, emit PayloadBatch with up to BatchSize devices per message to reduce network I/O
+	MaxMessageBytes int // batched: max encoded size of a message (a larger device goes alone); 0 = no limit
+	KeyBuckets      int // batched: number of key buckets; 0 = 1
+	Tombstones      bool
+	TombstoneGrace  time.Duration
+	HasDevice       func(vin string) bool // merger state lookup (StrategyEnv.HasDevice); nil = only the flush state is checked
+
+	mu      sync.Mutex
+	pending map[string]int64                                // vin -> evicted at (unix ms), waiting for the grace period
+	buckets map[int]map[string]map[string]model.MetricValue // batched: bucket -> vin -> device, as last emitted
+	chunks  map[int]int                                     // batched: bucket -> messages emitted for it last time
 }
 
-func (s LogCompactedFlushStrategy) Close(ctx context.Context) error {
+func (s *LogCompactedFlushStrategy) Close(ctx context.Context) error {
 	return nil
 }
 
-func (s LogCompactedFlushStrategy) OnFlush(
+func (s *LogCompactedFlushStrategy) OnFlush(
 	ctx context.Context,
 	state FlushState,
 ) (service.MessageBatch, error) {
 	now := time.Now().UnixMilli()
+	s.cancelTombstones(state)
 	if s.BatchSize <= 1 {
 		return s.emitPerDevice(state, now)
 	}
 	return s.emitBatched(state, now)
 }
 
-func (s LogCompactedFlushStrategy) emitPerDevice(state FlushState, now int64) (service.MessageBatch, error) {
+func (s *LogCompactedFlushStrategy) emitPerDevice(state FlushState, now int64) (service.MessageBatch, error) {
 	var batch service.MessageBatch
-	for vin, dev := range state {
+	for _, vin := range sortedKeys(state) {
 		payload := model.Payload{
 			NumOfData:  1,
-			Data:       model.Data{ID: vin, Metrics: dev},
+			Data:       model.Data{ID: vin, Metrics: state[vin]},
 			ProducedAt: now,
 		}
+		hash, err := model.ContentHash(payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("log_compacted: encode %s: %w", vin, err)
+		}
 		msg := service.NewMessage(nil)
 		msg.SetStructured(payload)
 		msg.MetaSet("vincode", vin)
+		msg.MetaSet(MetaContentHash, hash)
 		batch = append(batch, msg)
 	}
 	return batch, nil
 }
 
-func (s LogCompactedFlushStrategy) emitBatched(state FlushState, now int64) (service.MessageBatch, error) {
-	var batch service.MessageBatch
-	var chunk []model.Data
+func (s *LogCompactedFlushStrategy) emitBatched(state FlushState, now int64) (service.MessageBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	touched := make(map[int]bool)
 	for vin, dev := range state {
-		chunk = append(chunk, model.Data{ID: vin, Metrics: dev})
-		if len(chunk) >= s.BatchSize {
-			payload := model.PayloadBatch{
-				NumOfData:  len(chunk),
-				Data:       chunk,
-				ProducedAt: now,
+		b := s.bucketOf(vin)
+		if s.buckets == nil {
+			s.buckets = make(map[int]map[string]map[string]model.MetricValue)
+		}
+		if s.buckets[b] == nil {
+			s.buckets[b] = make(map[string]map[string]model.MetricValue)
+		}
+		s.buckets[b][vin] = dev
+		touched[b] = true
+	}
+	return s.emitBuckets(touched, now)
+}
+
+func (s *LogCompactedFlushStrategy) bucketOf(vin string) int {
+	if s.KeyBuckets <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(vin))
+	return int(h.Sum32() % uint32(s.KeyBuckets))
+}
+
+// emitBuckets emits every device of the touched buckets, then a tombstone for each key a bucket no longer
+// fills. The caller holds s.mu.
+func (s *LogCompactedFlushStrategy) emitBuckets(touched map[int]bool, now int64) (service.MessageBatch, error) {
+	if s.chunks == nil {
+		s.chunks = make(map[int]int)
+	}
+	order := make([]int, 0, len(touched))
+	for b := range touched {
+		order = append(order, b)
+	}
+	sort.Ints(order)
+
+	var batch service.MessageBatch
+	for _, b := range order {
+		devices := s.buckets[b]
+		var chunk []model.Data
+		var vins []string
+		size := 0
+		n := 0
+		emit := func() error {
+			key := fmt.Sprintf("bucket-%d-%d", b, n)
+			hash, err := model.ContentHash(chunk...)
+			if err != nil {
+				return fmt.Errorf("log_compacted: encode %s: %w", key, err)
 			}
 			msg := service.NewMessage(nil)
-			msg.SetStructured(payload)
+			msg.SetStructured(model.PayloadBatch{NumOfData: len(chunk), Data: chunk, ProducedAt: now})
+			msg.MetaSet("vincode", key)
+			msg.MetaSet("batch_key", key)
+			msg.MetaSet("vincodes", strings.Join(vins, ","))
+			msg.MetaSet(MetaContentHash, hash)
 			batch = append(batch, msg)
-			chunk = nil
+			chunk, vins, size = nil, nil, 0
+			n++
+			return nil
+		}
+		for _, vin := range sortedKeys(devices) {
+			data := model.Data{ID: vin, Metrics: devices[vin]}
+			enc, err := json.Marshal(data)
+			if err != nil {
+				return nil, fmt.Errorf("log_compacted: encode %s: %w", vin, err)
+			}
+			if len(chunk) > 0 && (len(chunk) >= s.BatchSize ||
+				(s.MaxMessageBytes > 0 && batchMessageSize(len(chunk)+1, size+len(enc), now) > s.MaxMessageBytes)) {
+				if err := emit(); err != nil {
+					return nil, err
+				}
+			}
+			chunk = append(chunk, data)
+			vins = append(vins, vin)
+			size += len(enc)
+		}
+		if len(chunk) > 0 {
+			if err := emit(); err != nil {
+				return nil, err
+			}
+		}
+
+		for i := n; i < s.chunks[b]; i++ {
+			key := fmt.Sprintf("bucket-%d-%d", b, i)
+			msg := service.NewMessage(nil)
+			msg.MetaSet("vincode", key)
+			msg.MetaSet("batch_key", key)
+			msg.MetaSet("tombstone", "true")
+			batch = append(batch, msg)
+		}
+		if n == 0 {
+			delete(s.chunks, b)
+			delete(s.buckets, b)
+		} else {
+			s.chunks[b] = n
 		}
 	}
-	if len(chunk) > 0 {
-		payload := model.PayloadBatch{
-			NumOfData:  len(chunk),
-			Data:       chunk,
-			ProducedAt: now,
+	return batch, nil
+}
+
+// batchMessageSize is the length of the JSON encoding of a model.PayloadBatch of n devices whose own
+// encodings total dataBytes.
+func batchMessageSize(n, dataBytes int, producedAt int64) int {
+	const fixed = len(`{"num_of_data":,"data":[],"produced_at":}`)
+	return fixed + len(strconv.Itoa(n)) + dataBytes + n - 1 + len(strconv.FormatInt(producedAt, 10))
+}
+
+// cancelTombstones drops pending tombstones for devices that are back in state (brief disconnect): in the
+// flush state or, when it is not complete, in the merger's.
+func (s *LogCompactedFlushStrategy) cancelTombstones(state FlushState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for vin := range s.pending {
+		if _, ok := state[vin]; ok || (s.HasDevice != nil && s.HasDevice(vin)) {
+			delete(s.pending, vin)
+		}
+	}
+}
+
+// OnEvict queues TTL evictions and emits a tombstone (nil value, meta vincode and tombstone=true) for each
+// one whose grace period has passed. Capacity evictions are ignored: the device may still be alive.
+// Batched, see evictBatched.
+func (s *LogCompactedFlushStrategy) OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error) {
+	if s.BatchSize > 1 {
+		return s.evictBatched(evicted)
+	}
+	if !s.Tombstones {
+		return nil, nil
+	}
+	now := time.Now().UnixMilli()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.pending = make(map[string]int64)
+	}
+	for _, e := range evicted {
+		switch e.Reason {
+		case EvictReasonTTL:
+			if _, ok := s.pending[e.VIN]; !ok && s.Tombstones {
+				s.pending[e.VIN] = e.At
+			}
+		case EvictReasonManual:
+			// Explicitly requested: no grace period.
+			if s.Tombstones {
+				s.pending[e.VIN] = 0
+			}
+		}
+	}
+
+	var batch service.MessageBatch
+	grace := s.TombstoneGrace.Milliseconds()
+	for vin, at := range s.pending {
+		if at > 0 && now-at < grace {
+			continue
 		}
+		delete(s.pending, vin)
 		msg := service.NewMessage(nil)
-		msg.SetStructured(payload)
+		msg.MetaSet("vincode", vin)
+		msg.MetaSet("tombstone", "true")
 		batch = append(batch, msg)
 	}
 	return batch, nil
 }
+
+// evictBatched removes every evicted device from its bucket, whatever the reason or Tombstones: the bucket
+// cache must not keep devices the merger no longer holds, or they would be emitted again with every later
+// flush of their bucket. The buckets are emitted again without them, except for devices revoked by a
+// rebalance, which are only dropped (their new owner emits them).
+func (s *LogCompactedFlushStrategy) evictBatched(evicted []Eviction) (service.MessageBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	touched := make(map[int]bool)
+	for _, e := range evicted {
+		b := s.bucketOf(e.VIN)
+		if _, ok := s.buckets[b][e.VIN]; !ok {
+			continue
+		}
+		delete(s.buckets[b], e.VIN)
+		if e.Reason != EvictReasonRevoked {
+			touched[b] = true
+		}
+	}
+	if len(touched) == 0 {
+		return nil, nil
+	}
+	return s.emitBuckets(touched, time.Now().UnixMilli())
+}
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name: StrategyLogCompacted,
+		Fields: func() []*service.ConfigField {
+			return []*service.ConfigField{
+				service.NewIntField("batch_size").Description("Devices per message (1 = one message per device; >1 = batched to reduce network I/O)").Default(1),
+				service.NewIntField("max_message_bytes").Description("Batched: max encoded size of a message, e.g. below the topic's max.message.bytes (a larger device goes alone); 0 = batch_size only").Default(0),
+				service.NewIntField("key_buckets").Description("Batched: devices are grouped by VIN hash into this many buckets, each emitted under keys bucket-<bucket>-<chunk> (meta vincode, batch_key; devices in meta vincodes)").Default(1),
+				service.NewBoolField("tombstones").Description("Emit a null-value message keyed by vincode for devices evicted by device_ttl, so compaction removes them (batched: evicted devices are always removed from their bucket)").Default(false),
+				service.NewStringField("tombstone_grace").Description("Extra time an evicted device must stay away before its tombstone is emitted (e.g. 5m); not used when batched").Default("5m"),
+			}
+		},
+		// A message replaces the whole record of its vincode, so a partial device would drop sensors.
+		WholeDevices: true,
+		Encodable:    true,
+		Build: func(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+			batchSize, _ := conf.FieldInt("batch_size")
+			maxBytes, _ := conf.FieldInt("max_message_bytes")
+			keyBuckets, _ := conf.FieldInt("key_buckets")
+			tombstones, _ := conf.FieldBool("tombstones")
+			graceStr, _ := conf.FieldString("tombstone_grace")
+			grace, err := time.ParseDuration(graceStr)
+			if err != nil || grace < 0 {
+				return nil, fmt.Errorf("invalid tombstone_grace %q", graceStr)
+			}
+			return &LogCompactedFlushStrategy{
+				BatchSize:       batchSize,
+				MaxMessageBytes: max(maxBytes, 0),
+				KeyBuckets:      max(keyBuckets, 1),
+				Tombstones:      tombstones,
+				TombstoneGrace:  grace,
+				HasDevice:       env.HasDevice,
+			}, nil
+		},
+	})
+}
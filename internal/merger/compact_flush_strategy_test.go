@@ -2,8 +2,12 @@ package merger
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"bethos/internal/model"
 )
@@ -154,3 +158,238 @@ func TestLogCompactedFlushStrategy_OnFlush_Batched(t *testing.T) {
 		t.Errorf("last message num_of_data = %d, want 50", pb2.NumOfData)
 	}
 }
+
+func TestLogCompactedFlushStrategy_OnFlush_BatchedEncodeError(t *testing.T) {
+	s := LogCompactedFlushStrategy{BatchSize: 10}
+	state := FlushState{
+		"VIN1": {"s": {Value: 1, ReceivedAt: 1}},
+		"VIN2": {"s": {Value: math.NaN(), ReceivedAt: 1}},
+	}
+	if batch, err := s.OnFlush(context.Background(), state); err == nil {
+		t.Errorf("OnFlush = %d messages, want an encode error (content_hash needs every device encodable)", len(batch))
+	}
+}
+
+func TestLogCompactedFlushStrategy_OnEvict_Disabled(t *testing.T) {
+	s := &LogCompactedFlushStrategy{}
+	batch, err := s.OnEvict(context.Background(), []Eviction{{VIN: "VIN1", Reason: EvictReasonTTL, At: 1}})
+	if err != nil || len(batch) != 0 {
+		t.Errorf("OnEvict with tombstones disabled = %d messages, err %v; want none", len(batch), err)
+	}
+}
+
+func TestLogCompactedFlushStrategy_OnEvict_Tombstone(t *testing.T) {
+	ctx := context.Background()
+	s := &LogCompactedFlushStrategy{Tombstones: true}
+	batch, err := s.OnEvict(ctx, []Eviction{
+		{VIN: "VIN1", Reason: EvictReasonTTL, At: 1},
+		{VIN: "VIN2", Reason: EvictReasonCapacity, At: 1},
+	})
+	if err != nil {
+		t.Fatalf("OnEvict: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 tombstone (ttl only), got %d", len(batch))
+	}
+	if vin, _ := batch[0].MetaGet("vincode"); vin != "VIN1" {
+		t.Errorf("vincode = %q, want VIN1", vin)
+	}
+	if b, _ := batch[0].AsBytes(); b != nil {
+		t.Errorf("tombstone value = %q, want nil", b)
+	}
+}
+
+func TestLogCompactedFlushStrategy_OnEvict_GraceCancelledWhenDeviceReturns(t *testing.T) {
+	ctx := context.Background()
+	s := &LogCompactedFlushStrategy{Tombstones: true, TombstoneGrace: time.Hour}
+	now := time.Now().UnixMilli()
+
+	batch, _ := s.OnEvict(ctx, []Eviction{{VIN: "VIN1", Reason: EvictReasonTTL, At: now}})
+	if len(batch) != 0 {
+		t.Fatalf("tombstone emitted inside grace period")
+	}
+
+	// Device reconnects: it is in the next flush state, so the pending tombstone is dropped.
+	if _, err := s.OnFlush(ctx, FlushState{"VIN1": {"s": {Value: 1, ReceivedAt: now}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.TombstoneGrace = 0
+	batch, _ = s.OnEvict(ctx, nil)
+	if len(batch) != 0 {
+		t.Errorf("tombstone emitted for a device that came back")
+	}
+}
+
+func TestLogCompactedFlushStrategy_OnEvict_GraceCancelledWhenDeviceBackOutsideFlush(t *testing.T) {
+	ctx := context.Background()
+	live := map[string]bool{}
+	s := &LogCompactedFlushStrategy{Tombstones: true, TombstoneGrace: time.Hour, HasDevice: func(vin string) bool { return live[vin] }}
+	now := time.Now().UnixMilli()
+
+	if batch, _ := s.OnEvict(ctx, []Eviction{{VIN: "VIN1", Reason: EvictReasonTTL, At: now}}); len(batch) != 0 {
+		t.Fatalf("tombstone emitted inside grace period")
+	}
+
+	// VIN1 is back in the merger but not in this flush (e.g. a scoped trigger for VIN2).
+	live["VIN1"] = true
+	if _, err := s.OnFlush(ctx, FlushState{"VIN2": {"s": {Value: 1, ReceivedAt: now}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.TombstoneGrace = 0
+	if batch, _ := s.OnEvict(ctx, nil); len(batch) != 0 {
+		t.Errorf("tombstone emitted for a device back in the merger's state")
+	}
+}
+
+func TestLogCompactedFlushStrategy_Batched_KeysAndBytes(t *testing.T) {
+	ctx := context.Background()
+	s := &LogCompactedFlushStrategy{BatchSize: 100, MaxMessageBytes: 300, KeyBuckets: 4}
+	state := make(FlushState)
+	for i := 0; i < 20; i++ {
+		state[fmt.Sprintf("VIN%02d", i)] = map[string]model.MetricValue{"speed": {Value: float64(i), ReceivedAt: 1_000}}
+	}
+
+	batch, err := s.OnFlush(ctx, state)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	seen := make(map[string]string)
+	keys := make(map[string]bool)
+	for _, msg := range batch {
+		key, _ := msg.MetaGet("vincode")
+		if bk, _ := msg.MetaGet("batch_key"); bk != key || key == "" {
+			t.Fatalf("vincode %q, batch_key %q: want the same non-empty key", key, bk)
+		}
+		if keys[key] {
+			t.Errorf("key %s used twice", key)
+		}
+		keys[key] = true
+		b, _ := msg.AsBytes()
+		if len(b) > 300 {
+			t.Errorf("%s is %d bytes, want <= 300", key, len(b))
+		}
+		var pb model.PayloadBatch
+		if err := json.Unmarshal(b, &pb); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		list, _ := msg.MetaGet("vincodes")
+		var ids []string
+		for _, d := range pb.Data {
+			ids = append(ids, d.ID)
+			seen[d.ID] = key
+		}
+		if list != strings.Join(ids, ",") {
+			t.Errorf("%s vincodes = %q, want %q", key, list, strings.Join(ids, ","))
+		}
+	}
+	if len(seen) != 20 {
+		t.Fatalf("got %d devices, want 20", len(seen))
+	}
+	if len(batch) <= 4 {
+		t.Errorf("got %d messages, want buckets split by max_message_bytes", len(batch))
+	}
+
+	// Same state again: same keys for the same devices.
+	batch, _ = s.OnFlush(ctx, state)
+	for _, msg := range batch {
+		key, _ := msg.MetaGet("vincode")
+		list, _ := msg.MetaGet("vincodes")
+		for _, vin := range strings.Split(list, ",") {
+			if seen[vin] != key {
+				t.Errorf("%s moved from %s to %s", vin, seen[vin], key)
+			}
+		}
+	}
+}
+
+func TestLogCompactedFlushStrategy_Batched_DeltaEmitsWholeBucket(t *testing.T) {
+	ctx := context.Background()
+	s := &LogCompactedFlushStrategy{BatchSize: 2}
+	full := FlushState{
+		"VIN1": {"s": {Value: 1, ReceivedAt: 1}},
+		"VIN2": {"s": {Value: 1, ReceivedAt: 1}},
+		"VIN3": {"s": {Value: 1, ReceivedAt: 1}},
+	}
+	if _, err := s.OnFlush(ctx, full); err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed_devices flush with only VIN3 still rewrites every key of its bucket.
+	batch, err := s.OnFlush(ctx, FlushState{"VIN3": {"s": {Value: 2, ReceivedAt: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range batch {
+		key, _ := msg.MetaGet("vincode")
+		list, _ := msg.MetaGet("vincodes")
+		got = append(got, key+"="+list)
+	}
+	if want := []string{"bucket-0-0=VIN1,VIN2", "bucket-0-1=VIN3"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("delta flush = %v, want %v", got, want)
+	}
+}
+
+func TestLogCompactedFlushStrategy_Batched_EvictShrinksBucket(t *testing.T) {
+	ctx := context.Background()
+	s := &LogCompactedFlushStrategy{BatchSize: 2, Tombstones: true}
+	state := FlushState{
+		"VIN1": {"s": {Value: 1}},
+		"VIN2": {"s": {Value: 1}},
+		"VIN3": {"s": {Value: 1}},
+	}
+	if _, err := s.OnFlush(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := s.OnEvict(ctx, []Eviction{{VIN: "VIN3", Reason: EvictReasonManual}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range batch {
+		key, _ := msg.MetaGet("vincode")
+		list, _ := msg.MetaGet("vincodes")
+		if tomb, _ := msg.MetaGet("tombstone"); tomb == "true" {
+			if b, _ := msg.AsBytes(); b != nil {
+				t.Errorf("tombstone %s has value %s", key, b)
+			}
+			list = "tombstone"
+		}
+		got = append(got, key+"="+list)
+	}
+	if want := []string{"bucket-0-0=VIN1,VIN2", "bucket-0-1=tombstone"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("evict = %v, want %v", got, want)
+	}
+}
+
+func TestLogCompactedFlushStrategy_Batched_EvictionLeavesBucket(t *testing.T) {
+	for _, reason := range []string{EvictReasonTTL, EvictReasonCapacity} {
+		t.Run(reason, func(t *testing.T) {
+			ctx := context.Background()
+			s := &LogCompactedFlushStrategy{BatchSize: 10}
+			if _, err := s.OnFlush(ctx, FlushState{"A": {"s": {Value: 1}}, "B": {"s": {Value: 1}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			batch, err := s.OnEvict(ctx, []Eviction{{VIN: "A", Reason: reason}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batch) != 1 {
+				t.Fatalf("evict = %d messages, want the bucket emitted again", len(batch))
+			}
+			if list, _ := batch[0].MetaGet("vincodes"); list != "B" {
+				t.Errorf("bucket after evicting A = %q, want B", list)
+			}
+
+			batch, err = s.OnFlush(ctx, FlushState{"B": {"s": {Value: 2}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if list, _ := batch[0].MetaGet("vincodes"); list != "B" {
+				t.Errorf("later flush of the bucket = %q, want B only", list)
+			}
+		})
+	}
+}
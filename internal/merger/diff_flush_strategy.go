@@ -0,0 +1,274 @@
+package merger
+
+import (
+	"bethos/internal/model"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+const (
+	DiffFormatJSONPatch = "json_patch" // RFC 6902 operations on the device's model.Payload
+	DiffFormatSimple    = "simple"     // model.DiffPayload
+
+	DefaultKeyframeInterval = time.Hour
+)
+
+var DiffFormats = []string{DiffFormatJSONPatch, DiffFormatSimple}
+
+// Meta diff_type of DiffFlushStrategy messages.
+const (
+	DiffTypeKeyframe = "keyframe"
+	DiffTypePatch    = "patch"
+	DiffTypeDelete   = "delete"
+)
+
+// DiffFlushStrategy emits, per device, what changed since the previous message for it rather than the whole
+// device: a sensor is added, changed (value or timestamps differ) or removed (no longer in the device). It
+// keeps its own copy of the last state emitted per VIN, so the flush state must hold complete devices
+// (flush_mode full or changed_devices). Every KeyframeInterval, and on the first flush after a start, it
+// emits a keyframe instead: the full model.Payload of every device known, so new consumers can
+// resynchronize. Messages carry meta vincode and diff_type (keyframe, patch or delete); a device evicted
+// from the merger gets a nil-value delete message, except when revoked by a rebalance (its new owner emits it
+// as added sensors). What a flush emits is staged and only becomes the last state emitted once the flush
+// succeeded (FlushDone, or the next OnFlush if never told), so a failed flush is diffed again on its retry.
+type DiffFlushStrategy struct {
+	Format           string        // DiffFormatJSONPatch if empty
+	KeyframeInterval time.Duration // 0 = keyframe only on the first flush
+
+	mu               sync.Mutex
+	prev             map[string]map[string]model.MetricValue
+	staged           map[string]map[string]model.MetricValue // emitted by the flush in progress; nil = deleted
+	keyframeAt       int64                                   // unix ms; 0 = none emitted yet
+	stagedKeyframeAt int64                                   // keyframe of the flush in progress; 0 = none
+}
+
+func (s *DiffFlushStrategy) Close(ctx context.Context) error {
+	return nil
+}
+
+// FlushDone commits what the flush emitted if it succeeded, or discards it so the retry diffs against the
+// last state actually delivered.
+func (s *DiffFlushStrategy) FlushDone(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.staged = nil
+		s.stagedKeyframeAt = 0
+		return
+	}
+	s.commit()
+}
+
+// commit makes the staged state the last state emitted. Must be called with mu held.
+func (s *DiffFlushStrategy) commit() {
+	if s.prev == nil {
+		s.prev = make(map[string]map[string]model.MetricValue)
+	}
+	for vin, dev := range s.staged {
+		if dev == nil {
+			delete(s.prev, vin)
+		} else {
+			s.prev[vin] = dev
+		}
+	}
+	if s.stagedKeyframeAt != 0 {
+		s.keyframeAt = s.stagedKeyframeAt
+	}
+	s.staged = nil
+	s.stagedKeyframeAt = 0
+}
+
+// last returns the last state emitted for vin, including the flush in progress. Must be called with mu held.
+func (s *DiffFlushStrategy) last(vin string) (map[string]model.MetricValue, bool) {
+	if dev, ok := s.staged[vin]; ok {
+		return dev, dev != nil
+	}
+	dev, ok := s.prev[vin]
+	return dev, ok
+}
+
+func (s *DiffFlushStrategy) OnFlush(ctx context.Context, state FlushState) (service.MessageBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commit()
+	staged := make(map[string]map[string]model.MetricValue, len(state))
+	now := time.Now().UnixMilli()
+	var batch service.MessageBatch
+	keyframe := s.keyframeAt == 0 || (s.KeyframeInterval > 0 && now-s.keyframeAt >= s.KeyframeInterval.Milliseconds())
+	for _, vin := range sortedKeys(state) {
+		dev := state[vin]
+		if !keyframe {
+			if msg := s.diffMessage(vin, s.prev[vin], dev, now); msg != nil {
+				batch = append(batch, msg)
+			}
+		}
+		cp := make(map[string]model.MetricValue, len(dev))
+		for sensor, m := range dev {
+			cp[sensor] = m
+		}
+		staged[vin] = cp
+	}
+	if !keyframe || len(s.prev)+len(staged) == 0 {
+		s.staged = staged
+		return batch, nil
+	}
+
+	known := make(map[string]struct{}, len(s.prev)+len(staged))
+	for vin := range s.prev {
+		known[vin] = struct{}{}
+	}
+	for vin := range staged {
+		known[vin] = struct{}{}
+	}
+	for _, vin := range sortedKeys(known) {
+		dev, ok := staged[vin]
+		if !ok {
+			dev = s.prev[vin]
+		}
+		data := model.Data{ID: vin, Metrics: dev}
+		hash, err := model.ContentHash(data)
+		if err != nil {
+			return nil, fmt.Errorf("diff: encode %s: %w", vin, err)
+		}
+		msg := service.NewMessage(nil)
+		msg.SetStructured(model.Payload{
+			NumOfData:  1,
+			Data:       data,
+			ProducedAt: now,
+		})
+		msg.MetaSet("vincode", vin)
+		msg.MetaSet("diff_type", DiffTypeKeyframe)
+		msg.MetaSet(MetaContentHash, hash)
+		batch = append(batch, msg)
+	}
+	s.staged = staged
+	s.stagedKeyframeAt = now
+	return batch, nil
+}
+
+// diffMessage returns the patch from old to dev, nil if nothing changed.
+func (s *DiffFlushStrategy) diffMessage(vin string, old, dev map[string]model.MetricValue, now int64) *service.Message {
+	diff := model.DiffPayload{ID: vin, ProducedAt: now}
+	for _, sensor := range sortedKeys(dev) {
+		m := dev[sensor]
+		prev, ok := old[sensor]
+		switch {
+		case !ok:
+			if diff.Added == nil {
+				diff.Added = make(map[string]model.MetricValue)
+			}
+			diff.Added[sensor] = m
+		case !reflect.DeepEqual(prev, m):
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]model.MetricValue)
+			}
+			diff.Changed[sensor] = m
+		}
+	}
+	for _, sensor := range sortedKeys(old) {
+		if _, ok := dev[sensor]; !ok {
+			diff.Removed = append(diff.Removed, sensor)
+		}
+	}
+	if len(diff.Added) == 0 && len(diff.Changed) == 0 && len(diff.Removed) == 0 {
+		return nil
+	}
+
+	msg := service.NewMessage(nil)
+	if s.Format == DiffFormatSimple {
+		msg.SetStructured(diff)
+	} else {
+		msg.SetStructured(patchOps(diff))
+	}
+	msg.MetaSet("vincode", vin)
+	msg.MetaSet("diff_type", DiffTypePatch)
+	return msg
+}
+
+// patchOps converts diff to JSON Patch operations on the device's Payload, ordered by sensor, ending with
+// the new produced_at.
+func patchOps(diff model.DiffPayload) []model.PatchOp {
+	var ops []model.PatchOp
+	for _, sensor := range sortedKeys(diff.Added) {
+		ops = append(ops, model.PatchOp{Op: "add", Path: "/data/" + escapePointer(sensor), Value: diff.Added[sensor]})
+	}
+	for _, sensor := range sortedKeys(diff.Changed) {
+		ops = append(ops, model.PatchOp{Op: "replace", Path: "/data/" + escapePointer(sensor), Value: diff.Changed[sensor]})
+	}
+	for _, sensor := range diff.Removed {
+		ops = append(ops, model.PatchOp{Op: "remove", Path: "/data/" + escapePointer(sensor)})
+	}
+	return append(ops, model.PatchOp{Op: "replace", Path: "/produced_at", Value: diff.ProducedAt})
+}
+
+// escapePointer escapes a JSON Pointer reference token (RFC 6901).
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// OnEvict forgets evicted devices (staged like a flush) and emits a delete message (nil value) for each, except those revoked.
+func (s *DiffFlushStrategy) OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var batch service.MessageBatch
+	for _, e := range evicted {
+		if _, known := s.last(e.VIN); !known {
+			continue
+		}
+		if s.staged == nil {
+			s.staged = make(map[string]map[string]model.MetricValue)
+		}
+		s.staged[e.VIN] = nil
+		if e.Reason == EvictReasonRevoked {
+			continue
+		}
+		msg := service.NewMessage(nil)
+		msg.MetaSet("vincode", e.VIN)
+		msg.MetaSet("diff_type", DiffTypeDelete)
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+// sortedKeys returns the keys of m (VINs or sensors) in order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name: StrategyDiff,
+		Fields: func() []*service.ConfigField {
+			return []*service.ConfigField{
+				service.NewStringEnumField("diff_format", DiffFormats...).Description("json_patch = RFC 6902 operations on the device payload; simple = {id, added, changed, removed, produced_at}").Default(DiffFormatJSONPatch),
+				service.NewStringField("keyframe_interval").Description("How often the full payload of every device is emitted instead of patches (meta diff_type=keyframe), so new consumers can resynchronize; 0 = only on the first flush").Default("1h"),
+			}
+		},
+		// Sensors missing from a device would be reported as removed.
+		WholeDevices: true,
+		Build: func(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+			format, _ := conf.FieldString("diff_format")
+			intervalStr, _ := conf.FieldString("keyframe_interval")
+			interval, err := time.ParseDuration(intervalStr)
+			if err != nil || interval < 0 {
+				return nil, fmt.Errorf("invalid keyframe_interval %q", intervalStr)
+			}
+			return &DiffFlushStrategy{Format: format, KeyframeInterval: interval}, nil
+		},
+	})
+}
@@ -0,0 +1,180 @@
+package merger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"bethos/internal/model"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func diffTypes(batch service.MessageBatch) []string {
+	var out []string
+	for _, msg := range batch {
+		vin, _ := msg.MetaGet("vincode")
+		typ, _ := msg.MetaGet("diff_type")
+		out = append(out, vin+":"+typ)
+	}
+	return out
+}
+
+func TestDiffFlushStrategy_KeyframeThenPatches(t *testing.T) {
+	ctx := context.Background()
+	s := &DiffFlushStrategy{KeyframeInterval: time.Hour}
+
+	first := FlushState{
+		"VIN2": {"speed": {Value: 10.0, ReceivedAt: 100}},
+		"VIN1": {"speed": {Value: 20.0, ReceivedAt: 100}, "a/b": {Value: "x", ReceivedAt: 100}},
+	}
+	batch, err := s.OnFlush(ctx, first)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if got := diffTypes(batch); !reflect.DeepEqual(got, []string{"VIN1:keyframe", "VIN2:keyframe"}) {
+		t.Fatalf("first flush = %v, want a keyframe per VIN", got)
+	}
+	b, _ := batch[0].AsBytes()
+	var p model.Payload
+	if err := json.Unmarshal(b, &p); err != nil || len(p.Data.Metrics) != 2 {
+		t.Errorf("keyframe = %s (%v), want VIN1 payload with both sensors", b, err)
+	}
+
+	// VIN1: speed changed, a/b removed, door added. VIN2 unchanged.
+	second := FlushState{
+		"VIN1": {"speed": {Value: 25.0, ReceivedAt: 200}, "door": {Value: "open", ReceivedAt: 200}},
+		"VIN2": {"speed": {Value: 10.0, ReceivedAt: 100}},
+	}
+	batch, err = s.OnFlush(ctx, second)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if got := diffTypes(batch); !reflect.DeepEqual(got, []string{"VIN1:patch"}) {
+		t.Fatalf("second flush = %v, want one patch for VIN1", got)
+	}
+	b, _ = batch[0].AsBytes()
+	var ops []model.PatchOp
+	if err := json.Unmarshal(b, &ops); err != nil {
+		t.Fatalf("patch %s: %v", b, err)
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.Op+" "+op.Path)
+	}
+	want := []string{"add /data/door", "replace /data/speed", "remove /data/a~1b", "replace /produced_at"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("patch ops = %v, want %v", got, want)
+	}
+}
+
+func TestDiffFlushStrategy_SimpleFormat(t *testing.T) {
+	ctx := context.Background()
+	s := &DiffFlushStrategy{Format: DiffFormatSimple}
+	if _, err := s.OnFlush(ctx, FlushState{"VIN1": {"a": {Value: "1", ReceivedAt: 100}, "b": {Value: "1", ReceivedAt: 100}}}); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	batch, err := s.OnFlush(ctx, FlushState{"VIN1": {"a": {Value: "2", ReceivedAt: 200}, "c": {Value: "1", ReceivedAt: 200}}})
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("OnFlush = %d messages (%v), want 1", len(batch), err)
+	}
+	b, _ := batch[0].AsBytes()
+	var d model.DiffPayload
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatalf("diff %s: %v", b, err)
+	}
+	if d.ID != "VIN1" || d.Added["c"].Value != "1" || d.Changed["a"].Value != "2" || !reflect.DeepEqual(d.Removed, []string{"b"}) {
+		t.Errorf("diff = %+v", d)
+	}
+}
+
+func TestDiffFlushStrategy_PeriodicKeyframe(t *testing.T) {
+	ctx := context.Background()
+	s := &DiffFlushStrategy{KeyframeInterval: time.Millisecond}
+	state := FlushState{"VIN1": {"a": {Value: "1", ReceivedAt: 100}}}
+	if _, err := s.OnFlush(ctx, state); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// A changed_devices flush without VIN1 still re-emits it in the keyframe.
+	batch, err := s.OnFlush(ctx, FlushState{})
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if got := diffTypes(batch); !reflect.DeepEqual(got, []string{"VIN1:keyframe"}) {
+		t.Errorf("flush after interval = %v, want a VIN1 keyframe", got)
+	}
+}
+
+func TestDiffFlushStrategy_Evict(t *testing.T) {
+	ctx := context.Background()
+	s := &DiffFlushStrategy{}
+	state := FlushState{"VIN1": {"a": {Value: "1"}}, "VIN2": {"a": {Value: "1"}}}
+	if _, err := s.OnFlush(ctx, state); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+
+	batch, err := s.OnEvict(ctx, []Eviction{
+		{VIN: "VIN1", Reason: EvictReasonTTL},
+		{VIN: "VIN2", Reason: EvictReasonRevoked},
+		{VIN: "VIN9", Reason: EvictReasonTTL},
+	})
+	if err != nil {
+		t.Fatalf("OnEvict: %v", err)
+	}
+	if got := diffTypes(batch); !reflect.DeepEqual(got, []string{"VIN1:delete"}) {
+		t.Errorf("evict = %v, want only a VIN1 delete", got)
+	}
+	if b, _ := batch[0].AsBytes(); b != nil {
+		t.Errorf("delete body = %s, want nil", b)
+	}
+
+	// Both are forgotten: coming back, every sensor is added.
+	batch, _ = s.OnFlush(ctx, FlushState{"VIN2": {"a": {Value: "1"}}})
+	if got := diffTypes(batch); !reflect.DeepEqual(got, []string{"VIN2:patch"}) {
+		t.Errorf("flush after evict = %v, want a VIN2 patch", got)
+	}
+}
+
+func TestDiffFlushStrategy_FailedFlushRetried(t *testing.T) {
+	ctx := context.Background()
+	s := &DiffFlushStrategy{}
+	state := FlushState{"VIN1": {"a": {Value: "1"}}, "VIN2": {"a": {Value: "1"}}}
+
+	// A failed keyframe is emitted again.
+	if _, err := s.OnFlush(ctx, state); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	s.FlushDone(errors.New("output down"))
+	batch, _ := s.OnFlush(ctx, state)
+	if got := diffTypes(batch); !reflect.DeepEqual(got, []string{"VIN1:keyframe", "VIN2:keyframe"}) {
+		t.Fatalf("retry of failed keyframe = %v, want the keyframes again", got)
+	}
+	s.FlushDone(nil)
+
+	// A failed patch and delete are emitted again, diffed against the last state delivered.
+	changed := FlushState{"VIN1": {"a": {Value: "2"}}}
+	if batch, _ = s.OnFlush(ctx, changed); len(batch) != 1 {
+		t.Fatalf("got %d messages, want a VIN1 patch", len(batch))
+	}
+	if _, err := s.OnEvict(ctx, []Eviction{{VIN: "VIN2", Reason: EvictReasonTTL}}); err != nil {
+		t.Fatalf("OnEvict: %v", err)
+	}
+	s.FlushDone(errors.New("output down"))
+
+	batch, _ = s.OnFlush(ctx, changed)
+	evictBatch, _ := s.OnEvict(ctx, []Eviction{{VIN: "VIN2", Reason: EvictReasonTTL}})
+	if got := diffTypes(append(batch, evictBatch...)); !reflect.DeepEqual(got, []string{"VIN1:patch", "VIN2:delete"}) {
+		t.Fatalf("retry = %v, want the VIN1 patch and VIN2 delete again", got)
+	}
+	s.FlushDone(nil)
+
+	// Once delivered, nothing is left to emit.
+	batch, _ = s.OnFlush(ctx, changed)
+	if len(batch) != 0 {
+		t.Errorf("flush after success = %v, want nothing", diffTypes(batch))
+	}
+}
@@ -0,0 +1,73 @@
+package merger
+
+import (
+	"bethos/internal/codec"
+	"bethos/internal/model"
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// EncodedFlushStrategy encodes the model.Payload and model.PayloadBatch messages of Strategy with Codec
+// (Avro or Protobuf), setting meta encoding and, when the schema is registered, schema_id. Other messages,
+// e.g. tombstones, are left as they are. Metadata set by Strategy (vincode, content_hash, ...) is kept.
+type EncodedFlushStrategy struct {
+	Strategy FlushStrategy
+	Codec    *codec.Codec
+}
+
+func (s *EncodedFlushStrategy) OnFlush(ctx context.Context, state FlushState) (service.MessageBatch, error) {
+	batch, err := s.Strategy.OnFlush(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return s.encode(ctx, batch)
+}
+
+func (s *EncodedFlushStrategy) OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error) {
+	l, ok := s.Strategy.(EvictionListener)
+	if !ok {
+		return nil, nil
+	}
+	batch, err := l.OnEvict(ctx, evicted)
+	if err != nil {
+		return nil, err
+	}
+	return s.encode(ctx, batch)
+}
+
+func (s *EncodedFlushStrategy) FlushDone(err error) {
+	if c, ok := s.Strategy.(FlushCommitter); ok {
+		c.FlushDone(err)
+	}
+}
+
+func (s *EncodedFlushStrategy) Close(ctx context.Context) error {
+	return s.Strategy.Close(ctx)
+}
+
+func (s *EncodedFlushStrategy) encode(ctx context.Context, batch service.MessageBatch) (service.MessageBatch, error) {
+	for _, msg := range batch {
+		v, err := msg.AsStructured()
+		if err != nil {
+			continue // nil value (tombstone)
+		}
+		switch v.(type) {
+		case model.Payload, model.PayloadBatch:
+		default:
+			continue
+		}
+		b, id, err := s.Codec.Encode(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("encode: %w", err)
+		}
+		msg.SetBytes(b)
+		msg.MetaSet("encoding", s.Codec.Encoding)
+		if id > 0 {
+			msg.MetaSet("schema_id", strconv.Itoa(id))
+		}
+	}
+	return batch, nil
+}
@@ -0,0 +1,83 @@
+package merger
+
+import (
+	"bethos/internal/codec"
+	"bethos/internal/model"
+	"bethos/internal/resource"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodedFlushStrategy_LogCompactedAvro(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(&codec.MemoryRegistry{})
+	defer srv.Close()
+
+	s, err := newStrategyFromYAML(t, `
+strategy: log_compacted
+encoding: avro
+schema_registry_url: `+srv.URL+`
+log_compacted:
+  tombstones: true
+`, StrategyEnv{ResourceMatrix: []resource.Resource{{ResourceID: "1", ResourceName: "speed"}}})
+	if err != nil {
+		t.Fatalf("NewStrategy: %v", err)
+	}
+	state := FlushState{"VIN1": {"speed": {Value: 12.5, ReceivedAt: 1}, "other": {Value: "x", ReceivedAt: 2}}}
+	batch, err := s.OnFlush(ctx, state)
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("OnFlush = %d messages, %v", len(batch), err)
+	}
+	msg := batch[0]
+	if enc, _ := msg.MetaGet("encoding"); enc != codec.EncodingAvro {
+		t.Errorf("meta encoding = %q", enc)
+	}
+	if id, _ := msg.MetaGet("schema_id"); id == "" {
+		t.Error("meta schema_id missing")
+	}
+	if vin, _ := msg.MetaGet("vincode"); vin != "VIN1" {
+		t.Errorf("meta vincode = %q", vin)
+	}
+	want, _ := model.ContentHash(model.Data{ID: "VIN1", Metrics: state["VIN1"]})
+	if h, _ := msg.MetaGet(MetaContentHash); h != want {
+		t.Errorf("content_hash = %s, want %s (of the device, whatever the encoding)", h, want)
+	}
+
+	b, _ := msg.AsBytes()
+	dec, _ := codec.New(codec.EncodingAvro, nil, codec.NewRegistry(srv.URL))
+	got, err := dec.Decode(ctx, b, "")
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if p, ok := got.(model.Payload); !ok || p.Data.ID != "VIN1" || p.Data.Metrics["speed"].Value != 12.5 || p.Data.Metrics["other"].Value != "x" {
+		t.Errorf("decoded %+v", got)
+	}
+
+	// Tombstones keep their nil value.
+	evict, err := s.(EvictionListener).OnEvict(ctx, []Eviction{{VIN: "VIN1", Reason: EvictReasonManual}})
+	if err != nil || len(evict) != 1 {
+		t.Fatalf("OnEvict = %d messages, %v", len(evict), err)
+	}
+	if b, _ := evict[0].AsBytes(); b != nil {
+		t.Errorf("tombstone value = %q, want nil", b)
+	}
+	if _, ok := evict[0].MetaGet("encoding"); ok {
+		t.Error("tombstone has meta encoding")
+	}
+}
+
+func TestEncodedFlushStrategy_Errors(t *testing.T) {
+	if _, err := newStrategyFromYAML(t, "strategy: diff\nencoding: protobuf\n", StrategyEnv{}); err == nil || !strings.Contains(err.Error(), "not supported with strategy diff") {
+		t.Errorf("diff with protobuf: got %v", err)
+	}
+	s, err := newStrategyFromYAML(t, "strategy: inline\nencoding: protobuf\n", StrategyEnv{})
+	if err != nil {
+		t.Fatalf("inline with protobuf: %v", err)
+	}
+	batch, err := s.OnFlush(context.Background(), FlushState{"VIN1": {"a": {Value: map[string]any{}, ReceivedAt: 1}}})
+	if err == nil || batch != nil {
+		t.Errorf("unsupported value: got %d messages, %v; want an error", len(batch), err)
+	}
+}
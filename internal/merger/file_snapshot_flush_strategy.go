@@ -0,0 +1,343 @@
+package merger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+const (
+	FileFormatNDJSON  = "ndjson"
+	FileFormatParquet = "parquet"
+
+	DefaultFilePrefix = "latest"
+	fileManifestName  = "manifest.json"
+)
+
+var FileFormats = []string{FileFormatNDJSON, FileFormatParquet}
+
+// FileSnapshotFlushStrategy writes every flush to a new file in Dir, one row per VIN: columns vin,
+// produced_at and one per sensor (sensors named vin or produced_at are not written). Every row holds the
+// whole device, so flush_mode changed_sensors is rejected. Files are named <Prefix>-<produced_at ms>.<format>,
+// written under a dot-prefixed temporary name and renamed once complete, so readers never see a partial file.
+// Dir also holds manifest.json listing the files written, oldest first; with Retain > 0 only the last Retain
+// files are kept. It emits nothing itself. A write error fails the flush.
+type FileSnapshotFlushStrategy struct {
+	Dir    string
+	Format string // FileFormatNDJSON if empty
+	Prefix string // DefaultFilePrefix if empty
+	// Columns are the sensor columns, e.g. the resource names of the resource matrix; other sensors are not
+	// written. Empty = the sensors present in each flush, sorted.
+	Columns []string
+	Retain  int // files kept; 0 = all
+
+	mu sync.Mutex
+}
+
+// FileManifest is the content of manifest.json.
+type FileManifest struct {
+	Version int                 `json:"version"`
+	Files   []FileManifestEntry `json:"files"`
+}
+
+type FileManifestEntry struct {
+	Name       string `json:"name"`
+	Format     string `json:"format"`
+	Rows       int    `json:"rows"`
+	Bytes      int64  `json:"bytes"`
+	ProducedAt int64  `json:"produced_at"`
+}
+
+func (s *FileSnapshotFlushStrategy) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *FileSnapshotFlushStrategy) format() string {
+	if s.Format == "" {
+		return FileFormatNDJSON
+	}
+	return s.Format
+}
+
+func (s *FileSnapshotFlushStrategy) OnFlush(ctx context.Context, state FlushState) (service.MessageBatch, error) {
+	if len(state) == 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0750); err != nil {
+		return nil, fmt.Errorf("file_snapshot: %w", err)
+	}
+	now := time.Now().UnixMilli()
+	name := s.fileName(now)
+	n, err := writeFileAtomic(filepath.Join(s.Dir, name), func(w io.Writer) error {
+		return s.encode(w, state, now)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("file_snapshot: write %s: %w", name, err)
+	}
+
+	manifest, err := LoadFileManifest(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("file_snapshot: %w", err)
+	}
+	manifest.Files = append(manifest.Files, FileManifestEntry{
+		Name: name, Format: s.format(), Rows: len(state), Bytes: n, ProducedAt: now,
+	})
+	var expired []FileManifestEntry
+	if s.Retain > 0 && len(manifest.Files) > s.Retain {
+		expired = manifest.Files[:len(manifest.Files)-s.Retain]
+		manifest.Files = manifest.Files[len(manifest.Files)-s.Retain:]
+	}
+	// Manifest first: a file it no longer lists may linger after a crash, never the reverse.
+	if err := saveFileManifest(s.Dir, manifest); err != nil {
+		return nil, fmt.Errorf("file_snapshot: %w", err)
+	}
+	for _, f := range expired {
+		if err := os.Remove(filepath.Join(s.Dir, f.Name)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("file_snapshot: retention: %w", err)
+		}
+	}
+	return nil, nil
+}
+
+// fileName returns a name for a file produced at now that is not taken yet (several flushes may share a ms).
+func (s *FileSnapshotFlushStrategy) fileName(now int64) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultFilePrefix
+	}
+	name := fmt.Sprintf("%s-%d.%s", prefix, now, s.format())
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(s.Dir, name)); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d-%d.%s", prefix, now, i, s.format())
+	}
+}
+
+func (s *FileSnapshotFlushStrategy) columns(state FlushState) []string {
+	if len(s.Columns) > 0 {
+		cols := make([]string, 0, len(s.Columns))
+		for _, sensor := range s.Columns {
+			if !reservedColumn(sensor) {
+				cols = append(cols, sensor)
+			}
+		}
+		return cols
+	}
+	seen := make(map[string]struct{})
+	for _, dev := range state {
+		for sensor := range dev {
+			if !reservedColumn(sensor) {
+				seen[sensor] = struct{}{}
+			}
+		}
+	}
+	cols := make([]string, 0, len(seen))
+	for sensor := range seen {
+		cols = append(cols, sensor)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// reservedColumn reports whether a sensor named name would overwrite the vin or produced_at column; such
+// sensors are not written.
+func reservedColumn(name string) bool {
+	return name == "vin" || name == "produced_at"
+}
+
+func (s *FileSnapshotFlushStrategy) encode(w io.Writer, state FlushState, now int64) error {
+	vins := make([]string, 0, len(state))
+	for vin := range state {
+		vins = append(vins, vin)
+	}
+	sort.Strings(vins)
+	cols := s.columns(state)
+
+	if s.format() == FileFormatParquet {
+		return encodeParquet(w, state, vins, cols, now)
+	}
+	enc := json.NewEncoder(w)
+	for _, vin := range vins {
+		row := map[string]any{"vin": vin, "produced_at": now}
+		for _, sensor := range cols {
+			if m, ok := state[vin][sensor]; ok {
+				row[sensor] = m.Value
+			}
+		}
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeParquet writes one row per VIN: vin, produced_at (ms) and an optional string column per sensor
+// (numbers and other non-string values as their JSON text).
+func encodeParquet(w io.Writer, state FlushState, vins, cols []string, now int64) error {
+	group := parquet.Group{
+		"vin":         parquet.String(),
+		"produced_at": parquet.Int(64),
+	}
+	for _, sensor := range cols {
+		group[sensor] = parquet.Optional(parquet.String())
+	}
+	schema := parquet.NewSchema("latest", group)
+
+	// Leaf columns are ordered by name; remember each one's index.
+	index := make(map[string]int)
+	for i, path := range schema.Columns() {
+		index[path[0]] = i
+	}
+	pw := parquet.NewWriter(w, schema, parquet.Compression(&parquet.Snappy))
+	rows := make([]parquet.Row, 0, len(vins))
+	for _, vin := range vins {
+		row := make(parquet.Row, len(index))
+		row[index["vin"]] = parquet.ByteArrayValue([]byte(vin)).Level(0, 0, index["vin"])
+		row[index["produced_at"]] = parquet.Int64Value(now).Level(0, 0, index["produced_at"])
+		for _, sensor := range cols {
+			i := index[sensor]
+			m, ok := state[vin][sensor]
+			if !ok || m.Value == nil {
+				row[i] = parquet.NullValue().Level(0, 0, i)
+				continue
+			}
+			text, err := valueText(m.Value)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", vin, sensor, err)
+			}
+			row[i] = parquet.ByteArrayValue([]byte(text)).Level(0, 1, i)
+		}
+		rows = append(rows, row)
+	}
+	if _, err := pw.WriteRows(rows); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
+func valueText(v any) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// writeFileAtomic writes path through a dot-prefixed temporary file in the same directory, synced and
+// renamed once complete. Returns the bytes written.
+func writeFileAtomic(path string, write func(io.Writer) error) (int64, error) {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: f}
+	bw := bufio.NewWriter(cw)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// LoadFileManifest reads manifest.json of dir; an empty manifest if there is none yet.
+func LoadFileManifest(dir string) (*FileManifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, fileManifestName))
+	if os.IsNotExist(err) {
+		return &FileManifest{Version: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m FileManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("manifest invalid: %w", err)
+	}
+	if m.Version != 1 {
+		return nil, fmt.Errorf("manifest version %d not supported (max 1)", m.Version)
+	}
+	return &m, nil
+}
+
+func saveFileManifest(dir string, m *FileManifest) error {
+	m.Version = 1
+	_, err := writeFileAtomic(filepath.Join(dir, fileManifestName), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+	return err
+}
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name:         StrategyFileSnapshot,
+		WholeDevices: true,
+		Fields: func() []*service.ConfigField {
+			return []*service.ConfigField{
+				service.NewStringField("file_dir").Description("Directory receiving one file per flush (one row per VIN, one column per sensor) and manifest.json (required)").Default(""),
+				service.NewStringEnumField("file_format", FileFormats...).Description("ndjson or parquet (sensor columns as optional strings)").Default(FileFormatNDJSON),
+				service.NewStringField("file_prefix").Description("File names are <prefix>-<unix ms>.<format>").Default(DefaultFilePrefix),
+				service.NewIntField("file_retain").Description("Number of most recent files kept; 0 = keep all").Default(0),
+			}
+		},
+		Build: func(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+			dir, _ := conf.FieldString("file_dir")
+			format, _ := conf.FieldString("file_format")
+			prefix, _ := conf.FieldString("file_prefix")
+			retain, _ := conf.FieldInt("file_retain")
+			if dir == "" {
+				return nil, errors.New("file_dir is required")
+			}
+			f := &FileSnapshotFlushStrategy{Dir: dir, Format: format, Prefix: prefix, Retain: max(retain, 0)}
+			// Sensor columns follow the resource matrix, so every file has the same schema.
+			for _, r := range env.ResourceMatrix {
+				f.Columns = append(f.Columns, r.ResourceName)
+			}
+			return f, nil
+		},
+	})
+}
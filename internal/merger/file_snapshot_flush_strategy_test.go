@@ -0,0 +1,163 @@
+package merger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func fileSnapshotState() FlushState {
+	return FlushState{
+		"VIN2": {"speed": {Value: 42.5, ReceivedAt: 100}, "door_status": {Value: "open", ReceivedAt: 100}},
+		"VIN1": {"speed": {Value: "541", ReceivedAt: 100}, "unknown": {Value: "x", ReceivedAt: 100}},
+	}
+}
+
+func TestFileSnapshotFlushStrategy_NDJSON(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSnapshotFlushStrategy{Dir: dir, Columns: []string{"speed", "door_status"}}
+
+	if _, err := s.OnFlush(context.Background(), fileSnapshotState()); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	m, err := LoadFileManifest(dir)
+	if err != nil || len(m.Files) != 1 {
+		t.Fatalf("manifest = %+v (%v), want 1 file", m, err)
+	}
+	entry := m.Files[0]
+	if !strings.HasPrefix(entry.Name, DefaultFilePrefix+"-") || !strings.HasSuffix(entry.Name, ".ndjson") || entry.Rows != 2 {
+		t.Errorf("manifest entry = %+v", entry)
+	}
+
+	f, err := os.Open(filepath.Join(dir, entry.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var rows []map[string]any
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var row map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 || rows[0]["vin"] != "VIN1" || rows[1]["vin"] != "VIN2" {
+		t.Fatalf("rows = %v, want VIN1 then VIN2", rows)
+	}
+	if rows[0]["speed"] != "541" || rows[1]["speed"] != 42.5 || rows[1]["door_status"] != "open" {
+		t.Errorf("rows = %v", rows)
+	}
+	if _, ok := rows[0]["unknown"]; ok {
+		t.Error("sensor outside Columns written")
+	}
+	if _, ok := rows[0]["door_status"]; ok {
+		t.Error("missing sensor written")
+	}
+}
+
+func TestFileSnapshotFlushStrategy_Parquet(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSnapshotFlushStrategy{Dir: dir, Format: FileFormatParquet, Columns: []string{"speed", "door_status"}}
+
+	if _, err := s.OnFlush(context.Background(), fileSnapshotState()); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	m, _ := LoadFileManifest(dir)
+	if len(m.Files) != 1 || !strings.HasSuffix(m.Files[0].Name, ".parquet") {
+		t.Fatalf("manifest = %+v", m)
+	}
+
+	type row struct {
+		VIN        string  `parquet:"vin"`
+		ProducedAt int64   `parquet:"produced_at"`
+		Speed      *string `parquet:"speed,optional"`
+		DoorStatus *string `parquet:"door_status,optional"`
+	}
+	rows, err := parquet.ReadFile[row](filepath.Join(dir, m.Files[0].Name))
+	if err != nil {
+		t.Fatalf("read parquet: %v", err)
+	}
+	if len(rows) != 2 || rows[0].VIN != "VIN1" || rows[1].VIN != "VIN2" {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if rows[0].Speed == nil || *rows[0].Speed != "541" || rows[0].DoorStatus != nil {
+		t.Errorf("VIN1 = %+v, want speed 541 and no door_status", rows[0])
+	}
+	if rows[1].Speed == nil || *rows[1].Speed != "42.5" || rows[1].DoorStatus == nil || *rows[1].DoorStatus != "open" {
+		t.Errorf("VIN2 = %+v, want speed 42.5 and door_status open", rows[1])
+	}
+	if rows[0].ProducedAt != m.Files[0].ProducedAt {
+		t.Errorf("produced_at = %d, want %d", rows[0].ProducedAt, m.Files[0].ProducedAt)
+	}
+}
+
+func TestFileSnapshotFlushStrategy_Retention(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSnapshotFlushStrategy{Dir: dir, Retain: 2}
+	for range 4 {
+		if _, err := s.OnFlush(context.Background(), fileSnapshotState()); err != nil {
+			t.Fatalf("OnFlush: %v", err)
+		}
+	}
+
+	m, _ := LoadFileManifest(dir)
+	if len(m.Files) != 2 {
+		t.Fatalf("manifest lists %d files, want 2", len(m.Files))
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{m.Files[0].Name, m.Files[1].Name, fileManifestName}
+	sort.Strings(want)
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("dir = %v, want %v (no temp files, expired ones removed)", names, want)
+	}
+}
+
+func TestFileSnapshotFlushStrategy_ReservedSensorNames(t *testing.T) {
+	state := FlushState{"VIN1": {"vin": {Value: "spoof", ReceivedAt: 100}, "produced_at": {Value: 1.0, ReceivedAt: 100}, "speed": {Value: 3.0, ReceivedAt: 100}}}
+	for _, columns := range [][]string{nil, {"vin", "speed", "produced_at"}} {
+		dir := t.TempDir()
+		s := &FileSnapshotFlushStrategy{Dir: dir, Columns: columns}
+		if _, err := s.OnFlush(context.Background(), state); err != nil {
+			t.Fatalf("OnFlush: %v", err)
+		}
+		m, err := LoadFileManifest(dir)
+		if err != nil || len(m.Files) != 1 {
+			t.Fatalf("manifest = %+v (%v), want 1 file", m, err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, m.Files[0].Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var row map[string]any
+		if err := json.Unmarshal(b, &row); err != nil {
+			t.Fatal(err)
+		}
+		if row["vin"] != "VIN1" || row["produced_at"] != float64(m.Files[0].ProducedAt) || row["speed"] != 3.0 {
+			t.Errorf("columns %v: row = %v, want vin and produced_at kept over the sensors of the same name", columns, row)
+		}
+	}
+}
+
+func TestFileSnapshotFlushStrategy_EmptyStateWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSnapshotFlushStrategy{Dir: dir}
+	if _, err := s.OnFlush(context.Background(), FlushState{}); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("dir has %d entries, want none", len(entries))
+	}
+}
@@ -3,6 +3,7 @@ package merger
 import (
 	"bethos/internal/model"
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/warpstreamlabs/bento/public/service"
@@ -18,22 +19,37 @@ func (InlineFlushStrategy) OnFlush(ctx context.Context, state FlushState) (servi
 	var batch service.MessageBatch
 	now := time.Now().UnixMilli()
 
-	for vin, dev := range state {
+	for _, vin := range sortedKeys(state) {
 		payload := model.Payload{
 			NumOfData: 1,
 			Data: model.Data{
 				ID:      vin,
-				Metrics: dev,
+				Metrics: state[vin],
 			},
 			ProducedAt: now,
 		}
+		hash, err := model.ContentHash(payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("inline: encode %s: %w", vin, err)
+		}
 
 		msg := service.NewMessage(nil)
 		msg.SetStructured(payload)
 		msg.MetaSet("vincode", vin)
+		msg.MetaSet(MetaContentHash, hash)
 
 		batch = append(batch, msg)
 	}
 
 	return batch, nil
 }
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name:      StrategyInline,
+		Encodable: true,
+		Build: func(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+			return InlineFlushStrategy{}, nil
+		},
+	})
+}
@@ -0,0 +1,41 @@
+package merger
+
+import (
+	"bethos/internal/model"
+	"context"
+	"testing"
+)
+
+func TestInlineFlushStrategy_OrderAndContentHash(t *testing.T) {
+	state := FlushState{
+		"VIN3": {"a": {Value: 1, ReceivedAt: 1}},
+		"VIN1": {"a": {Value: 1, ReceivedAt: 1}, "b": {Value: 2, ReceivedAt: 1}},
+		"VIN2": {"a": {Value: 1, ReceivedAt: 1}},
+	}
+	batch, err := InlineFlushStrategy{}.OnFlush(context.Background(), state)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if len(batch) != 3 {
+		t.Fatalf("got %d messages, want 3", len(batch))
+	}
+	for i, vin := range []string{"VIN1", "VIN2", "VIN3"} {
+		if got, _ := batch[i].MetaGet("vincode"); got != vin {
+			t.Errorf("message %d: vincode %s, want %s", i, got, vin)
+		}
+		want, _ := model.ContentHash(model.Data{ID: vin, Metrics: state[vin]})
+		if got, _ := batch[i].MetaGet(MetaContentHash); got != want {
+			t.Errorf("%s: content_hash %s, want %s", vin, got, want)
+		}
+	}
+
+	// Same state in a later flush: same hashes although produced_at differs.
+	again, _ := InlineFlushStrategy{}.OnFlush(context.Background(), state)
+	for i := range batch {
+		h1, _ := batch[i].MetaGet(MetaContentHash)
+		h2, _ := again[i].MetaGet(MetaContentHash)
+		if h1 != h2 {
+			t.Errorf("message %d: hash changed between flushes", i)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package merger
+
+import (
+	"bethos/internal/model"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// What a MultiFlushStrategy does when a child fails.
+const (
+	OnErrorFail     = "fail"     // the flush fails: state is kept and every child gets it again on the next flush
+	OnErrorContinue = "continue" // the error is logged and the child's messages of that flush are dropped
+)
+
+var OnErrorModes = []string{OnErrorFail, OnErrorContinue}
+
+// MultiChild is a strategy fanned out to by MultiFlushStrategy.
+type MultiChild struct {
+	Name     string // meta flush_strategy of its messages; unique within the multi
+	Strategy FlushStrategy
+	OnError  string // OnErrorFail if empty
+}
+
+// MultiFlushStrategy passes every flush to each child in order, with the same FlushState, and emits the
+// concatenation of their messages, each tagged with meta flush_strategy = the child's name (route on it with
+// a switch output). Every child runs even if an earlier one failed, so e.g. a cache outage does not stop the
+// compacted topic; the flush then fails if a child with OnErrorFail failed. On a retried flush the children
+// that had succeeded get the same devices again, so their outputs must tolerate redelivery; window_stream
+// emits a closed window only once, so a failed flush loses its windows. Evictions and observed values are
+// forwarded the same way to the children implementing EvictionListener, MetricObserver and FlushCommitter.
+type MultiFlushStrategy struct {
+	Children []MultiChild
+}
+
+// Validate checks the children: at least one, no nested multi, unique names, known OnError.
+func (s *MultiFlushStrategy) Validate() error {
+	if len(s.Children) == 0 {
+		return errors.New("no child strategies")
+	}
+	seen := make(map[string]bool, len(s.Children))
+	for _, c := range s.Children {
+		if c.Name == "" {
+			return errors.New("child strategy without name")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate child name %q", c.Name)
+		}
+		seen[c.Name] = true
+		if _, nested := c.Strategy.(*MultiFlushStrategy); nested {
+			return fmt.Errorf("child %s: nested multi not supported", c.Name)
+		}
+		if c.OnError != "" && c.OnError != OnErrorFail && c.OnError != OnErrorContinue {
+			return fmt.Errorf("child %s: unknown on_error %q (want one of %v)", c.Name, c.OnError, OnErrorModes)
+		}
+	}
+	return nil
+}
+
+func (s *MultiFlushStrategy) OnFlush(ctx context.Context, state FlushState) (service.MessageBatch, error) {
+	return s.fanOut("flush", func(c MultiChild) (service.MessageBatch, error) {
+		return c.Strategy.OnFlush(ctx, state)
+	})
+}
+
+func (s *MultiFlushStrategy) OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error) {
+	return s.fanOut("evict", func(c MultiChild) (service.MessageBatch, error) {
+		l, ok := c.Strategy.(EvictionListener)
+		if !ok {
+			return nil, nil
+		}
+		return l.OnEvict(ctx, evicted)
+	})
+}
+
+// FlushDone forwards the outcome of the whole flush: a child that succeeded still gets the state again when
+// another child failed it.
+func (s *MultiFlushStrategy) FlushDone(err error) {
+	for _, c := range s.Children {
+		if fc, ok := c.Strategy.(FlushCommitter); ok {
+			fc.FlushDone(err)
+		}
+	}
+}
+
+func (s *MultiFlushStrategy) Observe(vin, sensor string, v model.MetricValue) {
+	for _, c := range s.Children {
+		if o, ok := c.Strategy.(MetricObserver); ok {
+			o.Observe(vin, sensor, v)
+		}
+	}
+}
+
+// Close closes every child, returning their errors joined.
+func (s *MultiFlushStrategy) Close(ctx context.Context) error {
+	var errs []error
+	for _, c := range s.Children {
+		if err := c.Strategy.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("multi: child %s: %w", c.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MultiFlushStrategy) fanOut(op string, call func(MultiChild) (service.MessageBatch, error)) (service.MessageBatch, error) {
+	var batch service.MessageBatch
+	var errs []error
+	for _, c := range s.Children {
+		out, err := call(c)
+		if err != nil {
+			if c.OnError == OnErrorContinue {
+				log.Printf("[latest_merger] event=%s_error flush_strategy=%s on_error=%s error=%v", op, c.Name, c.OnError, err)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("multi: child %s: %w", c.Name, err))
+			continue
+		}
+		for _, msg := range out {
+			msg.MetaSet("flush_strategy", c.Name)
+		}
+		batch = append(batch, out...)
+	}
+	return batch, errors.Join(errs...)
+}
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name: StrategyMulti,
+		Fields: func() []*service.ConfigField {
+			child := append([]*service.ConfigField{
+				service.NewStringField("name").Description("Value of meta flush_strategy on the messages of this child; must be unique. Default: strategy").Default(""),
+				service.NewStringEnumField("on_error", OnErrorModes...).Description("fail = a failure of this child fails the flush (state kept, every child retried on the next flush); continue = log it and drop this child's messages of that flush").Default(OnErrorFail),
+			}, strategyConfigFields(StrategyMulti)...)
+			return []*service.ConfigField{
+				service.NewObjectListField("strategies", child...).Description("Child strategies, each called on every flush with the same state").Default([]any{}),
+			}
+		},
+		Build: buildMulti,
+	})
+}
+
+func buildMulti(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+	children, err := conf.FieldObjectList("strategies")
+	if err != nil {
+		return nil, err
+	}
+	multi := &MultiFlushStrategy{}
+	for i, child := range children {
+		c := MultiChild{}
+		c.Name, _ = child.FieldString("name")
+		c.OnError, _ = child.FieldString("on_error")
+		if name, _ := child.FieldString("strategy"); name == StrategyMulti {
+			return nil, fmt.Errorf("strategies[%d]: nested %s not supported", i, StrategyMulti)
+		} else if c.Name == "" {
+			c.Name = name
+		}
+		if c.Strategy, err = NewStrategy(child, env); err != nil {
+			return nil, fmt.Errorf("strategies[%d]: %w", i, err)
+		}
+		multi.Children = append(multi.Children, c)
+	}
+	if err := multi.Validate(); err != nil {
+		return nil, err
+	}
+	return multi, nil
+}
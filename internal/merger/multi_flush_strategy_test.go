@@ -0,0 +1,132 @@
+package merger
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"bethos/internal/model"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// stubStrategy emits one message per flushed VIN, or fails with err.
+type stubStrategy struct {
+	err      error
+	flushes  int
+	evicted  []Eviction
+	observed int
+	closed   bool
+}
+
+func (s *stubStrategy) OnFlush(ctx context.Context, state FlushState) (service.MessageBatch, error) {
+	s.flushes++
+	if s.err != nil {
+		return nil, s.err
+	}
+	var batch service.MessageBatch
+	for vin := range state {
+		msg := service.NewMessage([]byte(vin))
+		msg.MetaSet("vincode", vin)
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+func (s *stubStrategy) OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error) {
+	s.evicted = append(s.evicted, evicted...)
+	return nil, s.err
+}
+
+func (s *stubStrategy) Observe(vin, sensor string, v model.MetricValue) { s.observed++ }
+
+func (s *stubStrategy) Close(ctx context.Context) error {
+	s.closed = true
+	return s.err
+}
+
+func TestMultiFlushStrategy_TagsMessagesPerChild(t *testing.T) {
+	a, b := &stubStrategy{}, &stubStrategy{}
+	s := &MultiFlushStrategy{Children: []MultiChild{{Name: "topic", Strategy: a}, {Name: "cache", Strategy: b}}}
+
+	batch, err := s.OnFlush(context.Background(), FlushState{"VIN1": {"a": {Value: "1"}}})
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("got %d messages, want 2", len(batch))
+	}
+	for i, want := range []string{"topic", "cache"} {
+		if got, _ := batch[i].MetaGet("flush_strategy"); got != want {
+			t.Errorf("message %d flush_strategy = %q, want %q", i, got, want)
+		}
+	}
+
+	s.Observe("VIN1", "a", model.MetricValue{Value: "2"})
+	if a.observed != 1 || b.observed != 1 {
+		t.Errorf("observed = %d, %d, want 1 each", a.observed, b.observed)
+	}
+	if _, err := s.OnEvict(context.Background(), []Eviction{{VIN: "VIN1", Reason: EvictReasonTTL}}); err != nil {
+		t.Fatalf("OnEvict: %v", err)
+	}
+	if len(a.evicted) != 1 || len(b.evicted) != 1 {
+		t.Errorf("evictions forwarded = %d, %d, want 1 each", len(a.evicted), len(b.evicted))
+	}
+	if err := s.Close(context.Background()); err != nil || !a.closed || !b.closed {
+		t.Errorf("Close = %v, closed = %v, %v", err, a.closed, b.closed)
+	}
+}
+
+func TestMultiFlushStrategy_FailingChild(t *testing.T) {
+	state := FlushState{"VIN1": {"a": {Value: "1"}}}
+
+	// fail: every child still runs, the flush fails.
+	first, broken, last := &stubStrategy{}, &stubStrategy{err: errors.New("down")}, &stubStrategy{}
+	s := &MultiFlushStrategy{Children: []MultiChild{
+		{Name: "first", Strategy: first},
+		{Name: "broken", Strategy: broken},
+		{Name: "last", Strategy: last},
+	}}
+	if _, err := s.OnFlush(context.Background(), state); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("OnFlush error = %v, want one naming child broken", err)
+	}
+	if first.flushes != 1 || last.flushes != 1 {
+		t.Errorf("flushes = %d, %d, want every child called", first.flushes, last.flushes)
+	}
+
+	// continue: the flush succeeds without the failing child's messages.
+	s.Children[1].OnError = OnErrorContinue
+	batch, err := s.OnFlush(context.Background(), state)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if len(batch) != 2 {
+		t.Errorf("got %d messages, want 2 (first, last)", len(batch))
+	}
+}
+
+func TestMultiFlushStrategy_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		children []MultiChild
+		wantErr  string
+	}{
+		{"ok", []MultiChild{{Name: "a", Strategy: &stubStrategy{}}, {Name: "b", Strategy: &stubStrategy{}, OnError: OnErrorContinue}}, ""},
+		{"empty", nil, "no child"},
+		{"duplicate", []MultiChild{{Name: "a", Strategy: &stubStrategy{}}, {Name: "a", Strategy: &stubStrategy{}}}, "duplicate"},
+		{"nested", []MultiChild{{Name: "a", Strategy: &MultiFlushStrategy{}}}, "nested"},
+		{"on_error", []MultiChild{{Name: "a", Strategy: &stubStrategy{}, OnError: "retry"}}, "on_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&MultiFlushStrategy{Children: tt.children}).Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package merger
+
+import (
+	"bethos/internal/model"
+	"bethos/internal/resource"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Merge policies: how an incoming metric is reconciled with the stored one for the same sensor.
+const (
+	PolicyLatest     = "latest"      // newest received_at wins; ties broken by received_at_ns, then by arrival
+	PolicyFirstWrite = "first_write" // the first value ever merged is kept
+	PolicyMax        = "max"         // the largest numeric value is kept
+	PolicyMin        = "min"         // the smallest numeric value is kept
+	PolicyMonotonic  = "monotonic"   // like latest, but a value lower than the stored one is rejected (e.g. odometer)
+)
+
+// Policies lists the merge policy names, for config enums.
+var Policies = []string{PolicyLatest, PolicyFirstWrite, PolicyMax, PolicyMin, PolicyMonotonic}
+
+// MergePolicy decides whether incoming replaces stored (exists is false when the sensor has no value yet).
+type MergePolicy interface {
+	Accept(stored model.MetricValue, exists bool, incoming model.MetricValue) bool
+}
+
+type LatestPolicy struct{}
+
+func (LatestPolicy) Accept(stored model.MetricValue, exists bool, incoming model.MetricValue) bool {
+	if !exists {
+		return true
+	}
+	if incoming.ReceivedAt != stored.ReceivedAt {
+		return incoming.ReceivedAt > stored.ReceivedAt
+	}
+	return incoming.ReceivedAtNs >= stored.ReceivedAtNs
+}
+
+type FirstWritePolicy struct{}
+
+func (FirstWritePolicy) Accept(stored model.MetricValue, exists bool, incoming model.MetricValue) bool {
+	return !exists
+}
+
+type MaxPolicy struct{}
+
+func (MaxPolicy) Accept(stored model.MetricValue, exists bool, incoming model.MetricValue) bool {
+	return compareValues(stored, exists, incoming, 1)
+}
+
+type MinPolicy struct{}
+
+func (MinPolicy) Accept(stored model.MetricValue, exists bool, incoming model.MetricValue) bool {
+	return compareValues(stored, exists, incoming, -1)
+}
+
+type MonotonicPolicy struct{}
+
+func (MonotonicPolicy) Accept(stored model.MetricValue, exists bool, incoming model.MetricValue) bool {
+	if !(LatestPolicy{}).Accept(stored, exists, incoming) {
+		return false
+	}
+	if !exists {
+		return true
+	}
+	in, okIn := NumericValue(incoming.Value)
+	cur, okCur := NumericValue(stored.Value)
+	if !okCur {
+		return true
+	}
+	return okIn && in >= cur
+}
+
+// compareValues accepts incoming if its value is further in direction (1 = larger, -1 = smaller) than the
+// stored one; equal values fall back to latest so received_at still advances. A non-numeric incoming value
+// never replaces a numeric one.
+func compareValues(stored model.MetricValue, exists bool, incoming model.MetricValue, direction float64) bool {
+	if !exists {
+		return true
+	}
+	in, okIn := NumericValue(incoming.Value)
+	cur, okCur := NumericValue(stored.Value)
+	switch {
+	case !okCur:
+		return okIn || LatestPolicy{}.Accept(stored, exists, incoming)
+	case !okIn:
+		return false
+	case in == cur:
+		return LatestPolicy{}.Accept(stored, exists, incoming)
+	}
+	return (in-cur)*direction > 0
+}
+
+// NumericValue returns v as a number. Sensor values arrive as JSON numbers or as numeric strings ("541").
+func NumericValue(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// NewMergePolicy returns the policy for name; empty means PolicyLatest.
+func NewMergePolicy(name string) (MergePolicy, error) {
+	switch name {
+	case "", PolicyLatest:
+		return LatestPolicy{}, nil
+	case PolicyFirstWrite:
+		return FirstWritePolicy{}, nil
+	case PolicyMax:
+		return MaxPolicy{}, nil
+	case PolicyMin:
+		return MinPolicy{}, nil
+	case PolicyMonotonic:
+		return MonotonicPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown merge policy %q", name)
+}
+
+// PolicyOverrides returns sensor (resource_name) -> policy for resources with a merge_policy set.
+func PolicyOverrides(resources []resource.Resource) (map[string]MergePolicy, error) {
+	out := make(map[string]MergePolicy)
+	for _, r := range resources {
+		if r.MergePolicy == "" {
+			continue
+		}
+		p, err := NewMergePolicy(r.MergePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("resource %s (%s): %w", r.ResourceID, r.ResourceName, err)
+		}
+		out[r.ResourceName] = p
+	}
+	return out, nil
+}
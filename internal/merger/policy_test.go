@@ -0,0 +1,72 @@
+package merger
+
+import (
+	"testing"
+
+	"bethos/internal/model"
+	"bethos/internal/resource"
+)
+
+func TestMergePolicies_Accept(t *testing.T) {
+	mv := func(v any, ms, ns int64) model.MetricValue {
+		return model.MetricValue{Value: v, ReceivedAt: ms, ReceivedAtNs: ns}
+	}
+	tests := []struct {
+		name     string
+		policy   MergePolicy
+		stored   model.MetricValue
+		exists   bool
+		incoming model.MetricValue
+		want     bool
+	}{
+		{"latest/new sensor", LatestPolicy{}, model.MetricValue{}, false, mv("1", 1, 0), true},
+		{"latest/newer", LatestPolicy{}, mv("1", 100, 0), true, mv("2", 200, 0), true},
+		{"latest/older", LatestPolicy{}, mv("1", 200, 0), true, mv("2", 100, 0), false},
+		{"latest/tie newer ns", LatestPolicy{}, mv("1", 100, 5), true, mv("2", 100, 9), true},
+		{"latest/tie older ns", LatestPolicy{}, mv("1", 100, 9), true, mv("2", 100, 5), false},
+		{"latest/tie no ns, last arrival wins", LatestPolicy{}, mv("1", 100, 0), true, mv("2", 100, 0), true},
+		{"first_write/new sensor", FirstWritePolicy{}, model.MetricValue{}, false, mv("1", 1, 0), true},
+		{"first_write/existing", FirstWritePolicy{}, mv("1", 1, 0), true, mv("2", 200, 0), false},
+		{"max/larger", MaxPolicy{}, mv("10", 200, 0), true, mv(20.0, 100, 0), true},
+		{"max/smaller", MaxPolicy{}, mv("10", 100, 0), true, mv("5", 200, 0), false},
+		{"max/non-numeric", MaxPolicy{}, mv("10", 100, 0), true, mv("n/a", 200, 0), false},
+		{"min/smaller", MinPolicy{}, mv("10", 200, 0), true, mv("5", 100, 0), true},
+		{"min/larger", MinPolicy{}, mv("10", 100, 0), true, mv("20", 200, 0), false},
+		{"monotonic/forward", MonotonicPolicy{}, mv("1000", 100, 0), true, mv("1001", 200, 0), true},
+		{"monotonic/backwards", MonotonicPolicy{}, mv("1000", 100, 0), true, mv("999", 200, 0), false},
+		{"monotonic/older forward", MonotonicPolicy{}, mv("1000", 200, 0), true, mv("1001", 100, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Accept(tt.stored, tt.exists, tt.incoming); got != tt.want {
+				t.Errorf("Accept = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMergePolicy_Unknown(t *testing.T) {
+	if _, err := NewMergePolicy("newest"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestPolicyOverrides(t *testing.T) {
+	got, err := PolicyOverrides([]resource.Resource{
+		{ResourceID: "content.34183.1.3", ResourceName: "odometer", MergePolicy: PolicyMonotonic},
+		{ResourceID: "content.34183.1.2", ResourceName: "vehicle_speed"},
+	})
+	if err != nil {
+		t.Fatalf("PolicyOverrides: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 override, got %v", got)
+	}
+	if _, ok := got["odometer"].(MonotonicPolicy); !ok {
+		t.Errorf("odometer policy = %T, want MonotonicPolicy", got["odometer"])
+	}
+
+	if _, err := PolicyOverrides([]resource.Resource{{ResourceID: "x", ResourceName: "x", MergePolicy: "bogus"}}); err == nil {
+		t.Error("expected error for unknown policy in resource matrix")
+	}
+}
@@ -0,0 +1,127 @@
+package merger
+
+import (
+	"bethos/internal/codec"
+	"bethos/internal/resource"
+	"fmt"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// StrategyEnv is what a strategy may need to be built besides its own options.
+type StrategyEnv struct {
+	Resources      *service.Resources
+	ResourceMatrix []resource.Resource // loaded from latest_merger's resource_matrix_path; nil if unset
+	FlushMode      string
+	HasDevice      func(vin string) bool // whether the merger's state holds vin, flushed or not; nil if unknown
+}
+
+// StrategySpec registers a flush strategy: the latest_merger config selects it with strategy: <Name> and
+// sets its options in an object of the same name, e.g. window_stream: {window_size: 5m}.
+type StrategySpec struct {
+	Name string
+	// Fields returns its options (all with defaults); nil if it has none. A func so that multi can list the
+	// strategies registered after it.
+	Fields func() []*service.ConfigField
+	// WholeDevices rejects flush_mode changed_sensors: the strategy needs every sensor of a flushed device.
+	WholeDevices bool
+	// Encodable allows an encoding other than json: the strategy emits model.Payload or model.PayloadBatch
+	// messages (and does not implement MetricObserver).
+	Encodable bool
+	// Build creates the strategy from its options object.
+	Build func(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error)
+}
+
+var registry = make(map[string]StrategySpec)
+
+// RegisterStrategy adds spec to the registry; it panics on an empty or already registered name.
+func RegisterStrategy(spec StrategySpec) {
+	if spec.Name == "" || spec.Build == nil {
+		panic("merger: RegisterStrategy needs a name and a Build func")
+	}
+	if _, dup := registry[spec.Name]; dup {
+		panic(fmt.Sprintf("merger: strategy %s registered twice", spec.Name))
+	}
+	registry[spec.Name] = spec
+}
+
+// StrategyNames returns the registered strategies, sorted.
+func StrategyNames() []string {
+	return sortedKeys(registry)
+}
+
+// StrategyConfigFields returns the strategy field (an enum of the registered names, so an unknown one is a
+// lint error), the encoding of its messages and the options object of every strategy that has options.
+func StrategyConfigFields() []*service.ConfigField {
+	return strategyConfigFields("")
+}
+
+// strategyConfigFields is StrategyConfigFields without the strategy named exclude.
+func strategyConfigFields(exclude string) []*service.ConfigField {
+	var names []string
+	for _, name := range StrategyNames() {
+		if name != exclude {
+			names = append(names, name)
+		}
+	}
+	strategy := service.NewStringEnumField("strategy", names...).
+		Description("Flush strategy; its options go in the object of the same name (e.g. window_stream: {window_size: 5m})")
+	if exclude == "" {
+		strategy = strategy.Default(StrategyInline)
+	}
+	fields := []*service.ConfigField{
+		strategy,
+		service.NewStringEnumField("encoding", codec.Encodings...).Description("Encoding of the strategy's payload messages: json, or avro/protobuf with a schema derived from resource_matrix_path (inline and log_compacted only)").Default(codec.EncodingJSON),
+		service.NewStringField("schema_registry_url").Description("With encoding avro or protobuf: schema registry (Confluent API) to register the schemas in (subject = record name, e.g. bethos.Payload); messages are then framed with the schema id. Empty = unframed").Default(""),
+	}
+	for _, name := range names {
+		spec := registry[name]
+		if spec.Fields == nil {
+			continue
+		}
+		fields = append(fields, service.NewObjectField(name, spec.Fields()...).
+			Description(fmt.Sprintf("Options of strategy %s", name)))
+	}
+	return fields
+}
+
+// NewStrategy builds the strategy selected by the strategy field of conf (a config built from
+// StrategyConfigFields) from its options object.
+func NewStrategy(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+	name, err := conf.FieldString("strategy")
+	if err != nil {
+		return nil, err
+	}
+	spec, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q (want one of %v)", name, StrategyNames())
+	}
+	if spec.WholeDevices && env.FlushMode == FlushModeChangedSensors {
+		return nil, fmt.Errorf("flush_mode %s is not supported with strategy %s (use %s)", env.FlushMode, name, FlushModeChangedDevices)
+	}
+	s, err := spec.Build(conf.Namespace(name), env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return encodeStrategy(conf, name, spec, env, s)
+}
+
+// encodeStrategy wraps s in an EncodedFlushStrategy if conf sets an encoding other than json.
+func encodeStrategy(conf *service.ParsedConfig, name string, spec StrategySpec, env StrategyEnv, s FlushStrategy) (FlushStrategy, error) {
+	encoding, _ := conf.FieldString("encoding")
+	if encoding == "" || encoding == codec.EncodingJSON {
+		return s, nil
+	}
+	if !spec.Encodable {
+		return nil, fmt.Errorf("encoding %s is not supported with strategy %s", encoding, name)
+	}
+	var reg *codec.Registry
+	if url, _ := conf.FieldString("schema_registry_url"); url != "" {
+		reg = codec.NewRegistry(url)
+	}
+	c, err := codec.New(encoding, codec.Sensors(env.ResourceMatrix), reg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &EncodedFlushStrategy{Strategy: s, Codec: c}, nil
+}
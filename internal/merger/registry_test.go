@@ -0,0 +1,124 @@
+package merger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func strategySpec() *service.ConfigSpec {
+	return service.NewConfigSpec().Fields(StrategyConfigFields()...)
+}
+
+func newStrategyFromYAML(t *testing.T, yaml string, env StrategyEnv) (FlushStrategy, error) {
+	t.Helper()
+	conf, err := strategySpec().ParseYAML(yaml, nil)
+	if err != nil {
+		t.Fatalf("ParseYAML: %v", err)
+	}
+	return NewStrategy(conf, env)
+}
+
+func TestNewStrategy_NestedOptions(t *testing.T) {
+	s, err := newStrategyFromYAML(t, `
+strategy: window_stream
+window_stream:
+  window_size: 5m
+  allowed_lateness: 30s
+log_compacted:
+  batch_size: 50
+`, StrategyEnv{})
+	if err != nil {
+		t.Fatalf("NewStrategy: %v", err)
+	}
+	w, ok := s.(*WindowStreamStrategy)
+	if !ok || w.WindowSize != 5*time.Minute || w.AllowedLateness != 30*time.Second {
+		t.Errorf("strategy = %+v, want window_stream with 5m windows and 30s lateness", s)
+	}
+
+	// Defaults apply when the options object is omitted.
+	s, err = newStrategyFromYAML(t, "strategy: log_compacted\n", StrategyEnv{})
+	if err != nil {
+		t.Fatalf("NewStrategy: %v", err)
+	}
+	if c, ok := s.(*LogCompactedFlushStrategy); !ok || c.BatchSize != 1 || c.TombstoneGrace != 5*time.Minute {
+		t.Errorf("strategy = %+v, want log_compacted defaults", s)
+	}
+	if s, err = newStrategyFromYAML(t, "{}", StrategyEnv{}); err != nil || s != (InlineFlushStrategy{}) {
+		t.Errorf("default strategy = %v (%v), want inline", s, err)
+	}
+}
+
+func TestNewStrategy_Multi(t *testing.T) {
+	s, err := newStrategyFromYAML(t, `
+strategy: multi
+multi:
+  strategies:
+    - strategy: log_compacted
+      name: compacted
+      log_compacted:
+        batch_size: 10
+    - strategy: diff
+      on_error: continue
+`, StrategyEnv{})
+	if err != nil {
+		t.Fatalf("NewStrategy: %v", err)
+	}
+	m := s.(*MultiFlushStrategy)
+	if len(m.Children) != 2 || m.Children[0].Name != "compacted" || m.Children[1].Name != "diff" || m.Children[1].OnError != OnErrorContinue {
+		t.Fatalf("children = %+v", m.Children)
+	}
+	if c := m.Children[0].Strategy.(*LogCompactedFlushStrategy); c.BatchSize != 10 {
+		t.Errorf("child batch_size = %d, want 10", c.BatchSize)
+	}
+}
+
+func TestNewStrategy_Errors(t *testing.T) {
+	tests := []struct {
+		name, yaml, flushMode, wantErr string
+	}{
+		{"unknown", "strategy: kafka\n", "", "unknown strategy"},
+		{"required option", "strategy: state_store\n", "", "state_store: cache is required"},
+		{"whole devices", "strategy: diff\n", FlushModeChangedSensors, "not supported with strategy diff"},
+		{"whole devices file", "strategy: file_snapshot\nfile_snapshot:\n  file_dir: /tmp/x\n", FlushModeChangedSensors, "not supported with strategy file_snapshot"},
+		{"multi child", "strategy: multi\nmulti:\n  strategies:\n    - strategy: file_snapshot\n", "", "strategies[0]: file_snapshot: file_dir is required"},
+		{"multi empty", "strategy: multi\n", "", "no child strategies"},
+		{"invalid duration", "strategy: log_compacted\nlog_compacted:\n  tombstone_grace: 5 minutes\n", "", "invalid tombstone_grace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newStrategyFromYAML(t, tt.yaml, StrategyEnv{FlushMode: tt.flushMode})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewStrategy = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStrategyConfigFields_LintsUnknownStrategy(t *testing.T) {
+	env := service.NewEmptyEnvironment()
+	if err := env.RegisterProcessor("strategy_lint", strategySpec(),
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+			return nil, nil
+		}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		yaml    string
+		wantErr bool
+	}{
+		{"strategy_lint:\n  strategy: diff\n", false},
+		{"strategy_lint:\n  strategy: kafka\n", true},
+		{"strategy_lint:\n  window_stream:\n    window_sise: 5m\n", true},
+		{"strategy_lint:\n  strategy: multi\n  multi:\n    strategies:\n      - strategy: multi\n", true},
+	}
+	for _, tt := range tests {
+		err := env.NewStreamBuilder().AddProcessorYAML(tt.yaml)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("lint %q = %v, want error: %v", tt.yaml, err, tt.wantErr)
+		}
+	}
+}
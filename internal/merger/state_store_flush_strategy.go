@@ -3,46 +3,305 @@ package merger
 import (
 	"bethos/internal/model"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/warpstreamlabs/bento/public/service"
 )
 
+const (
+	DefaultStatePrefix   = "latest:"
+	DefaultStateIndexKey = "latest_index"
+	DefaultStateTTL      = 5 * time.Minute
+
+	// stateIndexLockTTL bounds how long a writer that died holding the index lock blocks the others.
+	stateIndexLockTTL = 30 * time.Second
+	// stateIndexLockRetry is the wait between two attempts to take the index lock.
+	stateIndexLockRetry = 10 * time.Millisecond
+)
+
+// StateStoreFlushStrategy writes each flushed device to the cache resource CacheName as a model.Payload
+// under Prefix+vin, and keeps under IndexKey a JSON array of the VINs written, so a separate reader (the
+// latest_state_publisher input) can find them. Devices evicted from the merger are deleted from both (see
+// OnEvict). It emits nothing itself. A cache error fails the flush.
+// Several replicas may share the cache: the index is only rewritten when a VIN is added or removed (or its
+// TTL is due for a refresh), under a lock taken with the cache's Add on IndexKey+".lock", so concurrent
+// writers do not drop each other's VINs.
 type StateStoreFlushStrategy struct {
 	CacheName string
 	Resources *service.Resources
+	Prefix    string        // DefaultStatePrefix if empty
+	IndexKey  string        // DefaultStateIndexKey if empty
+	TTL       time.Duration // per key, refreshed on every write; 0 = no expiry
+
+	indexSetAt atomic.Int64 // unix ms of this instance's last index write
 }
 
 func (s *StateStoreFlushStrategy) Close(ctx context.Context) error {
 	return nil
 }
 
+func (s *StateStoreFlushStrategy) prefix() string {
+	if s.Prefix == "" {
+		return DefaultStatePrefix
+	}
+	return s.Prefix
+}
+
+func (s *StateStoreFlushStrategy) indexKey() string {
+	if s.IndexKey == "" {
+		return DefaultStateIndexKey
+	}
+	return s.IndexKey
+}
+
+func (s *StateStoreFlushStrategy) ttl() *time.Duration {
+	if s.TTL <= 0 {
+		return nil
+	}
+	return &s.TTL
+}
+
 func (s *StateStoreFlushStrategy) OnFlush(
 	ctx context.Context,
 	state FlushState,
 ) (service.MessageBatch, error) {
 
-	if s.Resources == nil || s.CacheName == "" {
+	if s.Resources == nil || s.CacheName == "" || len(state) == 0 {
 		return nil, nil
 	}
 
-	return nil, s.Resources.AccessCache(ctx, s.CacheName, func(c service.Cache) {
-		ttl := 5 * time.Minute
-
-		for vin, dev := range state {
+	var err error
+	accessErr := s.Resources.AccessCache(ctx, s.CacheName, func(c service.Cache) {
+		now := time.Now().UnixMilli()
+		for _, vin := range sortedKeys(state) {
 			payload := model.Payload{
 				NumOfData: 1,
 				Data: model.Data{
 					ID:      vin,
-					Metrics: dev,
+					Metrics: state[vin],
 				},
-				ProducedAt: time.Now().UnixMilli(),
+				ProducedAt: now,
+			}
+			b, mErr := json.Marshal(payload)
+			if mErr != nil {
+				err = fmt.Errorf("state_store: encode %s: %w", vin, mErr)
+				return
+			}
+			if err = c.Set(ctx, s.prefix()+vin, b, s.ttl()); err != nil {
+				err = fmt.Errorf("state_store: set %s: %w", s.prefix()+vin, err)
+				return
+			}
+		}
+	})
+	if accessErr != nil {
+		return nil, fmt.Errorf("state_store: cache %s: %w", s.CacheName, accessErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.updateIndex(ctx, func(index map[string]struct{}) bool {
+		changed := false
+		for vin := range state {
+			if _, ok := index[vin]; !ok {
+				index[vin] = struct{}{}
+				changed = true
 			}
+		}
+		return changed
+	})
+}
 
-			b, _ := json.Marshal(payload)
+// OnEvict deletes evicted devices from the cache and the index, except those revoked by a rebalance: the
+// instance now consuming their partition keeps writing them to the same cache.
+func (s *StateStoreFlushStrategy) OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error) {
+	if s.Resources == nil || s.CacheName == "" || len(evicted) == 0 {
+		return nil, nil
+	}
 
-			_ = c.Set(ctx, "latest:"+vin, b, &ttl)
+	var err error
+	var deleted []string
+	accessErr := s.Resources.AccessCache(ctx, s.CacheName, func(c service.Cache) {
+		for _, e := range evicted {
+			if e.Reason == EvictReasonRevoked {
+				continue
+			}
+			if dErr := c.Delete(ctx, s.prefix()+e.VIN); dErr != nil && !errors.Is(dErr, service.ErrKeyNotFound) {
+				err = fmt.Errorf("state_store: delete %s: %w", s.prefix()+e.VIN, dErr)
+				return
+			}
+			deleted = append(deleted, e.VIN)
 		}
 	})
+	if accessErr != nil {
+		return nil, fmt.Errorf("state_store: cache %s: %w", s.CacheName, accessErr)
+	}
+	if err != nil || len(deleted) == 0 {
+		return nil, err
+	}
+	return nil, s.updateIndex(ctx, func(index map[string]struct{}) bool {
+		changed := false
+		for _, vin := range deleted {
+			if _, ok := index[vin]; ok {
+				delete(index, vin)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// updateIndex applies fn, which reports whether it changed the index, to the index. Nothing is written if
+// fn changes nothing and the TTL needs no refresh; otherwise the index is read again, changed and written
+// back sorted under the index lock. Each step is its own cache access, as with a remote cache.
+func (s *StateStoreFlushStrategy) updateIndex(ctx context.Context, fn func(map[string]struct{}) bool) error {
+	index, err := s.readIndex(ctx)
+	if err != nil {
+		return err
+	}
+	refresh := s.TTL > 0 && time.Since(time.UnixMilli(s.indexSetAt.Load())) >= s.TTL/2
+	if !fn(index) && !refresh {
+		return nil
+	}
+
+	unlock, err := s.lockIndex(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if index, err = s.readIndex(ctx); err != nil {
+		return err
+	}
+	fn(index)
+	vins := make([]string, 0, len(index))
+	for vin := range index {
+		vins = append(vins, vin)
+	}
+	sort.Strings(vins)
+	b, err := json.Marshal(vins)
+	if err != nil {
+		return err
+	}
+	if err := s.access(ctx, func(c service.Cache) error { return c.Set(ctx, s.indexKey(), b, s.ttl()) }); err != nil {
+		return fmt.Errorf("state_store: set index %s: %w", s.indexKey(), err)
+	}
+	s.indexSetAt.Store(time.Now().UnixMilli())
+	return nil
+}
+
+func (s *StateStoreFlushStrategy) readIndex(ctx context.Context) (map[string]struct{}, error) {
+	var vins []string
+	err := s.access(ctx, func(c service.Cache) (err error) {
+		vins, err = ReadStateIndex(ctx, c, s.indexKey())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]struct{}, len(vins))
+	for _, vin := range vins {
+		index[vin] = struct{}{}
+	}
+	return index, nil
+}
+
+// lockIndex takes the index lock: a key added with a random token that expires after stateIndexLockTTL.
+// It waits for a lock held by another writer until ctx is done. The returned func releases it.
+func (s *StateStoreFlushStrategy) lockIndex(ctx context.Context) (func(), error) {
+	key := s.indexKey() + ".lock"
+	var raw [8]byte
+	_, _ = rand.Read(raw[:])
+	token := []byte(hex.EncodeToString(raw[:]))
+	ttl := stateIndexLockTTL
+	for {
+		err := s.access(ctx, func(c service.Cache) error { return c.Add(ctx, key, token, &ttl) })
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, service.ErrKeyAlreadyExists) {
+			return nil, fmt.Errorf("state_store: lock index %s: %w", key, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("state_store: lock index %s: %w", key, ctx.Err())
+		case <-time.After(stateIndexLockRetry):
+		}
+	}
+	return func() {
+		// Only delete our own lock: after stateIndexLockTTL it may belong to another writer.
+		bg := context.Background()
+		_ = s.access(bg, func(c service.Cache) error {
+			if cur, err := c.Get(bg, key); err == nil && string(cur) == string(token) {
+				return c.Delete(bg, key)
+			}
+			return nil
+		})
+	}, nil
+}
+
+// access runs fn on the cache, returning its error or that of the cache access.
+func (s *StateStoreFlushStrategy) access(ctx context.Context, fn func(service.Cache) error) error {
+	var err error
+	if aErr := s.Resources.AccessCache(ctx, s.CacheName, func(c service.Cache) { err = fn(c) }); aErr != nil {
+		return fmt.Errorf("state_store: cache %s: %w", s.CacheName, aErr)
+	}
+	return err
+}
+
+// ReadStateIndex returns the VINs listed under key by StateStoreFlushStrategy; none if the key does not exist.
+func ReadStateIndex(ctx context.Context, c service.Cache, key string) ([]string, error) {
+	b, err := c.Get(ctx, key)
+	if errors.Is(err, service.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("state_store: get index %s: %w", key, err)
+	}
+	var vins []string
+	if err := json.Unmarshal(b, &vins); err != nil {
+		return nil, fmt.Errorf("state_store: index %s invalid: %w", key, err)
+	}
+	return vins, nil
+}
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name: StrategyStateStore,
+		Fields: func() []*service.ConfigField {
+			return []*service.ConfigField{
+				service.NewStringField("cache").Description("Cache resource the devices are written to (required)").Default(""),
+				service.NewStringField("cache_index_key").Description("Cache key for the list of vincodes").Default(DefaultStateIndexKey),
+				service.NewStringField("cache_prefix").Description("Cache key prefix per device").Default(DefaultStatePrefix),
+				service.NewStringField("cache_ttl").Description("TTL of the device and index keys, refreshed on every flush; 0 = no expiry").Default("5m"),
+			}
+		},
+		// A device key is replaced as a whole, so a partial device would drop sensors.
+		WholeDevices: true,
+		Build: func(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+			cacheName, _ := conf.FieldString("cache")
+			indexKey, _ := conf.FieldString("cache_index_key")
+			prefix, _ := conf.FieldString("cache_prefix")
+			ttlStr, _ := conf.FieldString("cache_ttl")
+			if cacheName == "" {
+				return nil, errors.New("cache is required")
+			}
+			ttl, err := time.ParseDuration(ttlStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cache_ttl %q", ttlStr)
+			}
+			return &StateStoreFlushStrategy{
+				CacheName: cacheName,
+				Resources: env.Resources,
+				Prefix:    prefix,
+				IndexKey:  indexKey,
+				TTL:       ttl,
+			}, nil
+		},
+	})
 }
@@ -0,0 +1,164 @@
+package merger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"bethos/internal/model"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func cacheGet(t *testing.T, res *service.Resources, key string) ([]byte, error) {
+	t.Helper()
+	var b []byte
+	var err error
+	if aErr := res.AccessCache(context.Background(), "state", func(c service.Cache) {
+		b, err = c.Get(context.Background(), key)
+	}); aErr != nil {
+		t.Fatalf("AccessCache: %v", aErr)
+	}
+	return b, err
+}
+
+func TestStateStoreFlushStrategy_WritesPayloadsAndIndex(t *testing.T) {
+	ctx := context.Background()
+	res := service.MockResources(service.MockResourcesOptAddCache("state"))
+	s := &StateStoreFlushStrategy{CacheName: "state", Resources: res, Prefix: "dev:", IndexKey: "vins"}
+
+	if _, err := s.OnFlush(ctx, FlushState{"VIN2": {"a": {Value: "1", ReceivedAt: 100}}}); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	// A delta flush with another device keeps VIN2 in the index.
+	if _, err := s.OnFlush(ctx, FlushState{"VIN1": {"a": {Value: "2", ReceivedAt: 200}}}); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+
+	b, err := cacheGet(t, res, "dev:VIN1")
+	if err != nil {
+		t.Fatalf("get dev:VIN1: %v", err)
+	}
+	var p model.Payload
+	if err := json.Unmarshal(b, &p); err != nil || p.Data.ID != "VIN1" || p.Data.Metrics["a"].Value != "2" {
+		t.Errorf("dev:VIN1 = %s (%v), want VIN1 payload with a=2", b, err)
+	}
+	b, _ = cacheGet(t, res, "vins")
+	var vins []string
+	if err := json.Unmarshal(b, &vins); err != nil || !reflect.DeepEqual(vins, []string{"VIN1", "VIN2"}) {
+		t.Errorf("index = %s, want [VIN1 VIN2]", b)
+	}
+}
+
+func TestStateStoreFlushStrategy_EvictDeletes(t *testing.T) {
+	ctx := context.Background()
+	res := service.MockResources(service.MockResourcesOptAddCache("state"))
+	s := &StateStoreFlushStrategy{CacheName: "state", Resources: res}
+
+	state := FlushState{"VIN1": {"a": {Value: "1"}}, "VIN2": {"a": {Value: "1"}}, "VIN3": {"a": {Value: "1"}}}
+	if _, err := s.OnFlush(ctx, state); err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	_, err := s.OnEvict(ctx, []Eviction{{VIN: "VIN1", Reason: EvictReasonTTL}, {VIN: "VIN2", Reason: EvictReasonRevoked}, {VIN: "VIN9", Reason: EvictReasonManual}})
+	if err != nil {
+		t.Fatalf("OnEvict: %v", err)
+	}
+
+	if _, err := cacheGet(t, res, DefaultStatePrefix+"VIN1"); !errors.Is(err, service.ErrKeyNotFound) {
+		t.Errorf("VIN1 still cached (err %v)", err)
+	}
+	if _, err := cacheGet(t, res, DefaultStatePrefix+"VIN2"); err != nil {
+		t.Errorf("revoked VIN2 deleted: %v", err)
+	}
+	b, _ := cacheGet(t, res, DefaultStateIndexKey)
+	if string(b) != `["VIN2","VIN3"]` {
+		t.Errorf("index = %s, want [VIN2 VIN3]", b)
+	}
+}
+
+func TestStateStoreFlushStrategy_UnknownCacheFailsFlush(t *testing.T) {
+	s := &StateStoreFlushStrategy{CacheName: "missing", Resources: service.MockResources()}
+	if _, err := s.OnFlush(context.Background(), FlushState{"VIN1": {"a": {Value: "1"}}}); err == nil {
+		t.Fatal("OnFlush with an unknown cache returned nil error")
+	}
+}
+
+func TestStateStoreFlushStrategy_ConcurrentWritersKeepIndex(t *testing.T) {
+	ctx := context.Background()
+	res := service.MockResources(service.MockResourcesOptAddCache("state"))
+	const perWriter = 40
+
+	// Two replicas sharing the cache, each flushing its own devices one at a time.
+	var wg sync.WaitGroup
+	var want []string
+	for w := 0; w < 2; w++ {
+		s := &StateStoreFlushStrategy{CacheName: "state", Resources: res, TTL: time.Minute}
+		var vins []string
+		for i := 0; i < perWriter; i++ {
+			vins = append(vins, fmt.Sprintf("W%d-VIN%02d", w, i))
+		}
+		want = append(want, vins...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, vin := range vins {
+				if _, err := s.OnFlush(ctx, FlushState{vin: {"a": {Value: "1"}}}); err != nil {
+					t.Errorf("OnFlush %s: %v", vin, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, _ := cacheGet(t, res, DefaultStateIndexKey)
+	var got []string
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("index %s: %v", b, err)
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("index has %d VINs, want %d: concurrent writers lost entries", len(got), len(want))
+	}
+	if _, err := cacheGet(t, res, DefaultStateIndexKey+".lock"); !errors.Is(err, service.ErrKeyNotFound) {
+		t.Errorf("index lock left behind: %v", err)
+	}
+}
+
+func TestStateStoreFlushStrategy_IndexWriteWaitsForLock(t *testing.T) {
+	ctx := context.Background()
+	res := service.MockResources(service.MockResourcesOptAddCache("state"))
+	s := &StateStoreFlushStrategy{CacheName: "state", Resources: res}
+
+	// Another replica holds the lock while it adds VIN9 to the index.
+	setKey := func(key, value string) {
+		_ = res.AccessCache(ctx, "state", func(c service.Cache) { _ = c.Set(ctx, key, []byte(value), nil) })
+	}
+	setKey(DefaultStateIndexKey+".lock", "other")
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.OnFlush(ctx, FlushState{"VIN1": {"a": {Value: "1"}}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("OnFlush returned (%v) while another writer held the index lock", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	setKey(DefaultStateIndexKey, `["VIN9"]`)
+	_ = res.AccessCache(ctx, "state", func(c service.Cache) { _ = c.Delete(ctx, DefaultStateIndexKey+".lock") })
+
+	if err := <-done; err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	b, _ := cacheGet(t, res, DefaultStateIndexKey)
+	if string(b) != `["VIN1","VIN9"]` {
+		t.Errorf("index = %s, want the other writer's VIN9 kept", b)
+	}
+}
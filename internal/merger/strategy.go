@@ -12,11 +12,64 @@ const (
 	StrategyStateStore   = "state_store"
 	StrategyLogCompacted = "log_compacted"
 	StrategyWindowStream = "window_stream"
+	StrategyFileSnapshot = "file_snapshot"
+	StrategyDiff         = "diff"
+	StrategyMulti        = "multi"
 )
 
+// MetaContentHash is the metadata key of model.ContentHash of the devices a message carries, set by the
+// strategies emitting current state (inline, log_compacted, diff keyframes). Their messages come in VIN order.
+const MetaContentHash = "content_hash"
+
+// Eviction reasons reported to EvictionListener.
+const (
+	EvictReasonTTL      = "ttl"      // not updated within the device TTL
+	EvictReasonCapacity = "capacity" // dropped to stay under the max device count (device may still be alive)
+	EvictReasonRevoked  = "revoked"  // its source partition is no longer consumed by this instance (another one owns it)
+	EvictReasonManual   = "manual"   // removed on request by a flush trigger's evict option
+)
+
+// Flush modes: what the merger puts in the FlushState passed to OnFlush.
+const (
+	FlushModeFull           = "full"            // every device in state, all sensors
+	FlushModeChangedDevices = "changed_devices" // devices updated since the last successful flush, all sensors
+	FlushModeChangedSensors = "changed_sensors" // devices updated since the last successful flush, only the updated sensors
+)
+
+// FlushState is vin -> sensor -> metric. In a changed_* flush mode it holds only what changed since the
+// last successful flush (possibly nothing), so strategies emit deltas without tracking state themselves.
 type FlushState map[string]map[string]model.MetricValue
 
 type FlushStrategy interface {
 	OnFlush(ctx context.Context, state FlushState) (service.MessageBatch, error)
 	Close(ctx context.Context) error
 }
+
+// Eviction is a device removed from merger state.
+type Eviction struct {
+	VIN    string
+	Reason string
+	At     int64 // unix ms
+}
+
+// EvictionListener is implemented by strategies that react to devices dropped from state.
+// OnEvict is called on every flush right after OnFlush, with the evictions since the previous flush
+// (possibly none); the returned messages are appended to the flush batch.
+type EvictionListener interface {
+	OnEvict(ctx context.Context, evicted []Eviction) (service.MessageBatch, error)
+}
+
+// FlushCommitter is implemented by strategies keeping state derived from what they emit. The merger calls
+// FlushDone after every flush reaching OnFlush, with nil if the flush succeeded (OnFlush and OnEvict of every
+// strategy) or the error that failed it, in which case the same state is passed again on the next flush.
+type FlushCommitter interface {
+	FlushDone(err error)
+}
+
+// MetricObserver is implemented by strategies that need every incoming sensor value rather than the merged
+// state, e.g. to assign it to an event-time window. The merger calls Observe for each value as it is merged,
+// whether or not the merge policy accepted it (exact duplicates of the stored value excepted), from
+// concurrent pipeline threads.
+type MetricObserver interface {
+	Observe(vin, sensor string, v model.MetricValue)
+}
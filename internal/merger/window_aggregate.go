@@ -0,0 +1,114 @@
+package merger
+
+import (
+	"bethos/internal/model"
+	"bethos/internal/resource"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Sensor aggregates of WindowStreamStrategy.
+const (
+	AggregateNumeric     = "numeric"     // count, first, last, min, max, mean
+	AggregateCategorical = "categorical" // count, first, last, changes
+)
+
+var Aggregates = []string{AggregateNumeric, AggregateCategorical}
+
+// AggregateOverrides returns the window_stream aggregate per sensor (resource_name): the window_aggregate of
+// each resource, then configured, whose keys are a resource_id of resources or a sensor name.
+func AggregateOverrides(resources []resource.Resource, configured map[string]string) (map[string]string, error) {
+	out := make(map[string]string)
+	idToName := make(map[string]string, len(resources))
+	for _, r := range resources {
+		idToName[r.ResourceID] = r.ResourceName
+		if r.WindowAggregate == "" {
+			continue
+		}
+		if err := validAggregate(r.WindowAggregate); err != nil {
+			return nil, fmt.Errorf("resource %s (%s): %w", r.ResourceID, r.ResourceName, err)
+		}
+		out[r.ResourceName] = r.WindowAggregate
+	}
+	for key, agg := range configured {
+		if err := validAggregate(agg); err != nil {
+			return nil, fmt.Errorf("sensor %s: %w", key, err)
+		}
+		if name, ok := idToName[key]; ok {
+			key = name
+		}
+		out[key] = agg
+	}
+	return out, nil
+}
+
+func validAggregate(name string) error {
+	for _, a := range Aggregates {
+		if name == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown window aggregate %q (want one of %v)", name, Aggregates)
+}
+
+// addSample inserts v into samples, kept ordered by received_at. A value already present (same timestamps
+// and value, e.g. redelivered) is not added again.
+func addSample(samples []model.MetricValue, v model.MetricValue) []model.MetricValue {
+	i := sort.Search(len(samples), func(i int) bool { return sampleAfter(samples[i], v) })
+	for j := i - 1; j >= 0 && !sampleAfter(v, samples[j]); j-- {
+		if reflect.DeepEqual(samples[j].Value, v.Value) {
+			return samples
+		}
+	}
+	samples = append(samples, model.MetricValue{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = v
+	return samples
+}
+
+// sampleAfter reports whether a was received strictly after b.
+func sampleAfter(a, b model.MetricValue) bool {
+	if a.ReceivedAt != b.ReceivedAt {
+		return a.ReceivedAt > b.ReceivedAt
+	}
+	return a.ReceivedAtNs > b.ReceivedAtNs
+}
+
+// aggregateSamples summarizes samples (ordered by received_at, not empty) as kind; any other kind gives
+// only count, first and last.
+func aggregateSamples(kind string, samples []model.MetricValue) model.SensorAggregate {
+	agg := model.SensorAggregate{Count: len(samples), First: samples[0], Last: samples[len(samples)-1]}
+	switch kind {
+	case AggregateNumeric:
+		var lo, hi, sum float64
+		n := 0
+		for _, s := range samples {
+			f, ok := NumericValue(s.Value)
+			if !ok {
+				continue
+			}
+			if n == 0 || f < lo {
+				lo = f
+			}
+			if n == 0 || f > hi {
+				hi = f
+			}
+			sum += f
+			n++
+		}
+		if n > 0 {
+			mean := sum / float64(n)
+			agg.Min, agg.Max, agg.Mean = &lo, &hi, &mean
+		}
+	case AggregateCategorical:
+		changes := 0
+		for i := 1; i < len(samples); i++ {
+			if !reflect.DeepEqual(samples[i].Value, samples[i-1].Value) {
+				changes++
+			}
+		}
+		agg.Changes = &changes
+	}
+	return agg
+}
@@ -0,0 +1,112 @@
+package merger
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"bethos/internal/model"
+	"bethos/internal/resource"
+)
+
+func TestAggregateSamples(t *testing.T) {
+	var samples []model.MetricValue
+	for _, v := range []model.MetricValue{
+		{Value: 30.0, ReceivedAt: 3},
+		{Value: "10", ReceivedAt: 1},
+		{Value: "n/a", ReceivedAt: 2},
+		{Value: 30.0, ReceivedAt: 3}, // redelivered
+		{Value: 20.0, ReceivedAt: 4},
+	} {
+		samples = addSample(samples, v)
+	}
+
+	num := aggregateSamples(AggregateNumeric, samples)
+	if num.Count != 4 || num.First.Value != "10" || num.Last.Value != 20.0 {
+		t.Errorf("count/first/last = %d %v %v, want 4 10 20", num.Count, num.First.Value, num.Last.Value)
+	}
+	if num.Min == nil || *num.Min != 10 || *num.Max != 30 || *num.Mean != 20 || num.Changes != nil {
+		t.Errorf("numeric aggregate = %+v, want min 10 max 30 mean 20", num)
+	}
+
+	cat := aggregateSamples(AggregateCategorical, samples)
+	if cat.Changes == nil || *cat.Changes != 3 || cat.Min != nil {
+		t.Errorf("categorical aggregate = %+v, want 3 changes and no min", cat)
+	}
+
+	plain := aggregateSamples("", samples)
+	if plain.Count != 4 || plain.Min != nil || plain.Changes != nil {
+		t.Errorf("default aggregate = %+v, want count/first/last only", plain)
+	}
+}
+
+func TestAggregateSamples_CategoricalChanges(t *testing.T) {
+	var samples []model.MetricValue
+	for i, v := range []string{"closed", "open", "open", "closed", "closed"} {
+		samples = addSample(samples, model.MetricValue{Value: v, ReceivedAt: int64(i + 1)})
+	}
+	if got := aggregateSamples(AggregateCategorical, samples); *got.Changes != 2 {
+		t.Errorf("changes = %d, want 2", *got.Changes)
+	}
+}
+
+func TestAggregateOverrides(t *testing.T) {
+	resources := []resource.Resource{
+		{ResourceID: "r1", ResourceName: "speed", WindowAggregate: AggregateNumeric},
+		{ResourceID: "r2", ResourceName: "door_status"},
+		{ResourceID: "r3", ResourceName: "fuel", WindowAggregate: AggregateNumeric},
+	}
+	got, err := AggregateOverrides(resources, map[string]string{"r2": AggregateCategorical, "gear": AggregateCategorical})
+	if err != nil {
+		t.Fatalf("AggregateOverrides: %v", err)
+	}
+	want := map[string]string{"speed": AggregateNumeric, "fuel": AggregateNumeric, "door_status": AggregateCategorical, "gear": AggregateCategorical}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := AggregateOverrides(nil, map[string]string{"speed": "median"}); err == nil {
+		t.Error("unknown aggregate accepted")
+	}
+	if _, err := AggregateOverrides([]resource.Resource{{ResourceID: "r1", ResourceName: "speed", WindowAggregate: "median"}}, nil); err == nil {
+		t.Error("unknown resource aggregate accepted")
+	}
+}
+
+func TestWindowStreamStrategy_AggregatePayload(t *testing.T) {
+	w := newTestWindowStrategy()
+	w.Aggregates = map[string]string{"speed": AggregateNumeric, "door_status": AggregateCategorical}
+
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 40.0, ReceivedAt: 20_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 60.0, ReceivedAt: 10_000})
+	w.Observe("VIN1", "door_status", model.MetricValue{Value: "open", ReceivedAt: 10_000})
+	w.Observe("VIN1", "door_status", model.MetricValue{Value: "closed", ReceivedAt: 30_000})
+	w.Observe("VIN1", "gear", model.MetricValue{Value: "D", ReceivedAt: 30_000})
+	w.Observe("VIN2", "speed", model.MetricValue{Value: 1.0, ReceivedAt: 75_000}) // closes window 0
+
+	batch, err := w.OnFlush(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("got %d messages, want 1", len(batch))
+	}
+	obj, _ := batch[0].AsStructured()
+	p, ok := obj.(model.WindowPayload)
+	if !ok {
+		t.Fatalf("got %T, want model.WindowPayload", obj)
+	}
+	if p.Data.ID != "VIN1" || p.WindowStart != 0 || p.WindowEnd != 60_000 {
+		t.Errorf("payload = %s [%d, %d), want VIN1 [0, 60000)", p.Data.ID, p.WindowStart, p.WindowEnd)
+	}
+	speed := p.Data.Sensors["speed"]
+	if speed.Count != 2 || *speed.Mean != 50 || speed.First.Value != 60.0 || speed.Last.Value != 40.0 {
+		t.Errorf("speed = %+v, want count 2 mean 50 first 60 last 40", speed)
+	}
+	if door := p.Data.Sensors["door_status"]; door.Changes == nil || *door.Changes != 1 {
+		t.Errorf("door_status = %+v, want 1 change", door)
+	}
+	if gear := p.Data.Sensors["gear"]; gear.Count != 1 || gear.Min != nil || gear.Changes != nil {
+		t.Errorf("gear = %+v, want count/first/last only", gear)
+	}
+}
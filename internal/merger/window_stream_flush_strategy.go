@@ -2,80 +2,495 @@ package merger
 
 import (
 	"bethos/internal/model"
+	"bethos/internal/snapshot"
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/warpstreamlabs/bento/public/service"
 )
 
+const (
+	DefaultWindowSize      = 2 * time.Minute
+	DefaultAllowedLateness = 10 * time.Second
+	DefaultSessionGap      = 5 * time.Minute
+	// DefaultWindowStatePath is where open windows are kept across restarts with emit_on_close.
+	DefaultWindowStatePath = "./data/window_stream_state.json"
+)
+
+// Window types of WindowStreamStrategy.
+const (
+	WindowTumbling = "tumbling" // fixed, non-overlapping windows of WindowSize
+	WindowHopping  = "hopping"  // windows of WindowSize starting every WindowHop; overlapping (sliding) when the hop is smaller
+	WindowSession  = "session"  // per VIN, from its first value until SessionGap without values
+)
+
+var WindowTypes = []string{WindowTumbling, WindowHopping, WindowSession}
+
+// WindowStreamStrategy emits, per event-time window, the last value of each sensor of each device within the
+// window. Values are assigned to windows by their ReceivedAt as the merger observes them (see MetricObserver),
+// so the FlushState passed to OnFlush is not used. The watermark is the newest ReceivedAt observed minus
+// AllowedLateness: a window closes, and is emitted on the next flush, once its end (for a session, its last
+// value plus SessionGap) is at or before the watermark; values for an already closed window are dropped.
 type WindowStreamStrategy struct {
-	WindowSize      time.Duration // e.g. 2m
-	AllowedLateness time.Duration // e.g. 10s
-	EmitOnClose     bool
+	Type            string // WindowTumbling if empty
+	WindowSize      time.Duration
+	WindowHop       time.Duration // hopping only; WindowSize if <= 0
+	SessionGap      time.Duration // session only
+	AllowedLateness time.Duration
+	// MaxWindowDevices bounds the device entries held by open windows (a device in two windows counts twice).
+	// Above it the window closing first is closed early and emitted on the next flush with meta
+	// window_closed_early=true; values for it arriving after that open a new window with the same bounds
+	// (for a session, a new session of the VIN), emitted in turn. 0 = unlimited.
+	MaxWindowDevices int
+	// Aggregates switches the output to model.WindowPayload: per sensor, the aggregate named here
+	// (AggregateNumeric or AggregateCategorical) of all its values in the window; sensors not listed get
+	// count, first and last. Empty = model.Payload with the last value of each sensor.
+	Aggregates map[string]string
+	// EmitOnClose keeps the windows still open at shutdown: they are written to StatePath for Restore on the
+	// next start and emitted once they close. Nothing is emitted on shutdown (Bento drops what Close returns),
+	// so without StatePath, or without EmitOnClose, they are dropped.
+	EmitOnClose bool
+	StatePath   string
+
+	mu         sync.Mutex
+	windows    map[int64]*streamWindow    // open tumbling/hopping windows by start
+	sessions   map[string][]*streamWindow // open sessions by VIN
+	early      []*streamWindow            // closed early, emitted by the next OnFlush
+	held       int                        // device entries in open windows
+	maxEventAt int64                      // newest ReceivedAt observed (unix ms)
+}
 
-	mu      sync.Mutex
-	windows map[int64]map[string]model.MetricValue // windowStart -> vin -> metrics
+type streamWindow struct {
+	Start   int64                                   `json:"start"`
+	End     int64                                   `json:"end"`           // exclusive for time windows; last value for sessions
+	VIN     string                                  `json:"vin,omitempty"` // sessions only
+	Devices map[string]map[string]model.MetricValue `json:"devices"`       // vin -> sensor -> metric
+	Early   bool                                    `json:"closed_early,omitempty"`
+	// Samples holds, with Aggregates, every value of the window: vin -> sensor -> values by received_at.
+	Samples map[string]map[string][]model.MetricValue `json:"samples,omitempty"`
+}
+
+func (win *streamWindow) addSample(vin, sensor string, v model.MetricValue) {
+	if win.Samples == nil {
+		win.Samples = make(map[string]map[string][]model.MetricValue)
+	}
+	if win.Samples[vin] == nil {
+		win.Samples[vin] = make(map[string][]model.MetricValue)
+	}
+	win.Samples[vin][sensor] = addSample(win.Samples[vin][sensor], v)
 }
 
 func NewWindowStreamStrategy() *WindowStreamStrategy {
 	return &WindowStreamStrategy{
-		WindowSize:      2 * time.Minute,
-		AllowedLateness: 10 * time.Second,
+		Type:            WindowTumbling,
+		WindowSize:      DefaultWindowSize,
+		AllowedLateness: DefaultAllowedLateness,
+		SessionGap:      DefaultSessionGap,
 		EmitOnClose:     true,
-		windows:         make(map[int64]map[string]model.MetricValue),
 	}
 }
 
+// Validate reports an unusable window configuration.
+func (w *WindowStreamStrategy) Validate() error {
+	switch w.Type {
+	case "", WindowTumbling, WindowHopping:
+		if w.WindowSize <= 0 {
+			return fmt.Errorf("window size must be positive")
+		}
+		if w.Type == WindowHopping && w.WindowHop > w.WindowSize {
+			return fmt.Errorf("window hop %s is larger than window size %s (values between windows would be lost)", w.WindowHop, w.WindowSize)
+		}
+	case WindowSession:
+		if w.SessionGap <= 0 {
+			return fmt.Errorf("session gap must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown window type %q", w.Type)
+	}
+	return nil
+}
+
+// Close writes the open windows to StatePath if EmitOnClose is set, and drops them otherwise. An error is
+// returned if EmitOnClose is set without StatePath and windows are dropped.
 func (w *WindowStreamStrategy) Close(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.EmitOnClose && w.StatePath != "" {
+		st := windowState{MaxEventAt: w.maxEventAt, Windows: w.early}
+		w.eachOpen(func(win *streamWindow) { st.Windows = append(st.Windows, win) })
+		return saveWindowState(w.StatePath, st)
+	}
+	n := len(w.early)
+	w.eachOpen(func(*streamWindow) { n++ })
+	w.windows, w.sessions, w.early, w.held = nil, nil, nil, 0
+	if w.EmitOnClose && n > 0 {
+		return fmt.Errorf("emit_on_close without window_state_path: %d open windows dropped", n)
+	}
 	return nil
 }
 
-func (w *WindowStreamStrategy) windowStart(ts int64) int64 {
-	return ts - (ts % w.WindowSize.Milliseconds())
+func (w *WindowStreamStrategy) watermark() int64 {
+	return w.maxEventAt - w.AllowedLateness.Milliseconds()
+}
+
+// closesAt is the event time at which the watermark closes win.
+func (w *WindowStreamStrategy) closesAt(win *streamWindow) int64 {
+	if win.VIN != "" {
+		return win.End + w.SessionGap.Milliseconds()
+	}
+	return win.End
+}
+
+func (w *WindowStreamStrategy) closed(win *streamWindow) bool {
+	return w.closesAt(win) <= w.watermark()
+}
+
+// eachOpen calls fn for every open window and session.
+func (w *WindowStreamStrategy) eachOpen(fn func(*streamWindow)) {
+	for _, win := range w.windows {
+		fn(win)
+	}
+	for _, wins := range w.sessions {
+		for _, win := range wins {
+			fn(win)
+		}
+	}
+}
+
+// open adds win to the open windows.
+func (w *WindowStreamStrategy) open(win *streamWindow) {
+	w.held += len(win.Devices)
+	if win.VIN == "" {
+		if w.windows == nil {
+			w.windows = make(map[int64]*streamWindow)
+		}
+		w.windows[win.Start] = win
+		return
+	}
+	if w.sessions == nil {
+		w.sessions = make(map[string][]*streamWindow)
+	}
+	w.sessions[win.VIN] = append(w.sessions[win.VIN], win)
+}
+
+// remove takes win out of the open windows.
+func (w *WindowStreamStrategy) remove(win *streamWindow) {
+	w.held -= len(win.Devices)
+	if win.VIN == "" {
+		delete(w.windows, win.Start)
+		return
+	}
+	wins := w.sessions[win.VIN]
+	for i, s := range wins {
+		if s == win {
+			wins = append(wins[:i], wins[i+1:]...)
+			break
+		}
+	}
+	if len(wins) == 0 {
+		delete(w.sessions, win.VIN)
+	} else {
+		w.sessions[win.VIN] = wins
+	}
+}
+
+// Observe assigns v to the windows of its ReceivedAt (arrival time if unset). Within a window the value with
+// the newest ReceivedAt wins.
+func (w *WindowStreamStrategy) Observe(vin, sensor string, v model.MetricValue) {
+	ts := v.ReceivedAt
+	if ts <= 0 {
+		ts = time.Now().UnixMilli()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var wins []*streamWindow
+	if w.Type == WindowSession {
+		if win := w.sessionFor(vin, ts); win != nil {
+			wins = append(wins, win)
+		}
+	} else {
+		wins = w.timeWindowsFor(ts)
+	}
+	if len(wins) == 0 {
+		return // late: every window of ts has closed
+	}
+	if ts > w.maxEventAt {
+		w.maxEventAt = ts
+	}
+	for _, win := range wins {
+		dev := win.Devices[vin]
+		if dev == nil {
+			dev = make(map[string]model.MetricValue)
+			win.Devices[vin] = dev
+			w.held++
+		}
+		if cur, ok := dev[sensor]; !ok || v.ReceivedAt >= cur.ReceivedAt {
+			dev[sensor] = v
+		}
+		if len(w.Aggregates) > 0 {
+			win.addSample(vin, sensor, v)
+		}
+	}
+	w.enforceLimit()
+}
+
+// timeWindowsFor returns the open tumbling or hopping windows containing ts, creating them as needed.
+func (w *WindowStreamStrategy) timeWindowsFor(ts int64) []*streamWindow {
+	size := w.WindowSize.Milliseconds()
+	hop := size
+	if w.Type == WindowHopping && w.WindowHop > 0 {
+		hop = w.WindowHop.Milliseconds()
+	}
+	var wins []*streamWindow
+	for start := ts - ts%hop; start+size > ts; start -= hop {
+		win := w.windows[start]
+		if win == nil {
+			win = &streamWindow{Start: start, End: start + size, Devices: make(map[string]map[string]model.MetricValue)}
+			if w.closed(win) {
+				continue
+			}
+			w.open(win)
+		} else if w.closed(win) {
+			continue
+		}
+		wins = append(wins, win)
+	}
+	return wins
+}
+
+// sessionFor returns the open session of vin that ts falls in or extends, merging the sessions it bridges,
+// or starts a new one. Returns nil if ts belongs to a session that has closed.
+func (w *WindowStreamStrategy) sessionFor(vin string, ts int64) *streamWindow {
+	gap := w.SessionGap.Milliseconds()
+	merged := &streamWindow{Start: ts, End: ts, VIN: vin, Devices: make(map[string]map[string]model.MetricValue)}
+	var bridged []*streamWindow
+	for _, win := range w.sessions[vin] {
+		if ts < win.Start-gap || ts > win.End+gap {
+			continue
+		}
+		if w.closed(win) {
+			return nil
+		}
+		bridged = append(bridged, win)
+	}
+	if len(bridged) == 1 && ts >= bridged[0].Start {
+		win := bridged[0]
+		win.End = max(win.End, ts)
+		return win
+	}
+	if len(bridged) == 0 && w.closed(merged) {
+		return nil
+	}
+	for _, win := range bridged {
+		merged.Start = min(merged.Start, win.Start)
+		merged.End = max(merged.End, win.End)
+		for sensor, m := range win.Devices[vin] {
+			if merged.Devices[vin] == nil {
+				merged.Devices[vin] = make(map[string]model.MetricValue)
+			}
+			if cur, ok := merged.Devices[vin][sensor]; !ok || m.ReceivedAt >= cur.ReceivedAt {
+				merged.Devices[vin][sensor] = m
+			}
+		}
+		for sensor, samples := range win.Samples[vin] {
+			for _, v := range samples {
+				merged.addSample(vin, sensor, v)
+			}
+		}
+		w.remove(win)
+	}
+	w.open(merged)
+	return merged
+}
+
+// enforceLimit closes early the windows closing first until MaxWindowDevices holds. They leave the open
+// windows, so a later value for them opens a new one.
+func (w *WindowStreamStrategy) enforceLimit() {
+	for w.MaxWindowDevices > 0 && w.held > w.MaxWindowDevices {
+		var oldest *streamWindow
+		w.eachOpen(func(win *streamWindow) {
+			if oldest == nil || w.closesAt(win) < w.closesAt(oldest) {
+				oldest = win
+			}
+		})
+		if oldest == nil {
+			return
+		}
+		w.remove(oldest)
+		oldest.Early = true
+		w.early = append(w.early, oldest)
+	}
 }
 
+// OnFlush emits every closed window, oldest first: one message per device (model.Payload, or
+// model.WindowPayload with Aggregates) with ProducedAt = window end and meta window_start and window_end
+// (unix ms).
 func (w *WindowStreamStrategy) OnFlush(
 	ctx context.Context,
 	state FlushState,
 ) (service.MessageBatch, error) {
-	now := time.Now().UnixMilli()
-	currentWindow := w.windowStart(now)
-
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// merge snapshot into current window
-	win := w.windows[currentWindow]
-	if win == nil {
-		win = make(map[string]model.MetricValue)
-		w.windows[currentWindow] = win
-	}
-	for vin, metrics := range state {
-		win[vin] = model.MetricValue{
-			Value:      metrics,
-			ReceivedAt: now,
+	closed := w.early
+	w.early = nil
+	w.eachOpen(func(win *streamWindow) {
+		if w.closed(win) {
+			closed = append(closed, win)
+		}
+	})
+	for _, win := range closed {
+		if !win.Early {
+			w.remove(win)
 		}
 	}
+	sort.SliceStable(closed, func(i, j int) bool {
+		if closed[i].End != closed[j].End {
+			return closed[i].End < closed[j].End
+		}
+		return closed[i].VIN < closed[j].VIN
+	})
 
 	var batch service.MessageBatch
-	for ws, data := range w.windows {
-		if ws+w.WindowSize.Milliseconds()+w.AllowedLateness.Milliseconds() <= now {
-			for vin, metric := range data {
-				payload := model.Payload{
+	for _, win := range closed {
+		for _, vin := range sortedKeys(win.Devices) {
+			metrics := win.Devices[vin]
+			msg := service.NewMessage(nil)
+			if len(w.Aggregates) > 0 {
+				msg.SetStructured(w.aggregatePayload(win, vin))
+			} else {
+				msg.SetStructured(model.Payload{
 					NumOfData:  1,
-					Data:      model.Data{ID: vin, Metrics: metric.Value.(map[string]model.MetricValue)},
-					ProducedAt: ws + int64(w.WindowSize.Milliseconds()),
-				}
-				msg := service.NewMessage(nil)
-				msg.SetStructured(payload)
-				msg.MetaSet("kafka_key", vin)
-				msg.MetaSet("window_start", fmt.Sprintf("%d", ws))
-				batch = append(batch, msg)
+					Data:       model.Data{ID: vin, Metrics: metrics},
+					ProducedAt: win.End,
+				})
+			}
+			msg.MetaSet("kafka_key", vin)
+			msg.MetaSet("window_start", strconv.FormatInt(win.Start, 10))
+			msg.MetaSet("window_end", strconv.FormatInt(win.End, 10))
+			if win.Early {
+				msg.MetaSet("window_closed_early", "true")
 			}
-			delete(w.windows, ws)
+			batch = append(batch, msg)
 		}
 	}
 	return batch, nil
 }
+
+func (w *WindowStreamStrategy) aggregatePayload(win *streamWindow, vin string) model.WindowPayload {
+	sensors := make(map[string]model.SensorAggregate, len(win.Samples[vin]))
+	for sensor, samples := range win.Samples[vin] {
+		if len(samples) > 0 {
+			sensors[sensor] = aggregateSamples(w.Aggregates[sensor], samples)
+		}
+	}
+	return model.WindowPayload{
+		NumOfData:   1,
+		Data:        model.WindowData{ID: vin, Sensors: sensors},
+		WindowStart: win.Start,
+		WindowEnd:   win.End,
+		ProducedAt:  win.End,
+	}
+}
+
+// Restore loads the windows written by Close to StatePath, if any, then removes the file: the windows now
+// live in memory until the next Close writes them again, so a crash before that does not restore (and
+// emit) them a second time. Call it before the first Observe.
+func (w *WindowStreamStrategy) Restore() error {
+	st, err := loadWindowState(w.StatePath)
+	if err != nil || st == nil {
+		return err
+	}
+	if err := snapshot.Remove(w.StatePath); err != nil {
+		return fmt.Errorf("remove restored window state: %w", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, win := range st.Windows {
+		if win.Devices == nil {
+			continue
+		}
+		if win.Early {
+			w.early = append(w.early, win)
+		} else {
+			w.open(win)
+		}
+	}
+	w.maxEventAt = max(w.maxEventAt, st.MaxEventAt)
+	return nil
+}
+
+func init() {
+	RegisterStrategy(StrategySpec{
+		Name: StrategyWindowStream,
+		Fields: func() []*service.ConfigField {
+			return []*service.ConfigField{
+				service.NewStringEnumField("window_type", WindowTypes...).Description("tumbling = fixed windows of window_size; hopping = windows of window_size starting every window_hop (sliding when the hop is small); session = per VIN, closed after session_gap without values").Default(WindowTumbling),
+				service.NewStringField("window_size").Description("Tumbling/hopping: event-time window size (e.g. 2m); values are assigned by received_at").Default("2m"),
+				service.NewStringField("window_hop").Description("Hopping: interval between window starts (e.g. 1m, at most window_size); empty = window_size").Default(""),
+				service.NewStringField("session_gap").Description("Session: inactivity (in received_at) that ends a VIN's session (e.g. 5m)").Default("5m"),
+				service.NewStringMapField("window_aggregates").Description("Emit per-sensor aggregates of each window (model.WindowPayload) instead of last values. Keys are sensor names or resource IDs (of resource_matrix_path), values numeric (count/min/max/mean/first/last) or categorical (count/first/last/changes); resource matrix entries may also set window_aggregate. Other sensors get count/first/last").Default(map[string]any{}),
+				service.NewIntField("max_window_devices").Description("Max device entries held across open windows; above it the window closing first is emitted early (meta window_closed_early=true). 0 = unlimited").Default(0),
+				service.NewStringField("allowed_lateness").Description("How far behind the newest received_at a value may arrive and still join its window; a window is emitted once its end is older than newest received_at minus this").Default("10s"),
+				service.NewBoolField("emit_on_close").Description("On shutdown write the windows still open to window_state_path, to restore them on startup and emit them once they close (nothing is emitted on shutdown); false = drop them").Default(true),
+				service.NewStringField("window_state_path").Description("Local file where open windows are written on shutdown and restored on startup (required with emit_on_close)").Default(DefaultWindowStatePath),
+			}
+		},
+		Build: buildWindowStream,
+	})
+}
+
+func buildWindowStream(conf *service.ParsedConfig, env StrategyEnv) (FlushStrategy, error) {
+	windowType, _ := conf.FieldString("window_type")
+	windowSizeStr, _ := conf.FieldString("window_size")
+	windowHopStr, _ := conf.FieldString("window_hop")
+	sessionGapStr, _ := conf.FieldString("session_gap")
+	windowAggregates, _ := conf.FieldStringMap("window_aggregates")
+	maxWindowDevices, _ := conf.FieldInt("max_window_devices")
+	allowedLatenessStr, _ := conf.FieldString("allowed_lateness")
+	emitOnClose, _ := conf.FieldBool("emit_on_close")
+	statePath, _ := conf.FieldString("window_state_path")
+
+	var err error
+	w := NewWindowStreamStrategy()
+	w.Type = windowType
+	if w.WindowSize, err = time.ParseDuration(windowSizeStr); err != nil {
+		return nil, fmt.Errorf("invalid window_size %q", windowSizeStr)
+	}
+	if windowHopStr != "" {
+		if w.WindowHop, err = time.ParseDuration(windowHopStr); err != nil {
+			return nil, fmt.Errorf("invalid window_hop %q", windowHopStr)
+		}
+	}
+	if w.SessionGap, err = time.ParseDuration(sessionGapStr); err != nil {
+		return nil, fmt.Errorf("invalid session_gap %q", sessionGapStr)
+	}
+	if w.AllowedLateness, err = time.ParseDuration(allowedLatenessStr); err != nil || w.AllowedLateness < 0 {
+		return nil, fmt.Errorf("invalid allowed_lateness %q", allowedLatenessStr)
+	}
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	w.MaxWindowDevices = max(maxWindowDevices, 0)
+	if len(windowAggregates) > 0 || env.ResourceMatrix != nil {
+		if w.Aggregates, err = AggregateOverrides(env.ResourceMatrix, windowAggregates); err != nil {
+			return nil, fmt.Errorf("window_aggregates: %w", err)
+		}
+	}
+	if emitOnClose && statePath == "" {
+		return nil, fmt.Errorf("emit_on_close requires window_state_path (nothing is emitted on shutdown); set emit_on_close: false to drop open windows")
+	}
+	w.EmitOnClose = emitOnClose
+	if emitOnClose {
+		w.StatePath = statePath // without emit_on_close a file left there would be restored on every start
+	}
+	if err := w.Restore(); err != nil {
+		return nil, fmt.Errorf("window_state_path: %w", err)
+	}
+	return w, nil
+}
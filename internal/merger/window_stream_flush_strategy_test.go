@@ -0,0 +1,315 @@
+package merger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"bethos/internal/model"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func newTestWindowStrategy() *WindowStreamStrategy {
+	w := NewWindowStreamStrategy()
+	w.WindowSize = time.Minute
+	w.AllowedLateness = 10 * time.Second
+	return w
+}
+
+func TestWindowStreamStrategy_EventTimeWatermark(t *testing.T) {
+	ctx := context.Background()
+	w := newTestWindowStrategy()
+	const minute = int64(60_000)
+
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 10, ReceivedAt: 5_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 20, ReceivedAt: 50_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 30, ReceivedAt: minute + 5_000})
+
+	// Watermark = 65s - 10s = 55s: window [0, 60s) is still open.
+	batch, err := w.OnFlush(ctx, nil)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if len(batch) != 0 {
+		t.Fatalf("window closed before the watermark passed its end: %d messages", len(batch))
+	}
+
+	// Late but within allowed lateness: joins window [0, 60s), yet the window keeps its newest value.
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 15, ReceivedAt: 30_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 40, ReceivedAt: minute + 15_000})
+
+	batch, err = w.OnFlush(ctx, nil)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("got %d messages, want 1 (window [0, 60s))", len(batch))
+	}
+	if ws, _ := batch[0].MetaGet("window_start"); ws != "0" {
+		t.Errorf("window_start = %q, want 0", ws)
+	}
+	obj, _ := batch[0].AsStructured()
+	p := obj.(model.Payload)
+	if p.ProducedAt != minute || p.Data.Metrics["speed"].Value != 20 {
+		t.Errorf("got produced_at %d speed %v, want %d and 20", p.ProducedAt, p.Data.Metrics["speed"].Value, minute)
+	}
+
+	// Window [0, 60s) is closed: a value for it is dropped.
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 99, ReceivedAt: 59_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 50, ReceivedAt: 2*minute + 15_000})
+	batch, _ = w.OnFlush(ctx, nil)
+	if len(batch) != 1 {
+		t.Fatalf("got %d messages, want 1 (window [60s, 120s))", len(batch))
+	}
+	if ws, _ := batch[0].MetaGet("window_start"); ws != "60000" {
+		t.Errorf("window_start = %q, want 60000 (late value must not reopen window 0)", ws)
+	}
+}
+
+func TestWindowStreamStrategy_CloseWithoutStatePathDrops(t *testing.T) {
+	ctx := context.Background()
+	w := newTestWindowStrategy()
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 10, ReceivedAt: 5_000})
+
+	// Nothing is emitted on shutdown: without a state path the open window is lost, and Close says so.
+	if err := w.Close(ctx); err == nil {
+		t.Fatal("Close with emit_on_close and no window_state_path: want an error")
+	}
+	if batch, _ := w.OnFlush(ctx, nil); len(batch) != 0 {
+		t.Fatalf("got %d messages after Close, want none", len(batch))
+	}
+
+	if _, err := newStrategyFromYAML(t, "strategy: window_stream\nwindow_stream:\n  window_state_path: \"\"\n", StrategyEnv{}); err == nil {
+		t.Error("emit_on_close with an empty window_state_path: want a config error")
+	}
+	if _, err := newStrategyFromYAML(t, "strategy: window_stream\nwindow_stream:\n  emit_on_close: false\n  window_state_path: \"\"\n", StrategyEnv{}); err != nil {
+		t.Errorf("emit_on_close false: %v", err)
+	}
+}
+
+func TestWindowStreamStrategy_CloseWithoutEmitDrops(t *testing.T) {
+	ctx := context.Background()
+	w := newTestWindowStrategy()
+	w.EmitOnClose = false
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 10, ReceivedAt: 5_000})
+
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if batch, _ := w.OnFlush(ctx, nil); len(batch) != 0 {
+		t.Fatalf("got %d messages, want open windows dropped", len(batch))
+	}
+}
+
+func TestWindowStreamStrategy_PersistAndRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "windows.json")
+
+	w1 := newTestWindowStrategy()
+	w1.StatePath = path
+	w1.Observe("VIN1", "speed", model.MetricValue{Value: 10, ReceivedAt: 5_000})
+	w1.Observe("VIN1", "speed", model.MetricValue{Value: 20, ReceivedAt: 65_000})
+	if err := w1.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	w2 := newTestWindowStrategy()
+	w2.StatePath = path
+	if err := w2.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file after Restore: %v, want removed (a crash must not restore the windows twice)", err)
+	}
+	// The restored watermark still rejects values of closed windows and closes window 0 on the next value.
+	w2.Observe("VIN2", "speed", model.MetricValue{Value: 30, ReceivedAt: 75_000})
+	batch, _ := w2.OnFlush(ctx, nil)
+	if len(batch) != 1 {
+		t.Fatalf("got %d messages, want restored window [0, 60s)", len(batch))
+	}
+	obj, _ := batch[0].AsStructured()
+	if p := obj.(model.Payload); p.Data.ID != "VIN1" || p.Data.Metrics["speed"].Value.(float64) != 10 {
+		t.Errorf("restored window = %+v, want VIN1 speed 10", p.Data)
+	}
+}
+
+func TestWindowStreamStrategy_RestoreMissingFile(t *testing.T) {
+	w := newTestWindowStrategy()
+	w.StatePath = filepath.Join(t.TempDir(), "none.json")
+	if err := w.Restore(); err != nil {
+		t.Fatalf("Restore of a missing file: %v", err)
+	}
+}
+
+// windowsOf returns "start-end" of each message of batch, in order.
+func windowsOf(batch service.MessageBatch) []string {
+	var out []string
+	for _, msg := range batch {
+		start, _ := msg.MetaGet("window_start")
+		end, _ := msg.MetaGet("window_end")
+		out = append(out, start+"-"+end)
+	}
+	return out
+}
+
+func TestWindowStreamStrategy_Hopping(t *testing.T) {
+	w := newTestWindowStrategy()
+	w.Type = WindowHopping
+	w.WindowSize = 5 * time.Minute
+	w.WindowHop = time.Minute
+	w.AllowedLateness = 0
+
+	// 4m30s falls in the 5 windows starting at 0m, 1m, 2m, 3m and 4m.
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 10, ReceivedAt: 270_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 20, ReceivedAt: 420_000}) // watermark 7m
+
+	batch, err := w.OnFlush(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	want := []string{"0-300000", "60000-360000", "120000-420000"}
+	if got := windowsOf(batch); !reflect.DeepEqual(got, want) {
+		t.Errorf("closed windows = %v, want %v", got, want)
+	}
+}
+
+func TestWindowStreamStrategy_Session(t *testing.T) {
+	ctx := context.Background()
+	w := newTestWindowStrategy()
+	w.Type = WindowSession
+	w.SessionGap = 90 * time.Second
+	w.AllowedLateness = 100 * time.Second
+
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 1, ReceivedAt: 1_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 2, ReceivedAt: 50_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 3, ReceivedAt: 200_000}) // gap > 90s: new session
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 4, ReceivedAt: 130_000}) // bridges both sessions
+	w.Observe("VIN2", "speed", model.MetricValue{Value: 5, ReceivedAt: 400_000}) // watermark 300s
+
+	batch, err := w.OnFlush(ctx, nil)
+	if err != nil {
+		t.Fatalf("OnFlush: %v", err)
+	}
+	if got, want := windowsOf(batch), []string{"1000-200000"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("closed sessions = %v, want %v (merged)", got, want)
+	}
+	obj, _ := batch[0].AsStructured()
+	if p := obj.(model.Payload); p.Data.ID != "VIN1" || p.Data.Metrics["speed"].Value != 3 || p.ProducedAt != 200_000 {
+		t.Errorf("session = %+v produced_at %d, want VIN1 speed 3 at 200000", p.Data, p.ProducedAt)
+	}
+
+	// VIN1's session has closed: a value inside it is dropped rather than reopening it.
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 6, ReceivedAt: 190_000})
+	if batch, _ := w.OnFlush(ctx, nil); len(batch) != 0 {
+		t.Errorf("got %v, want nothing (VIN2's session still open)", windowsOf(batch))
+	}
+}
+
+func TestWindowStreamStrategy_MaxWindowDevicesClosesEarly(t *testing.T) {
+	w := newTestWindowStrategy()
+	w.MaxWindowDevices = 2
+
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 1, ReceivedAt: 5_000})
+	w.Observe("VIN2", "speed", model.MetricValue{Value: 1, ReceivedAt: 65_000})
+	w.Observe("VIN3", "speed", model.MetricValue{Value: 1, ReceivedAt: 66_000}) // 3 entries: window 0 closes early
+
+	batch, _ := w.OnFlush(context.Background(), nil)
+	if len(batch) != 1 {
+		t.Fatalf("got %d messages, want window [0, 60s) closed early", len(batch))
+	}
+	if early, _ := batch[0].MetaGet("window_closed_early"); early != "true" {
+		t.Errorf("window_closed_early = %q, want true", early)
+	}
+	// Once emitted, a later value of window 0 opens it again; it is emitted once more when it closes.
+	w.Observe("VIN4", "speed", model.MetricValue{Value: 1, ReceivedAt: 6_000})
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 1, ReceivedAt: 200_000})
+	batch, _ = w.OnFlush(context.Background(), nil)
+	if got, want := windowsOf(batch), []string{"0-60000", "60000-120000", "60000-120000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("closed windows = %v, want %v", got, want)
+	}
+}
+
+func TestWindowStreamStrategy_EarlyClosedWindowReopensBeforeFlush(t *testing.T) {
+	ctx := context.Background()
+	w := newTestWindowStrategy()
+	w.MaxWindowDevices = 2
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 1, ReceivedAt: 5_000})
+	w.Observe("VIN2", "speed", model.MetricValue{Value: 1, ReceivedAt: 6_000})
+	w.Observe("VIN3", "speed", model.MetricValue{Value: 1, ReceivedAt: 65_000}) // window 0 closes early
+	w.Observe("VIN1", "speed", model.MetricValue{Value: 2, ReceivedAt: 7_000})  // not flushed yet: reopens it
+
+	batch, _ := w.OnFlush(ctx, nil)
+	if got, want := windowsOf(batch), []string{"0-60000", "0-60000"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("closed windows = %v, want %v (the early one only)", got, want)
+	}
+	w.Observe("VIN2", "speed", model.MetricValue{Value: 1, ReceivedAt: 200_000})
+	batch, _ = w.OnFlush(ctx, nil)
+	var got []string
+	for _, msg := range batch {
+		obj, _ := msg.AsStructured()
+		p := obj.(model.Payload)
+		got = append(got, fmt.Sprintf("%s@%d=%v", p.Data.ID, p.ProducedAt, p.Data.Metrics["speed"].Value))
+	}
+	if want := []string{"VIN1@60000=2", "VIN3@120000=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v (reopened window 0 holds the value observed after the early close)", got, want)
+	}
+
+	// Sessions: the next value of the VIN starts a new session.
+	s := newTestWindowStrategy()
+	s.Type = WindowSession
+	s.SessionGap = time.Minute
+	s.MaxWindowDevices = 1
+	s.Observe("VIN1", "speed", model.MetricValue{Value: 1, ReceivedAt: 1_000})
+	s.Observe("VIN2", "speed", model.MetricValue{Value: 1, ReceivedAt: 2_000}) // VIN1's session closes early
+	s.Observe("VIN1", "speed", model.MetricValue{Value: 2, ReceivedAt: 3_000}) // VIN2's closes early
+	batch, _ = s.OnFlush(ctx, nil)
+	if got, want := windowsOf(batch), []string{"1000-1000", "2000-2000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("closed sessions = %v, want %v", got, want)
+	}
+	if n := len(s.sessions["VIN1"]); n != 1 {
+		t.Errorf("open sessions of VIN1 = %d, want 1 (reopened)", n)
+	}
+}
+
+func TestWindowStreamStrategy_RestoreUnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "windows.json")
+	v1 := `{"version":1,"max_event_at":65000,"windows":{"0":{"VIN1":{"speed":{"value":10,"received_at":5000}}}}}`
+	if err := os.WriteFile(path, []byte(v1), 0640); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWindowStrategy()
+	w.StatePath = path
+	if err := w.Restore(); err == nil || !strings.Contains(err.Error(), "version 1 not supported") {
+		t.Fatalf("Restore of a v1 file = %v, want an unsupported version error", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("state file after a failed Restore: %v, want it kept", err)
+	}
+}
+
+func TestWindowStreamStrategy_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		w    *WindowStreamStrategy
+		ok   bool
+	}{
+		{"tumbling", &WindowStreamStrategy{Type: WindowTumbling, WindowSize: time.Minute}, true},
+		{"zero size", &WindowStreamStrategy{Type: WindowTumbling}, false},
+		{"hopping", &WindowStreamStrategy{Type: WindowHopping, WindowSize: 5 * time.Minute, WindowHop: time.Minute}, true},
+		{"hop over size", &WindowStreamStrategy{Type: WindowHopping, WindowSize: time.Minute, WindowHop: 5 * time.Minute}, false},
+		{"session", &WindowStreamStrategy{Type: WindowSession, SessionGap: time.Minute}, true},
+		{"session without gap", &WindowStreamStrategy{Type: WindowSession}, false},
+		{"unknown", &WindowStreamStrategy{Type: "sliding", WindowSize: time.Minute}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.w.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package merger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"bethos/internal/snapshot"
+)
+
+// windowStateVersion is the only format written and read by saveWindowState and loadWindowState.
+const windowStateVersion = 2
+
+// windowState is the on-disk form of the windows still open when WindowStreamStrategy was closed.
+type windowState struct {
+	Version    int             `json:"version"`
+	MaxEventAt int64           `json:"max_event_at"`
+	Windows    []*streamWindow `json:"windows"`
+}
+
+// loadWindowState reads the file written by saveWindowState. Returns nil and nil error if it does not exist.
+func loadWindowState(path string) (*windowState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("window state invalid: %w", err)
+	}
+	if header.Version != windowStateVersion {
+		return nil, fmt.Errorf("window state version %d not supported (want %d)", header.Version, windowStateVersion)
+	}
+	var st windowState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("window state invalid: %w", err)
+	}
+	return &st, nil
+}
+
+// saveWindowState writes st to path with snapshot.WriteFile, so a crash leaves either the previous state
+// or the new one.
+func saveWindowState(path string, st windowState) error {
+	st.Version = windowStateVersion
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return snapshot.WriteFile(path, b)
+}
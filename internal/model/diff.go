@@ -0,0 +1,18 @@
+package model
+
+// DiffPayload is a diff strategy output message in the simple format: the sensors of one device added,
+// changed or removed since the previous message for it.
+type DiffPayload struct {
+	ID         string                 `json:"id"`
+	Added      map[string]MetricValue `json:"added,omitempty"`
+	Changed    map[string]MetricValue `json:"changed,omitempty"`
+	Removed    []string               `json:"removed,omitempty"`
+	ProducedAt int64                  `json:"produced_at"`
+}
+
+// PatchOp is one RFC 6902 JSON Patch operation (diff strategy, json_patch format) on a device's Payload.
+type PatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
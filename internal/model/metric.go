@@ -1,6 +1,7 @@
 package model
 
 type MetricValue struct {
-	Value      any   `json:"value"`
-	ReceivedAt int64 `json:"received_at"`
+	Value        any   `json:"value"`
+	ReceivedAt   int64 `json:"received_at"`
+	ReceivedAtNs int64 `json:"received_at_ns,omitempty"` // optional: breaks ties between equal received_at (ms)
 }
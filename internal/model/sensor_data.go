@@ -1,6 +1,12 @@
 package model
 
-import "encoding/json"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+)
 
 type Payload struct {
 	NumOfData  int   `json:"num_of_data"`
@@ -47,16 +53,118 @@ func (d *Data) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalJSON writes the canonical encoding of d: id first, then the sensors in key order, so the same
+// device always encodes to the same bytes. A sensor named id is dropped when ID is set.
 func (d Data) MarshalJSON() ([]byte, error) {
-	out := make(map[string]any, len(d.Metrics)+1)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
 
 	if d.ID != "" {
-		out["id"] = d.ID
+		buf.WriteString(`"id":`)
+		id, err := json.Marshal(d.ID)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(id)
+	}
+
+	keys := make([]string, 0, len(d.Metrics))
+	for k := range d.Metrics {
+		if k == "id" && d.ID != "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(d.Metrics[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(v)
 	}
 
-	for k, v := range d.Metrics {
-		out[k] = v
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// ContentHash returns the hex SHA-256 of the canonical encoding of the devices, in order (produced_at is not
+// part of it): equal state always hashes the same, whenever and by whichever instance it is produced.
+func ContentHash(data ...Data) (string, error) {
+	h := sha256.New()
+	for _, d := range data {
+		b, err := d.MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+		h.Write([]byte{'\n'})
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	return json.Marshal(out)
+// DecodePayloads decodes a message that holds a Payload, a PayloadBatch (data is an array of devices) or a
+// JSON array of Payloads, returning one Payload per device.
+func DecodePayloads(b []byte) ([]Payload, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		var ps []Payload
+		if err := json.Unmarshal(b, &ps); err != nil {
+			return nil, err
+		}
+		return ps, nil
+	}
+
+	var p struct {
+		NumOfData  int       `json:"num_of_data"`
+		Data       dataShape `json:"data"`
+		ProducedAt int64     `json:"produced_at"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if !p.Data.batch {
+		var d Data
+		if len(p.Data.list) > 0 {
+			d = p.Data.list[0]
+		}
+		return []Payload{{NumOfData: p.NumOfData, Data: d, ProducedAt: p.ProducedAt}}, nil
+	}
+	ps := make([]Payload, len(p.Data.list))
+	for i, d := range p.Data.list {
+		ps[i] = Payload{NumOfData: 1, Data: d, ProducedAt: p.ProducedAt}
+	}
+	return ps, nil
+}
+
+// dataShape is the data field of a Payload (one object) or a PayloadBatch (array), decoded in one pass.
+type dataShape struct {
+	list  []Data
+	batch bool
+}
+
+func (s *dataShape) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '[' {
+		s.batch = true
+		return json.Unmarshal(b, &s.list)
+	}
+	if string(b) == "null" {
+		return nil
+	}
+	var d Data
+	if err := json.Unmarshal(b, &d); err != nil {
+		return err
+	}
+	s.list = []Data{d}
+	return nil
 }
@@ -97,3 +97,104 @@ func TestData_MarshalJSON_Roundtrip(t *testing.T) {
 		t.Errorf("roundtrip Metrics mismatch")
 	}
 }
+
+func TestDecodePayloads_Shapes(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string // VINs in order
+	}{
+		{"payload", `{"num_of_data":1,"data":{"id":"VIN1","a":{"value":"1","received_at":1}},"produced_at":5}`, []string{"VIN1"}},
+		{"payload batch", `{"num_of_data":2,"data":[{"id":"VIN1","a":{"value":"1","received_at":1}},{"id":"VIN2"}],"produced_at":5}`, []string{"VIN1", "VIN2"}},
+		{"array", ` [{"data":{"id":"VIN1"}},{"data":{"id":"VIN2"}},{"data":{"id":"VIN3"}}]`, []string{"VIN1", "VIN2", "VIN3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := DecodePayloads([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("DecodePayloads: %v", err)
+			}
+			if len(ps) != len(tt.want) {
+				t.Fatalf("got %d payloads, want %d", len(ps), len(tt.want))
+			}
+			for i, vin := range tt.want {
+				if ps[i].Data.ID != vin {
+					t.Errorf("payload %d: ID = %q, want %q", i, ps[i].Data.ID, vin)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePayloads_BatchKeepsMetricsAndProducedAt(t *testing.T) {
+	raw := `{"num_of_data":2,"data":[{"id":"VIN1","a":{"value":"1","received_at":10}},{"id":"VIN2","b":{"value":"2","received_at":20}}],"produced_at":99}`
+	ps, err := DecodePayloads([]byte(raw))
+	if err != nil {
+		t.Fatalf("DecodePayloads: %v", err)
+	}
+	if ps[1].ProducedAt != 99 || ps[1].NumOfData != 1 {
+		t.Errorf("payload 1: produced_at=%d num_of_data=%d, want 99 and 1", ps[1].ProducedAt, ps[1].NumOfData)
+	}
+	if ps[1].Data.Metrics["b"].ReceivedAt != 20 {
+		t.Errorf("VIN2 b = %+v", ps[1].Data.Metrics["b"])
+	}
+}
+
+func TestDecodePayloads_Invalid(t *testing.T) {
+	for _, raw := range []string{`{invalid`, `[{"data":1}]`, `{"data":[1]}`} {
+		if _, err := DecodePayloads([]byte(raw)); err == nil {
+			t.Errorf("DecodePayloads(%s): expected error", raw)
+		}
+	}
+}
+
+func TestData_MarshalJSON_Canonical(t *testing.T) {
+	d := Data{ID: "VIN1", Metrics: map[string]MetricValue{
+		"speed":    {Value: 12.5, ReceivedAt: 2},
+		"a_sensor": {Value: "x", ReceivedAt: 1},
+		"Zeta":     {Value: true, ReceivedAt: 3, ReceivedAtNs: 7},
+	}}
+	want := `{"id":"VIN1","Zeta":{"value":true,"received_at":3,"received_at_ns":7},"a_sensor":{"value":"x","received_at":1},"speed":{"value":12.5,"received_at":2}}`
+	for i := 0; i < 20; i++ {
+		b, err := json.Marshal(d)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		if string(b) != want {
+			t.Fatalf("Marshal = %s\nwant      %s", b, want)
+		}
+	}
+
+	var back Data
+	if err := json.Unmarshal([]byte(want), &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if back.ID != "VIN1" || len(back.Metrics) != 3 {
+		t.Errorf("round trip = %+v", back)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	a := Data{ID: "VIN1", Metrics: map[string]MetricValue{"a": {Value: "1", ReceivedAt: 1}, "b": {Value: "2", ReceivedAt: 1}}}
+	same := Data{ID: "VIN1", Metrics: map[string]MetricValue{"b": {Value: "2", ReceivedAt: 1}, "a": {Value: "1", ReceivedAt: 1}}}
+	changed := Data{ID: "VIN1", Metrics: map[string]MetricValue{"a": {Value: "1", ReceivedAt: 1}, "b": {Value: "3", ReceivedAt: 1}}}
+
+	h1, err := ContentHash(a)
+	if err != nil {
+		t.Fatalf("ContentHash: %v", err)
+	}
+	if len(h1) != 64 {
+		t.Errorf("hash %q: want 64 hex chars", h1)
+	}
+	if h2, _ := ContentHash(same); h2 != h1 {
+		t.Errorf("same content: %s != %s", h2, h1)
+	}
+	if h3, _ := ContentHash(changed); h3 == h1 {
+		t.Error("changed value: same hash")
+	}
+	ab, _ := ContentHash(a, changed)
+	ba, _ := ContentHash(changed, a)
+	if ab == ba || ab == h1 {
+		t.Error("hash of several devices must depend on each device and their order")
+	}
+}
@@ -0,0 +1,29 @@
+package model
+
+// WindowPayload is a window_stream output message when sensor aggregates are configured: one device and
+// one window, with an aggregate of every value each sensor had in the window instead of its last value.
+type WindowPayload struct {
+	NumOfData   int        `json:"num_of_data"`
+	Data        WindowData `json:"data"`
+	WindowStart int64      `json:"window_start"`
+	WindowEnd   int64      `json:"window_end"`
+	ProducedAt  int64      `json:"produced_at"`
+}
+
+type WindowData struct {
+	ID      string                     `json:"id"`
+	Sensors map[string]SensorAggregate `json:"sensors"`
+}
+
+// SensorAggregate summarizes the values of one sensor in a window, ordered by received_at. Min, Max and Mean
+// are set for numeric sensors (over the values that parse as numbers), Changes for categorical ones (how many
+// times the value differs from the previous one).
+type SensorAggregate struct {
+	Count   int         `json:"count"`
+	First   MetricValue `json:"first"`
+	Last    MetricValue `json:"last"`
+	Min     *float64    `json:"min,omitempty"`
+	Max     *float64    `json:"max,omitempty"`
+	Mean    *float64    `json:"mean,omitempty"`
+	Changes *int        `json:"changes,omitempty"`
+}
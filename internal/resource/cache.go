@@ -6,10 +6,12 @@ import (
 )
 
 type Resource struct {
-	ResourceID   string `json:"resource_id"`
-	ResourceName string `json:"resource_name"`
-	Operation    string `json:"operation"`
-	State        string `json:"state"`
+	ResourceID      string `json:"resource_id"`
+	ResourceName    string `json:"resource_name"`
+	Operation       string `json:"operation"`
+	State           string `json:"state"`
+	MergePolicy     string `json:"merge_policy,omitempty"`     // optional per-sensor latest_merger policy (see merger.Policies)
+	WindowAggregate string `json:"window_aggregate,omitempty"` // optional per-sensor window_stream aggregate (see merger.Aggregates)
 }
 
 type Cache struct {
@@ -0,0 +1,152 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bethos/internal/model"
+)
+
+// Version is the format written by Save. Load keeps reading every older version it knows about,
+// so bump this (and add a case to decode) whenever File changes shape.
+const Version = 2
+
+// ErrCorrupt is returned (wrapped) by Load when the file cannot be decoded, e.g. truncated by a crash.
+// Unlike an unsupported version, the file holds nothing worth keeping the merger from starting: see
+// MoveAside.
+var ErrCorrupt = errors.New("snapshot corrupt")
+
+// Device is the persisted form of one merged device.
+type Device struct {
+	Metrics  map[string]model.MetricValue `json:"metrics"`
+	LastSeen int64                        `json:"last_seen"`
+	// Partition is the source Kafka partition (v2+); nil if unknown or written by v1.
+	Partition *int32 `json:"partition,omitempty"`
+}
+
+// File is the on-disk snapshot of the merger state.
+type File struct {
+	Version int               `json:"version"`
+	SavedAt int64             `json:"saved_at"`
+	Devices map[string]Device `json:"devices"`
+}
+
+// Load reads a snapshot written by Save.
+// If the file does not exist, returns nil and nil error (caller starts with empty state).
+func Load(path string) (*File, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decode(b)
+}
+
+func decode(b []byte) (*File, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	switch header.Version {
+	case 1, 2: // v2 only adds Device.Partition
+		var f File
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%w: v%d: %w", ErrCorrupt, header.Version, err)
+		}
+		if f.Devices == nil {
+			f.Devices = make(map[string]Device)
+		}
+		return &f, nil
+	default:
+		return nil, fmt.Errorf("snapshot version %d not supported (max %d)", header.Version, Version)
+	}
+}
+
+// Save writes f to path with the current Version.
+// Creates parent directories if needed. File is written with WriteFile, so a crash leaves either the
+// previous snapshot or the new one.
+func Save(path string, f *File) error {
+	if path == "" {
+		return nil
+	}
+	f.Version = Version
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, b)
+}
+
+// WriteFile writes b to path atomically (write to temp, fsync, rename, fsync the directory), creating
+// parent directories if needed.
+func WriteFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Remove deletes path and fsyncs its directory, so the removal survives a crash. A missing file is not
+// an error.
+func Remove(path string) error {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// MoveAside renames a snapshot Load reported as ErrCorrupt to <path>.corrupt (replacing an older one), so
+// it can be inspected while the merger starts empty. Returns the new path.
+func MoveAside(path string) (string, error) {
+	aside := path + ".corrupt"
+	if err := os.Rename(path, aside); err != nil {
+		return "", err
+	}
+	return aside, syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs dir so a rename in it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cErr := d.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
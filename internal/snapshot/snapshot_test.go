@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bethos/internal/model"
+)
+
+func TestSaveLoad_Roundtrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "merger.json")
+	in := &File{
+		SavedAt: 1770632664525,
+		Devices: map[string]Device{
+			"VIN1": {
+				Metrics:  map[string]model.MetricValue{"sensor_a": {Value: "541", ReceivedAt: 1770629822367}},
+				LastSeen: 1770632660000,
+			},
+		},
+	}
+	if err := Save(path, in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	out, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if out.Version != Version {
+		t.Errorf("Version = %d, want %d", out.Version, Version)
+	}
+	dev, ok := out.Devices["VIN1"]
+	if !ok {
+		t.Fatal("VIN1 missing after roundtrip")
+	}
+	if dev.LastSeen != 1770632660000 {
+		t.Errorf("LastSeen = %d", dev.LastSeen)
+	}
+	if dev.Metrics["sensor_a"].ReceivedAt != 1770629822367 || dev.Metrics["sensor_a"].Value != "541" {
+		t.Errorf("Metrics[sensor_a] = %+v", dev.Metrics["sensor_a"])
+	}
+}
+
+func TestLoad_Missing(t *testing.T) {
+	f, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || f != nil {
+		t.Errorf("Load(missing) = %v, %v; want nil, nil", f, err)
+	}
+}
+
+func TestLoad_V1Fixture(t *testing.T) {
+	// Snapshot as written by the first release; must stay readable after format upgrades.
+	raw := `{"version":1,"saved_at":5,"devices":{"VIN1":{"metrics":{"odometer":{"value":"12","received_at":3}},"last_seen":4}}}`
+	path := filepath.Join(t.TempDir(), "v1.json")
+	if err := os.WriteFile(path, []byte(raw), 0640); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if f.Devices["VIN1"].Metrics["odometer"].ReceivedAt != 3 {
+		t.Errorf("odometer not restored: %+v", f.Devices["VIN1"])
+	}
+	if f.Devices["VIN1"].Partition != nil {
+		t.Errorf("v1 device has partition %d, want nil", *f.Devices["VIN1"].Partition)
+	}
+}
+
+func TestSaveLoad_Partition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	p := int32(3)
+	in := &File{Devices: map[string]Device{"VIN1": {LastSeen: 1, Partition: &p}, "VIN2": {LastSeen: 1}}}
+	if err := Save(path, in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	out, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := out.Devices["VIN1"].Partition; got == nil || *got != 3 {
+		t.Errorf("VIN1 partition = %v, want 3", got)
+	}
+	if out.Devices["VIN2"].Partition != nil {
+		t.Error("VIN2 partition should stay unknown")
+	}
+}
+
+func TestLoad_UnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "future.json")
+	if err := os.WriteFile(path, []byte(`{"version":99,"devices":{}}`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v, want an unsupported version error (not ErrCorrupt: the file must be kept)", err)
+	}
+}
+
+func TestLoad_CorruptMovedAside(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "truncated.json")
+	if err := os.WriteFile(path, []byte(`{"version":2,"devices":{"VIN1":{"metr`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Load = %v, want ErrCorrupt", err)
+	}
+	aside, err := MoveAside(path)
+	if err != nil || aside != path+".corrupt" {
+		t.Fatalf("MoveAside = %q, %v", aside, err)
+	}
+	if f, err := Load(path); f != nil || err != nil {
+		t.Errorf("Load after MoveAside = %v, %v; want no snapshot", f, err)
+	}
+	if _, err := os.Stat(aside); err != nil {
+		t.Errorf("corrupt file not kept: %v", err)
+	}
+}
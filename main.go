@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bethos/internal/bootstrap"
+	"bethos/internal/codec"
 	"bethos/internal/input/influxdb"
+	"bethos/internal/input/statestore"
 	"bethos/internal/merger"
 	"bethos/internal/resource"
 	"bethos/processors"
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -114,34 +118,68 @@ func main() {
 		},
 	)
 
+	service.RegisterProcessor(
+		"telemetry_encode",
+		telemetryCodecSpec(append([]string{processors.RecordAuto}, codec.Records...), processors.RecordAuto).
+			Summary("Encodes Payload, PayloadBatch, Data or CSVRow messages (JSON or structured) as Avro or Protobuf, with a schema derived from the resource matrix; sets meta encoding and schema_id."),
+		func(conf *service.ParsedConfig, _ *service.Resources) (service.Processor, error) {
+			c, record, err := newTelemetryCodec(conf)
+			if err != nil {
+				return nil, fmt.Errorf("telemetry_encode: %w", err)
+			}
+			return &processors.TelemetryEncoder{Codec: c, Record: record}, nil
+		},
+	)
+
+	service.RegisterProcessor(
+		"telemetry_decode",
+		telemetryCodecSpec(codec.Records, codec.RecordPayload).
+			Summary("Decodes messages encoded by telemetry_encode or a latest_merger strategy with encoding set back to JSON."),
+		func(conf *service.ParsedConfig, _ *service.Resources) (service.Processor, error) {
+			c, record, err := newTelemetryCodec(conf)
+			if err != nil {
+				return nil, fmt.Errorf("telemetry_decode: %w", err)
+			}
+			return &processors.TelemetryDecoder{Codec: c, Record: record}, nil
+		},
+	)
+
 	service.RegisterProcessor(
 		"latest_merger",
-		service.NewConfigSpec().
-			Field(service.NewStringField("strategy").Description("inline = emit batch to output; state_store = write to cache, separate publisher reads and emits").Default("inline")).
-			Field(service.NewStringField("cache").Description("Cache resource name for state_store strategy").Default("")).
-			Field(service.NewStringField("cache_index_key").Description("Cache key for list of vincodes (state_store)").Default("")).
-			Field(service.NewStringField("cache_prefix").Description("Cache key prefix per device (state_store)").Default("")).
-			Field(service.NewIntField("batch_size").Description("For log_compacted: devices per message (1 = one message per device; >1 = batched to reduce network I/O). Default 1").Default(1)),
+		latestMergerSpec(),
 		func(conf *service.ParsedConfig, res *service.Resources) (service.Processor, error) {
-			strategyName, _ := conf.FieldString("strategy")
-			cacheName, _ := conf.FieldString("cache")
-			batchSize, _ := conf.FieldInt("batch_size")
+			m, err := newLatestMerger(conf, res)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		},
+	)
+
+	service.RegisterBatchProcessor(
+		"latest_merger_batch",
+		latestMergerSpec().
+			Summary("Batch variant of latest_merger (same config): decodes each batch in parallel in one JSON pass and merges it with one lock per state shard."),
+		func(conf *service.ParsedConfig, res *service.Resources) (service.BatchProcessor, error) {
+			m, err := newLatestMerger(conf, res)
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		},
+	)
 
-			var strat merger.FlushStrategy
-			switch strategyName {
-			case merger.StrategyStateStore:
-				strat = &merger.StateStoreFlushStrategy{
-					CacheName: cacheName,
-					Resources: res,
-				}
-			case merger.StrategyLogCompacted:
-				strat = &merger.LogCompactedFlushStrategy{BatchSize: batchSize}
-			case merger.StrategyWindowStream:
-				strat = merger.NewWindowStreamStrategy()
-			default:
-				strat = merger.InlineFlushStrategy{}
-			}
-			return &processors.LatestMerger{Strategy: strat}, nil
+	service.RegisterBatchBuffer(
+		"latest_merger_ack",
+		service.NewConfigSpec().
+			Summary("At-least-once buffer for latest_merger: holds input acks until a flush that includes the merged data has been delivered by the output.").
+			Field(service.NewIntField("max_unacked").Description("Max data messages held unacked; when reached, a flush is forced and input is paused until it is delivered. 0 = unbounded").Default(10000)),
+		func(conf *service.ParsedConfig, _ *service.Resources) (service.BatchBuffer, error) {
+			maxUnacked, _ := conf.FieldInt("max_unacked")
+			if maxUnacked < 0 {
+				maxUnacked = 0
+			}
+			return &processors.FlushAckBuffer{MaxUnacked: maxUnacked}, nil
 		},
 	)
 
@@ -224,6 +262,40 @@ func main() {
 		},
 	)
 
+	service.RegisterBatchInput(
+		"latest_state_publisher",
+		service.NewConfigSpec().
+			Summary("Reads the devices written by latest_merger strategy state_store and emits each one's payload (meta vincode) on an interval.").
+			Field(service.NewStringField("cache").Description("Cache resource written by latest_merger (same as its cache)")).
+			Field(service.NewStringField("cache_index_key").Description("Cache key of the vincode index (same as latest_merger's)").Default(merger.DefaultStateIndexKey)).
+			Field(service.NewStringField("cache_prefix").Description("Cache key prefix per device (same as latest_merger's)").Default(merger.DefaultStatePrefix)).
+			Field(service.NewStringField("interval").Description("How often the whole state is read and emitted (e.g. 2m)").Default("30s")).
+			Field(service.NewIntField("batch_size").Description("Max messages per batch").Default(100)),
+		func(conf *service.ParsedConfig, res *service.Resources) (service.BatchInput, error) {
+			cacheName, _ := conf.FieldString("cache")
+			indexKey, _ := conf.FieldString("cache_index_key")
+			prefix, _ := conf.FieldString("cache_prefix")
+			intervalStr, _ := conf.FieldString("interval")
+			batchSize, _ := conf.FieldInt("batch_size")
+
+			interval, err := time.ParseDuration(intervalStr)
+			if err != nil {
+				return nil, fmt.Errorf("latest_state_publisher: invalid interval %q", intervalStr)
+			}
+			inp, err := statestore.New(res, statestore.Config{
+				CacheName: cacheName,
+				IndexKey:  indexKey,
+				Prefix:    prefix,
+				Interval:  interval,
+				BatchSize: batchSize,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return service.AutoRetryNacksBatched(inp), nil
+		},
+	)
+
 	configPath := os.Getenv("BENTO_CONFIG")
 	if configPath == "" {
 		configPath = "./config/pipeline.yaml"
@@ -235,3 +307,183 @@ func main() {
 	os.Args = []string{"bento", "--config", configPath}
 	service.RunCLI(context.Background())
 }
+
+// telemetryCodecSpec is the config of telemetry_encode and telemetry_decode.
+func telemetryCodecSpec(records []string, defaultRecord string) *service.ConfigSpec {
+	return service.NewConfigSpec().
+		Field(service.NewStringEnumField("encoding", codec.Encodings...).Description("avro or protobuf (json passes the model through)").Default(codec.EncodingAvro)).
+		Field(service.NewStringEnumField("schema", records...).Description("Record of the messages; auto = detect it from the JSON message. With schema_registry_url, decoding uses the record of the message's schema id").Default(defaultRecord)).
+		Field(service.NewStringField("resource_matrix_path").Description("resource_matrix.json whose sensors (resource_name, in matrix order) become fields of Data; others go in its extra map. Empty = extra map only").Default("")).
+		Field(service.NewStringField("schema_registry_url").Description("Optional schema registry (Confluent API): schemas are registered under their record name (e.g. bethos.Payload) and messages framed with the schema id").Default(""))
+}
+
+func newTelemetryCodec(conf *service.ParsedConfig) (*codec.Codec, string, error) {
+	encoding, _ := conf.FieldString("encoding")
+	record, _ := conf.FieldString("schema")
+	resourceMatrixPath, _ := conf.FieldString("resource_matrix_path")
+	registryURL, _ := conf.FieldString("schema_registry_url")
+
+	var sensors []string
+	if resourceMatrixPath != "" {
+		resources, err := resource.LoadResourceList(resourceMatrixPath)
+		if err != nil {
+			return nil, "", err
+		}
+		sensors = codec.Sensors(resources)
+	}
+	var reg *codec.Registry
+	if registryURL != "" {
+		reg = codec.NewRegistry(registryURL)
+	}
+	c, err := codec.New(encoding, sensors, reg)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, record, nil
+}
+
+// latestMergerSpec is the config of latest_merger, shared by latest_merger_batch.
+func latestMergerSpec() *service.ConfigSpec {
+	return service.NewConfigSpec().
+		Fields(merger.StrategyConfigFields()...).
+		Field(service.NewStringEnumField("flush_mode", merger.FlushModeFull, merger.FlushModeChangedDevices, merger.FlushModeChangedSensors).Description("full = every device on each flush; changed_devices = only devices updated since the last successful flush (all sensors); changed_sensors = only the updated sensors of those devices (inline only); window_stream ignores it").Default(merger.FlushModeFull)).
+		Field(service.NewBoolField("skip_unchanged").Description("Leave out of a flush the devices whose content (meta content_hash: SHA-256 of the canonical device encoding) is unchanged since their last successful flush; a full trigger still emits them. The first flush after a restart emits every device").Default(false)).
+		Field(service.NewStringEnumField("merge_policy", merger.Policies...).Description("How an incoming metric replaces the stored one: latest = newest received_at (ties: received_at_ns, then arrival); first_write; max; min; monotonic = latest but never lower (e.g. odometer)").Default(merger.PolicyLatest)).
+		Field(service.NewStringField("resource_matrix_path").Description("Optional: resource_matrix.json whose entries may set merge_policy per sensor (resource_name), overriding merge_policy").Default("")).
+		Field(service.NewBoolField("route_rejected").Description("Emit stale/duplicate sensor updates as messages with meta latest_merger_outcome (stale|duplicate), lateness_ms, rejected_vincode, sensor (no vincode, so they never get the key of the device records); route them with a switch output on latest_merger_outcome (e.g. to a late-data topic)").Default(false)).
+		Field(service.NewStringField("http_address").Description("Optional: address (e.g. 0.0.0.0:4196) for a read-only API: GET /latest/{vin}, GET /latest?sensor=a,b, GET /stats. Empty = disabled").Default("")).
+		Field(service.NewStringField("snapshot_path").Description("Optional: local file to persist merged state (metrics + last_seen); restored on startup. Empty = disabled").Default("")).
+		Field(service.NewStringField("snapshot_interval").Description("How often to write the snapshot (e.g. 30s); 0 = after every flush").Default("0")).
+		Field(service.NewStringField("bootstrap_source").Description("Optional warm start before consuming: kafka = read latest-per-VIN topic, file = NDJSON dump of payloads. Empty = disabled").Default("")).
+		Field(service.NewStringListField("bootstrap_seed_brokers").Description("Brokers for bootstrap_source kafka").Default([]string{})).
+		Field(service.NewStringField("bootstrap_topic").Description("Compacted topic for bootstrap_source kafka (key = vincode, value = payload)").Default("")).
+		Field(service.NewStringField("bootstrap_path").Description("Dump file for bootstrap_source file (one payload JSON per line)").Default("")).
+		Field(service.NewStringField("bootstrap_timeout").Description("Max time for the bootstrap phase (e.g. 60s); 0 = no limit").Default("60s")).
+		Field(service.NewStringEnumField("bootstrap_on_error", processors.BootstrapOnErrorHold, processors.BootstrapOnErrorContinue).Description("When the bootstrap fails (e.g. timeout): hold = no flush emits (flush_error) and the bootstrap is retried on flush triggers until it succeeds (with partition_aware, a failed partition rebuild keeps that partition held and is retried the same way); continue = flush whatever state was merged").Default(processors.BootstrapOnErrorHold)).
+		Field(service.NewStringField("bootstrap_retry_interval").Description("With bootstrap_on_error hold: min time between bootstrap (or partition rebuild) retries, so a nacked trigger coming straight back does not hammer the source (e.g. 10s); 0 = on every flush trigger").Default("10s")).
+		Field(service.NewStringField("device_ttl").Description("Devices not updated for this long are evicted on flush (e.g. 10m)").Default("10m")).
+		Field(service.NewStringEnumField("ttl_basis", processors.TTLBasisArrival, processors.TTLBasisReceivedAt).Description("arrival = age from last merged message (wall clock); received_at = age from newest metric received_at in the device").Default(processors.TTLBasisArrival)).
+		Field(service.NewIntField("shards").Description("Number of state shards (by VIN hash), each with its own lock, so pipeline threads merging different devices do not contend").Default(16)).
+		Field(service.NewIntField("max_devices").Description("Max devices kept in state; least recently seen is evicted when exceeded. 0 = unlimited").Default(0)).
+		Field(service.NewBoolField("partition_aware").Description("For replicas sharing a consumer group: track each VIN's kafka_partition, drop devices of partitions no longer consumed and rebuild newly assigned ones from bootstrap_source kafka (which must be keyed by vincode with the same partition count)").Default(false)).
+		Field(service.NewStringField("partition_idle_timeout").Description("With partition_aware: a partition without messages for this long is treated as revoked (e.g. 5m). Only for topics where every partition always has traffic, well above the flush interval: a quiet partition is otherwise dropped while still owned. 0 = never").Default("0"))
+}
+
+func newLatestMerger(conf *service.ParsedConfig, res *service.Resources) (*processors.LatestMerger, error) {
+	flushMode, _ := conf.FieldString("flush_mode")
+	skipUnchanged, _ := conf.FieldBool("skip_unchanged")
+	mergePolicy, _ := conf.FieldString("merge_policy")
+	resourceMatrixPath, _ := conf.FieldString("resource_matrix_path")
+	routeRejected, _ := conf.FieldBool("route_rejected")
+	httpAddress, _ := conf.FieldString("http_address")
+	snapshotPath, _ := conf.FieldString("snapshot_path")
+	snapshotIntervalStr, _ := conf.FieldString("snapshot_interval")
+
+	bootstrapSource, _ := conf.FieldString("bootstrap_source")
+	bootstrapBrokers, _ := conf.FieldStringList("bootstrap_seed_brokers")
+	bootstrapTopic, _ := conf.FieldString("bootstrap_topic")
+	bootstrapPath, _ := conf.FieldString("bootstrap_path")
+	bootstrapTimeoutStr, _ := conf.FieldString("bootstrap_timeout")
+	bootstrapOnError, _ := conf.FieldString("bootstrap_on_error")
+	bootstrapRetryStr, _ := conf.FieldString("bootstrap_retry_interval")
+	deviceTTLStr, _ := conf.FieldString("device_ttl")
+	ttlBasis, _ := conf.FieldString("ttl_basis")
+	maxDevices, _ := conf.FieldInt("max_devices")
+	shards, _ := conf.FieldInt("shards")
+	partitionAware, _ := conf.FieldBool("partition_aware")
+	partitionIdleStr, _ := conf.FieldString("partition_idle_timeout")
+
+	snapshotInterval, err := time.ParseDuration(snapshotIntervalStr)
+	if err != nil || snapshotInterval < 0 {
+		return nil, fmt.Errorf("latest_merger: invalid snapshot_interval %q", snapshotIntervalStr)
+	}
+	bootstrapTimeout, err := time.ParseDuration(bootstrapTimeoutStr)
+	if err != nil || bootstrapTimeout < 0 {
+		return nil, fmt.Errorf("latest_merger: invalid bootstrap_timeout %q", bootstrapTimeoutStr)
+	}
+	deviceTTL, err := time.ParseDuration(deviceTTLStr)
+	if err != nil || deviceTTL < 0 {
+		return nil, fmt.Errorf("latest_merger: invalid device_ttl %q", deviceTTLStr)
+	}
+	bootstrapRetry, err := time.ParseDuration(bootstrapRetryStr)
+	if err != nil || bootstrapRetry < 0 {
+		return nil, fmt.Errorf("latest_merger: invalid bootstrap_retry_interval %q", bootstrapRetryStr)
+	}
+	partitionIdle, err := time.ParseDuration(partitionIdleStr)
+	if err != nil || partitionIdle < 0 {
+		return nil, fmt.Errorf("latest_merger: invalid partition_idle_timeout %q", partitionIdleStr)
+	}
+	if maxDevices < 0 {
+		maxDevices = 0
+	}
+
+	policy, err := merger.NewMergePolicy(mergePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("latest_merger: %w", err)
+	}
+	var policies map[string]merger.MergePolicy
+	var resources []resource.Resource
+	if resourceMatrixPath != "" {
+		if resources, err = resource.LoadResourceList(resourceMatrixPath); err != nil {
+			return nil, err
+		}
+		if policies, err = merger.PolicyOverrides(resources); err != nil {
+			return nil, fmt.Errorf("latest_merger: %w", err)
+		}
+	}
+
+	if partitionAware && bootstrapSource == bootstrap.SourceFile {
+		return nil, fmt.Errorf("latest_merger: partition_aware cannot rebuild partitions from bootstrap_source file (use kafka)")
+	}
+
+	var boot bootstrap.Source
+	switch bootstrapSource {
+	case "":
+	case bootstrap.SourceKafka:
+		if len(bootstrapBrokers) == 0 || bootstrapTopic == "" {
+			return nil, fmt.Errorf("latest_merger: bootstrap_source kafka requires bootstrap_seed_brokers and bootstrap_topic")
+		}
+		boot = bootstrap.KafkaSource{Brokers: bootstrapBrokers, Topic: bootstrapTopic}
+	case bootstrap.SourceFile:
+		if bootstrapPath == "" {
+			return nil, fmt.Errorf("latest_merger: bootstrap_source file requires bootstrap_path")
+		}
+		boot = bootstrap.FileSource{Path: bootstrapPath}
+	default:
+		return nil, fmt.Errorf("latest_merger: unknown bootstrap_source %q", bootstrapSource)
+	}
+
+	m := &processors.LatestMerger{
+		FlushMode:        flushMode,
+		SkipUnchanged:    skipUnchanged,
+		Policy:           policy,
+		Policies:         policies,
+		RouteRejected:    routeRejected,
+		SnapshotPath:     snapshotPath,
+		SnapshotInterval: snapshotInterval,
+		Bootstrap:        boot,
+		BootstrapTimeout: bootstrapTimeout,
+		BootstrapOnError: bootstrapOnError,
+
+		BootstrapRetryInterval: bootstrapRetry,
+		DeviceTTL:        deviceTTL,
+		TTLBasis:         ttlBasis,
+		MaxDevices:       maxDevices,
+		Shards:           shards,
+
+		PartitionAware:       partitionAware,
+		PartitionIdleTimeout: partitionIdle,
+	}
+	strat, err := merger.NewStrategy(conf, merger.StrategyEnv{Resources: res, ResourceMatrix: resources, FlushMode: flushMode, HasDevice: m.HasDevice})
+	if err != nil {
+		return nil, fmt.Errorf("latest_merger: %w", err)
+	}
+	m.Strategy = strat
+	if httpAddress != "" {
+		if err := m.StartAPI(httpAddress); err != nil {
+			return nil, fmt.Errorf("latest_merger: http_address: %w", err)
+		}
+	}
+	return m, nil
+}
+
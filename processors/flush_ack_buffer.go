@@ -0,0 +1,218 @@
+package processors
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+const ackBufferLogPrefix = "[latest_merger_ack]"
+
+// FlushAckBuffer is a buffer for at-least-once latest_merger pipelines. LatestMerger drops data messages
+// after merging them, so without it the input acks (and Kafka commits) each message long before its
+// contribution is flushed. The buffer holds the input ack of every data batch until a flush trigger that
+// was read after the batch was merged has been delivered by the output; a crash in between only causes
+// redelivery, which the merge absorbs (latest received_at wins).
+//
+// MaxUnacked bounds the number of held messages. When it is reached the buffer injects its own flush
+// trigger and blocks further writes until that flush has been delivered.
+//
+// Relies on data and trigger messages arriving in separate batches (the default for kafka_franz + generate),
+// and on the output nacking a trigger whose flush failed inside latest_merger (it comes back flagged with
+// the error, e.g. route errored() messages to a reject output): otherwise the acks are released.
+type FlushAckBuffer struct {
+	MaxUnacked int // 0 = unbounded
+
+	mu          sync.Mutex
+	queue       []*ackEntry
+	eligible    []*ackEntry // merged by the pipeline, released by the next delivered flush
+	unacked     int         // data messages whose input ack is still held
+	forcedFlush bool        // an injected trigger is queued or in flight
+	ended       bool
+	changed     chan struct{}
+}
+
+type ackEntry struct {
+	batch   service.MessageBatch
+	ack     service.AckFunc // nil for injected triggers
+	trigger bool
+}
+
+// isFlushBatch returns true if any message of the batch is a complete flush trigger. Scoped, dry-run and
+// reset triggers do not emit every merged update, so they are held like data instead of releasing acks.
+func isFlushBatch(batch service.MessageBatch) bool {
+	for _, msg := range batch {
+		if obj, err := msg.AsBytes(); err == nil {
+			if t, ok := parseFlushTrigger(obj); ok && t.complete() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wait releases mu until the state changes or ctx is done. Must be called with mu held.
+func (b *FlushAckBuffer) wait(ctx context.Context) error {
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	ch := b.changed
+	b.mu.Unlock()
+	defer b.mu.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// broadcast wakes every waiter. Must be called with mu held.
+func (b *FlushAckBuffer) broadcast() {
+	if b.changed != nil {
+		close(b.changed)
+	}
+	b.changed = make(chan struct{})
+}
+
+func (b *FlushAckBuffer) WriteBatch(ctx context.Context, batch service.MessageBatch, aFn service.AckFunc) error {
+	e := &ackEntry{batch: batch, ack: aFn, trigger: isFlushBatch(batch)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Triggers are never blocked: they are what releases held acks.
+	for !e.trigger && b.MaxUnacked > 0 && b.unacked >= b.MaxUnacked {
+		if !b.forcedFlush {
+			b.forcedFlush = true
+			b.queue = append(b.queue, &ackEntry{
+				batch:   service.MessageBatch{service.NewMessage([]byte(`{"_flush":true}`))},
+				trigger: true,
+			})
+			b.broadcast()
+			log.Printf("%s event=forced_flush unacked=%d max_unacked=%d", ackBufferLogPrefix, b.unacked, b.MaxUnacked)
+		}
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	b.queue = append(b.queue, e)
+	if !e.trigger {
+		b.unacked += len(batch)
+	}
+	b.broadcast()
+	return nil
+}
+
+func (b *FlushAckBuffer) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.queue) == 0 {
+		if b.ended {
+			return nil, nil, service.ErrEndOfBuffer
+		}
+		if err := b.wait(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	e := b.queue[0]
+	b.queue[0] = nil
+	b.queue = b.queue[1:]
+
+	if !e.trigger {
+		return e.batch, b.dataAck(e), nil
+	}
+	// Everything merged before this trigger was read is part of the flush it causes.
+	captured := b.eligible
+	b.eligible = nil
+	return e.batch, b.triggerAck(e, captured), nil
+}
+
+// dataAck marks a data batch as merged; its input ack waits for the next delivered flush.
+// A nack (processing failed) is passed straight to the input so the batch is redelivered.
+func (b *FlushAckBuffer) dataAck(e *ackEntry) service.AckFunc {
+	return func(ctx context.Context, err error) error {
+		b.mu.Lock()
+		if err != nil {
+			b.unacked -= len(e.batch)
+			b.broadcast()
+			b.mu.Unlock()
+			return e.ack(ctx, err)
+		}
+		b.eligible = append(b.eligible, e)
+		b.mu.Unlock()
+		return nil
+	}
+}
+
+// triggerAck releases the captured data acks once the flush was delivered. If delivery failed they go
+// back to the eligible set and are released by the next successful flush instead.
+func (b *FlushAckBuffer) triggerAck(e *ackEntry, captured []*ackEntry) service.AckFunc {
+	return func(ctx context.Context, err error) error {
+		if err != nil {
+			b.mu.Lock()
+			b.eligible = append(captured, b.eligible...)
+			if e.ack == nil {
+				b.forcedFlush = false
+			}
+			b.broadcast()
+			b.mu.Unlock()
+			log.Printf("%s event=flush_not_delivered held=%d error=%v", ackBufferLogPrefix, len(captured), err)
+			if e.ack != nil {
+				return e.ack(ctx, err)
+			}
+			return nil
+		}
+
+		released := 0
+		var firstErr error
+		for _, c := range captured {
+			released += len(c.batch)
+			if aerr := c.ack(ctx, nil); aerr != nil && firstErr == nil {
+				firstErr = aerr
+			}
+		}
+
+		b.mu.Lock()
+		b.unacked -= released
+		if e.ack == nil {
+			b.forcedFlush = false
+		}
+		unacked := b.unacked
+		b.broadcast()
+		b.mu.Unlock()
+
+		if released > 0 {
+			log.Printf("%s event=acks_released message_count=%d unacked=%d", ackBufferLogPrefix, released, unacked)
+		}
+		if e.ack != nil {
+			if aerr := e.ack(ctx, nil); aerr != nil && firstErr == nil {
+				firstErr = aerr
+			}
+		}
+		return firstErr
+	}
+}
+
+func (b *FlushAckBuffer) EndOfInput() {
+	b.mu.Lock()
+	b.ended = true
+	b.broadcast()
+	b.mu.Unlock()
+}
+
+// Close leaves held acks unacknowledged, so the input redelivers them after a restart.
+func (b *FlushAckBuffer) Close(ctx context.Context) error {
+	b.mu.Lock()
+	held := b.unacked
+	b.mu.Unlock()
+	if held > 0 {
+		log.Printf("%s event=close unacked=%d note=redelivered_after_restart", ackBufferLogPrefix, held)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package processors
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+type ackRecorder struct {
+	acked []error
+}
+
+func (r *ackRecorder) fn() service.AckFunc {
+	return func(_ context.Context, err error) error {
+		r.acked = append(r.acked, err)
+		return nil
+	}
+}
+
+func dataBatch() service.MessageBatch {
+	return service.MessageBatch{service.NewMessage([]byte(`{"num_of_data":1,"data":{"id":"VIN1"},"produced_at":1}`))}
+}
+
+func triggerBatch() service.MessageBatch {
+	return service.MessageBatch{service.NewMessage([]byte(`{"_flush":true}`))}
+}
+
+func TestFlushAckBuffer_AckHeldUntilFlushDelivered(t *testing.T) {
+	ctx := context.Background()
+	b := &FlushAckBuffer{}
+	var data, trig ackRecorder
+
+	if err := b.WriteBatch(ctx, dataBatch(), data.fn()); err != nil {
+		t.Fatal(err)
+	}
+	_, dataAck, err := b.ReadBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pipeline merged the message (processor returned nothing): input ack must still be held.
+	_ = dataAck(ctx, nil)
+	if len(data.acked) != 0 {
+		t.Fatalf("data acked before flush: %v", data.acked)
+	}
+
+	if err := b.WriteBatch(ctx, triggerBatch(), trig.fn()); err != nil {
+		t.Fatal(err)
+	}
+	_, trigAck, err := b.ReadBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Output failed to deliver the flush: still held.
+	_ = trigAck(ctx, errors.New("output down"))
+	if len(data.acked) != 0 {
+		t.Fatalf("data acked after failed flush: %v", data.acked)
+	}
+
+	// Next flush delivered: released.
+	if err := b.WriteBatch(ctx, triggerBatch(), trig.fn()); err != nil {
+		t.Fatal(err)
+	}
+	_, trigAck, _ = b.ReadBatch(ctx)
+	_ = trigAck(ctx, nil)
+	if len(data.acked) != 1 || data.acked[0] != nil {
+		t.Fatalf("data acks = %v, want one nil ack", data.acked)
+	}
+}
+
+func TestFlushAckBuffer_DataMergedAfterTriggerWaitsForNextFlush(t *testing.T) {
+	ctx := context.Background()
+	b := &FlushAckBuffer{}
+	var data, trig ackRecorder
+
+	_ = b.WriteBatch(ctx, dataBatch(), data.fn())
+	_ = b.WriteBatch(ctx, triggerBatch(), trig.fn())
+	_, dataAck, _ := b.ReadBatch(ctx)
+	_, trigAck, _ := b.ReadBatch(ctx)
+
+	// With parallel pipeline threads the data can finish merging after the trigger was read.
+	_ = dataAck(ctx, nil)
+	_ = trigAck(ctx, nil)
+	if len(data.acked) != 0 {
+		t.Fatalf("data acked by a flush that may not include it: %v", data.acked)
+	}
+}
+
+func TestFlushAckBuffer_NackPassedThrough(t *testing.T) {
+	ctx := context.Background()
+	b := &FlushAckBuffer{}
+	var data ackRecorder
+
+	_ = b.WriteBatch(ctx, dataBatch(), data.fn())
+	_, dataAck, _ := b.ReadBatch(ctx)
+	_ = dataAck(ctx, errors.New("unmarshal"))
+	if len(data.acked) != 1 || data.acked[0] == nil {
+		t.Fatalf("data acks = %v, want one nack", data.acked)
+	}
+}
+
+func TestFlushAckBuffer_MaxUnackedForcesFlush(t *testing.T) {
+	ctx := context.Background()
+	b := &FlushAckBuffer{MaxUnacked: 1}
+	var first, second ackRecorder
+
+	_ = b.WriteBatch(ctx, dataBatch(), first.fn())
+
+	writeDone := make(chan error, 1)
+	go func() { writeDone <- b.WriteBatch(ctx, dataBatch(), second.fn()) }()
+
+	// First read: the held data batch. Second read: the injected trigger.
+	_, dataAck, _ := b.ReadBatch(ctx)
+	_ = dataAck(ctx, nil)
+	forced, trigAck, err := b.ReadBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFlushBatch(forced) {
+		t.Fatal("expected injected flush trigger")
+	}
+	select {
+	case <-writeDone:
+		t.Fatal("write not blocked while at max_unacked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_ = trigAck(ctx, nil)
+	select {
+	case err := <-writeDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked after forced flush was delivered")
+	}
+	if len(first.acked) != 1 {
+		t.Errorf("first batch acks = %v, want 1", first.acked)
+	}
+}
+
+func TestFlushAckBuffer_EndOfInput(t *testing.T) {
+	b := &FlushAckBuffer{}
+	b.EndOfInput()
+	if _, _, err := b.ReadBatch(context.Background()); !errors.Is(err, service.ErrEndOfBuffer) {
+		t.Errorf("ReadBatch after EndOfInput err = %v, want ErrEndOfBuffer", err)
+	}
+}
+
+func TestFlushAckBuffer_PartialTriggerDoesNotRelease(t *testing.T) {
+	ctx := context.Background()
+	b := &FlushAckBuffer{}
+	var data, trig ackRecorder
+
+	_ = b.WriteBatch(ctx, dataBatch(), data.fn())
+	_, dataAck, _ := b.ReadBatch(ctx)
+	_ = dataAck(ctx, nil)
+
+	for _, body := range []string{
+		`{"_flush":true,"vins":["VIN2"]}`,
+		`{"_flush":true,"dry_run":true}`,
+	} {
+		_ = b.WriteBatch(ctx, service.MessageBatch{service.NewMessage([]byte(body))}, trig.fn())
+		_, trigAck, _ := b.ReadBatch(ctx)
+		_ = trigAck(ctx, nil)
+		if len(data.acked) != 0 {
+			t.Fatalf("data acked after %s: %v", body, data.acked)
+		}
+	}
+
+	_ = b.WriteBatch(ctx, service.MessageBatch{service.NewMessage([]byte(`{"_flush":true,"full":true}`))}, trig.fn())
+	_, trigAck, _ := b.ReadBatch(ctx)
+	_ = trigAck(ctx, nil)
+	if len(data.acked) != 1 {
+		t.Fatalf("data acks = %v, want released by the complete flush", data.acked)
+	}
+}
+
+// deliver runs batch through m and an output that nacks errored messages, as the reject case of
+// config/pipeline_log_compacted.yaml does, and returns what the output acks with.
+func deliver(ctx context.Context, m *LatestMerger, batch service.MessageBatch) error {
+	out, err := m.ProcessBatch(ctx, batch)
+	if err != nil {
+		return err
+	}
+	for _, b := range out {
+		for _, msg := range b {
+			if err := msg.GetError(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestFlushAckBuffer_FailedMergerFlushKeepsAcks(t *testing.T) {
+	ctx := context.Background()
+	b := &FlushAckBuffer{}
+	strat := &recordingStrategy{err: errors.New("cache down")}
+	m := &LatestMerger{Strategy: strat}
+	var data, trig ackRecorder
+
+	_ = b.WriteBatch(ctx, dataBatch(), data.fn())
+	batch, dataAck, _ := b.ReadBatch(ctx)
+	_ = dataAck(ctx, deliver(ctx, m, batch))
+
+	_ = b.WriteBatch(ctx, triggerBatch(), trig.fn())
+	batch, trigAck, _ := b.ReadBatch(ctx)
+	_ = trigAck(ctx, deliver(ctx, m, batch))
+	if len(data.acked) != 0 {
+		t.Fatalf("data acked after the merger's flush failed: %v", data.acked)
+	}
+	if len(trig.acked) != 1 || trig.acked[0] == nil {
+		t.Errorf("trigger acks = %v, want a nack", trig.acked)
+	}
+
+	strat.err = nil
+	_ = b.WriteBatch(ctx, triggerBatch(), trig.fn())
+	batch, trigAck, _ = b.ReadBatch(ctx)
+	_ = trigAck(ctx, deliver(ctx, m, batch))
+	if len(data.acked) != 1 || data.acked[0] != nil {
+		t.Fatalf("data acks = %v, want released by the next successful flush", data.acked)
+	}
+}
@@ -2,12 +2,18 @@ package processors
 
 import (
 	"bethos/internal/model"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"bethos/internal/bootstrap"
 	"bethos/internal/merger"
 
 	"github.com/warpstreamlabs/bento/public/service"
@@ -15,138 +21,448 @@ import (
 
 const logPrefix = "[latest_merger]"
 
+var flushKey = []byte(`"_flush"`)
+
+const defaultDeviceTTL = 10 * time.Minute
+
+// TTL basis: what a device's age is measured from when applying DeviceTTL.
+const (
+	TTLBasisArrival    = "arrival"     // wall clock of the last merged message (LastSeen)
+	TTLBasisReceivedAt = "received_at" // newest ReceivedAt among the device's metrics
+)
+
+// evictReasons is the log order of eviction counters.
+var evictReasons = []string{merger.EvictReasonTTL, merger.EvictReasonCapacity, merger.EvictReasonRevoked, merger.EvictReasonManual}
+
 // LatestMerger is a stateful processor that merges telemetry by device (vincode).
-// On each Kafka message it merges into state. When it receives a flush trigger
+// On each Kafka message (a Payload, a PayloadBatch or a JSON array of Payloads) it merges into state, per sensor, as decided by the sensor's merge policy
+// (default: newest received_at wins). Each update is counted as applied, stale or duplicate, and with
+// RouteRejected the rejected ones are also returned as tagged messages. When it receives a flush trigger
 // (message with _flush: true, e.g. from generate input every 2m), it delegates to FlushStrategy.
+// With a changed_* FlushMode, only devices (or sensors) updated since the last successful flush are passed
+// to the strategy; a failed flush keeps them pending for the next one.
+// State is split into Shards by VIN hash, each with its own lock, so concurrent pipeline threads
+// merging different devices do not serialize and a flush snapshots shards in parallel.
+// If SnapshotPath is set, state is restored from it before the first message and saved after
+// every flush (or every SnapshotInterval when > 0) and on Close. StartAPI serves the current state over HTTP.
+// If Bootstrap is set, state is also seeded from it (e.g. the compacted output topic) before the first
+// message is merged, so no flush can emit partial devices after a restart; if it fails, flushes are held and
+// it is retried on each flush trigger until it succeeds, unless BootstrapOnError is continue.
+// With PartitionAware, replicas sharing a consumer group only hold and emit devices of the partitions they
+// consume: a newly seen partition is rebuilt in the background from Bootstrap (if it is a
+// bootstrap.PartitionSource) instead of bootstrapping everything at startup (a failed rebuild is handled like a
+// failed bootstrap: the partition stays held and is rebuilt again, per BootstrapOnError), and, only if PartitionIdleTimeout
+// is set, a partition idle for that long is dropped as revoked.
 type LatestMerger struct {
-	mu       sync.Mutex
-	state    map[string]*DeviceState
-	Strategy merger.FlushStrategy
+	Strategy  merger.FlushStrategy
+	FlushMode string // merger.FlushModeFull (default), FlushModeChangedDevices or FlushModeChangedSensors
+	Shards    int    // number of state shards; 0 = 1
+
+	Policy   merger.MergePolicy            // how an incoming metric replaces the stored one; nil = merger.LatestPolicy
+	Policies map[string]merger.MergePolicy // per-sensor overrides of Policy (e.g. from the resource matrix)
+
+	RouteRejected bool // emit stale/duplicate updates as messages tagged with MetaOutcome and MetaLatenessMs
+
+	// SkipUnchanged leaves out of a flush the devices whose model.ContentHash equals that of their last
+	// successful flush (a full trigger still emits them). Not kept in the snapshot: the first flush after a
+	// restart emits every device.
+	SkipUnchanged bool
+
+	SnapshotPath     string        // optional: local file for durable state; empty = disabled
+	SnapshotInterval time.Duration // 0 = save after every flush; > 0 = save on this interval instead
+
+	Bootstrap        bootstrap.Source // optional: latest-per-VIN source to seed state on startup
+	BootstrapTimeout time.Duration    // 0 = no timeout
+	BootstrapOnError string           // BootstrapOnErrorHold (default) or BootstrapOnErrorContinue
+
+	BootstrapRetryInterval time.Duration // min time between retries of a failed bootstrap; 0 = on every flush trigger
+
+	DeviceTTL  time.Duration // devices older than this are evicted on flush; 0 = defaultDeviceTTL
+	TTLBasis   string        // TTLBasisArrival (default) or TTLBasisReceivedAt
+	MaxDevices int           // cap on devices in state (split across shards); least recently seen is evicted on merge. 0 = unlimited
+
+	PartitionAware       bool          // track each device's kafka_partition and only keep devices of partitions still consumed
+	PartitionIdleTimeout time.Duration // a partition without messages for this long is treated as revoked; 0 = never
+
+	shardsOnce sync.Once
+	shards     []*mergerShard
+
+	statsMu      sync.Mutex
+	evictedTotal map[string]int64  // reason -> count since start. Guarded by statsMu
+	evictions    []merger.Eviction // not yet accepted by the EvictionListener. Guarded by statsMu
+	outcomeTotal outcomeCounts     // since start. Guarded by statsMu
+
+	partMu       sync.RWMutex
+	partitions   map[int32]*partitionState // owned source partitions (PartitionAware)
+	rebuildCtx   context.Context           // cancelled by Close; see sourcePartition
+	stopRebuilds context.CancelFunc
+	rebuildWG    sync.WaitGroup
+
+	api   *http.Server // see StartAPI
+	ready atomic.Bool  // init finished without error
+
+	bootstrapMu      sync.Mutex
+	bootstrapPending atomic.Bool // the bootstrap failed with BootstrapOnErrorHold; see retryBootstrap
+	bootstrapAt      time.Time   // start of the last bootstrap attempt. Guarded by bootstrapMu
+	bootstrapErr     error       // error of the last bootstrap attempt. Guarded by bootstrapMu
+
+	initOnce     sync.Once
+	initErr      error
+	stopSnapshot chan struct{}
+	snapshotWG   sync.WaitGroup
 }
 
-type DeviceState struct {
-	Metrics  map[string]model.MetricValue
-	LastSeen int64
+// flushTrigger is a flush trigger message: {"_flush": true} plus optional options.
+type flushTrigger struct {
+	Flush  *bool    `json:"_flush"`
+	VINs   []string `json:"vins,omitempty"`    // flush only these devices; others keep their state and dirty marks
+	Full   bool     `json:"full,omitempty"`    // in a changed_* flush mode, emit every device (in scope) with all sensors
+	DryRun bool     `json:"dry_run,omitempty"` // only log what would be flushed and evicted; state is untouched
+	Reset  bool     `json:"reset,omitempty"`   // discard state (all, or VINs) without emitting it
+	Evict  []string `json:"evict,omitempty"`   // remove these devices first (reason manual), reported to the EvictionListener
 }
 
-// isFlushTrigger parses JSON and returns true if the message is a flush trigger (e.g. {"_flush": true}).
-// Tolerates whitespace and key order so generate input is reliable.
-func isFlushTrigger(obj []byte) bool {
-	var v struct {
-		Flush *bool `json:"_flush"`
+// complete reports whether the trigger emits every merged update, so acks held for them may be released.
+func (t flushTrigger) complete() bool {
+	return len(t.VINs) == 0 && !t.DryRun && !t.Reset
+}
+
+// parseFlushTrigger parses JSON and returns the trigger if the message is a flush trigger (e.g. {"_flush": true}).
+// Tolerates whitespace and key order so generate input is reliable. Data messages without the key are
+// rejected without parsing, so they are only decoded once.
+func parseFlushTrigger(obj []byte) (flushTrigger, bool) {
+	if !bytes.Contains(obj, flushKey) {
+		return flushTrigger{}, false
 	}
-	if err := json.Unmarshal(obj, &v); err != nil {
-		return false
+	var t flushTrigger
+	if err := json.Unmarshal(obj, &t); err != nil {
+		return flushTrigger{}, false
 	}
-	return v.Flush != nil && *v.Flush
+	return t, t.Flush != nil && *t.Flush
+}
+
+// isFlushTrigger returns true if the message is a flush trigger, whatever its options.
+func isFlushTrigger(obj []byte) bool {
+	_, ok := parseFlushTrigger(obj)
+	return ok
+}
+
+// init restores the snapshot, runs the bootstrap and starts the interval saver (each if configured).
+// Runs once, before the first message; Process blocks on it, so neither consumption nor emission starts earlier.
+func (m *LatestMerger) init() error {
+	m.initOnce.Do(func() {
+		if m.SnapshotPath != "" {
+			if m.initErr = m.restoreSnapshot(); m.initErr != nil {
+				return
+			}
+		}
+		if _, perPartition := m.Bootstrap.(bootstrap.PartitionSource); m.Bootstrap != nil && !(m.PartitionAware && perPartition) {
+			m.bootstrapAt = time.Now()
+			if err := m.runBootstrap(); err != nil && m.bootstrapOnError() == BootstrapOnErrorHold {
+				m.bootstrapErr = err
+				m.bootstrapPending.Store(true)
+			}
+		}
+		if m.PartitionAware {
+			m.rebuildCtx, m.stopRebuilds = context.WithCancel(context.Background())
+		}
+		if m.SnapshotPath != "" && m.SnapshotInterval > 0 {
+			m.stopSnapshot = make(chan struct{})
+			m.snapshotWG.Add(1)
+			go m.snapshotLoop()
+		}
+		m.ready.Store(true)
+	})
+	return m.initErr
 }
 
 func (m *LatestMerger) Close(ctx context.Context) error {
-	_, err := m.flush(ctx)
-	if err != nil {
+	// Never overwrite a snapshot that could not be restored (e.g. unsupported version).
+	initErr := m.init()
+	m.stopAPI(ctx)
+	if m.stopRebuilds != nil {
+		m.stopRebuilds()
+		m.rebuildWG.Wait()
+	}
+
+	// The strategy closes first so it can persist what it still holds (window_stream). Nothing returned by the
+	// shutdown flush is emitted (Bento drops it); it only runs the strategies' side effects and logs. The
+	// snapshot is saved whatever they return.
+	var errs []error
+	if err := m.Strategy.Close(ctx); err != nil {
+		log.Printf("%s event=shutdown_flush op=strategy_close error=%v", logPrefix, err)
+		errs = append(errs, err)
+	}
+	if _, err := m.flush(ctx); err != nil {
 		log.Printf("%s event=shutdown_flush error=%v", logPrefix, err)
-		return err
+		errs = append(errs, err)
+	}
+	if m.stopSnapshot != nil {
+		close(m.stopSnapshot)
+		m.snapshotWG.Wait()
 	}
-	log.Printf("%s event=shutdown_flush note=data_not_emitted_on_shutdown", logPrefix)
-	return nil
+	if m.SnapshotPath != "" && initErr == nil {
+		if err := m.saveSnapshot(); err != nil {
+			errs = append(errs, err)
+		} else {
+			log.Printf("%s event=shutdown_flush note=state_persisted_to_snapshot", logPrefix)
+		}
+	} else {
+		log.Printf("%s event=shutdown_flush note=data_not_emitted_on_shutdown", logPrefix)
+	}
+	return errors.Join(errs...)
 }
 
 func (m *LatestMerger) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+
 	obj, err := msg.AsBytes()
 	if err != nil {
 		log.Printf("%s event=error error=as_bytes err=%v", logPrefix, err)
 		return nil, err
 	}
 
-	if isFlushTrigger(obj) {
-		return m.flush(ctx)
+	if t, ok := parseFlushTrigger(obj); ok {
+		return m.flushWith(ctx, t)
 	}
 
-	var payload model.Payload
-	if err := json.Unmarshal(obj, &payload); err != nil {
+	payloads, err := model.DecodePayloads(obj)
+	if err != nil {
 		log.Printf("%s event=error error=unmarshal err=%v", logPrefix, err)
 		return nil, err
 	}
 
-	if payload.Data.ID == "" {
-		log.Printf("%s event=skip reason=empty_vin hint=payload_must_have_data.id", logPrefix)
-		return nil, nil
+	partition := m.sourcePartition(msg)
+	var rejected []rejectedUpdate
+	for _, payload := range payloads {
+		if payload.Data.ID == "" {
+			log.Printf("%s event=skip reason=empty_vin hint=payload_must_have_data.id", logPrefix)
+			continue
+		}
+		rejected = append(rejected, m.mergeFrom(payload, partition)...)
+	}
+	if len(rejected) > 0 {
+		return rejectedMessages(rejected, time.Now().UnixMilli()), nil
 	}
-
-	m.merge(payload)
 
 	return nil, nil
 }
 
-func (m *LatestMerger) merge(p model.Payload) {
+// merge applies p to state and counts the outcome of every sensor update. Rejected updates are returned
+// only when RouteRejected is set.
+func (m *LatestMerger) merge(p model.Payload) []rejectedUpdate {
+	return m.mergeFrom(p, noPartition)
+}
+
+// mergeFrom is merge for a payload read from the given source partition (noPartition if unknown).
+func (m *LatestMerger) mergeFrom(p model.Payload, partition int32) []rejectedUpdate {
 	vin := p.Data.ID
 	if vin == "" {
-		return
+		return nil
 	}
 
-	now := time.Now().UnixMilli()
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if m.state == nil {
-		m.state = make(map[string]*DeviceState)
-	}
+	s := m.shardFor(vin)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return m.mergeLocked(s, p, partition, time.Now().UnixMilli())
+}
 
-	dev := m.state[vin]
-	if dev == nil {
-		dev = &DeviceState{
-			Metrics:  make(map[string]model.MetricValue),
-			LastSeen: now,
-		}
-		m.state[vin] = dev
+// mergeLocked is mergeFrom for a payload whose VIN belongs to s. Must hold s.mu.
+func (m *LatestMerger) mergeLocked(s *mergerShard, p model.Payload, partition int32, now int64) []rejectedUpdate {
+	vin := p.Data.ID
+	dev := s.upsertLocked(vin, now)
+	if partition != noPartition {
+		dev.Partition = partition
 	}
-
+	delta := s.delta()
+	observer, _ := m.Strategy.(merger.MetricObserver)
+	var rejected []rejectedUpdate
 	for sensor, metric := range p.Data.Metrics {
-		if metric.ReceivedAt >= dev.Metrics[sensor].ReceivedAt {
+		stored, exists := dev.Metrics[sensor]
+		outcome := OutcomeApplied
+		switch {
+		case exists && sameMetric(stored, metric):
+			outcome = OutcomeDuplicate
+			s.outcomes.Duplicate++
+		case m.policyFor(sensor).Accept(stored, exists, metric):
+			s.outcomes.Applied++
 			dev.Metrics[sensor] = metric
+			if delta {
+				dev.markDirty(sensor)
+			}
+		default:
+			outcome = OutcomeStale
+			s.outcomes.Stale++
+			if l := latenessMs(stored, metric); l > s.outcomes.MaxLatenessMs {
+				s.outcomes.MaxLatenessMs = l
+			}
+		}
+		if observer != nil && outcome != OutcomeDuplicate {
+			observer.Observe(vin, sensor, metric)
+		}
+		if outcome != OutcomeApplied && m.RouteRejected {
+			rejected = append(rejected, rejectedUpdate{
+				vin: vin, sensor: sensor, metric: metric, outcome: outcome, latenessMs: latenessMs(stored, metric),
+			})
 		}
 	}
 
 	dev.LastSeen = now
+	return rejected
+}
+
+// policyFor returns the merge policy for sensor: its override if any, else Policy, else latest.
+func (m *LatestMerger) policyFor(sensor string) merger.MergePolicy {
+	if p, ok := m.Policies[sensor]; ok {
+		return p
+	}
+	if m.Policy != nil {
+		return m.Policy
+	}
+	return merger.LatestPolicy{}
 }
 
 func (m *LatestMerger) flush(ctx context.Context) (service.MessageBatch, error) {
+	return m.flushWith(ctx, flushTrigger{})
+}
+
+// flushWith flushes state as the trigger t asks (see flushTrigger).
+func (m *LatestMerger) flushWith(ctx context.Context, t flushTrigger) (service.MessageBatch, error) {
 	start := time.Now()
 	now := time.Now().UnixMilli()
-	const deviceTTL = int64(10 * time.Minute / time.Millisecond)
-
-	m.mu.Lock()
+	ttl := m.DeviceTTL
+	if ttl <= 0 {
+		ttl = defaultDeviceTTL
+	}
 
-	snapshot := make(map[string]map[string]model.MetricValue)
-	for vin, dev := range m.state {
+	m.initShards()
+	opts := collectOptions{now: now, ttl: ttl.Milliseconds(), basis: m.TTLBasis, full: t.Full, dryRun: t.DryRun,
+		skipUnchanged: m.SkipUnchanged && !t.Full}
+	if len(t.VINs) > 0 {
+		opts.scope = make(map[string]struct{}, len(t.VINs))
+		for _, vin := range t.VINs {
+			opts.scope[vin] = struct{}{}
+		}
+	}
+	if t.DryRun {
+		m.dryRun(opts, t)
+		return nil, nil
+	}
+	if t.Reset {
+		m.reset(opts.scope)
+		return nil, nil
+	}
+	if err := m.retryBootstrap(); err != nil {
+		log.Printf("%s event=flush_error error=%v", logPrefix, err)
+		return nil, err
+	}
+	m.evictManual(t.Evict)
+	m.retryRebuilds(now)
+	opts.owned, opts.rebuilding = m.ownedPartitions(now, true)
 
-		if now-dev.LastSeen > deviceTTL {
-			delete(m.state, vin)
-			continue
+	parts := make([]shardFlush, len(m.shards))
+	if len(m.shards) == 1 {
+		parts[0] = m.shards[0].collect(opts)
+	} else {
+		var wg sync.WaitGroup
+		for i, s := range m.shards {
+			wg.Add(1)
+			go func(i int, s *mergerShard) {
+				defer wg.Done()
+				parts[i] = s.collect(opts)
+			}(i, s)
 		}
+		wg.Wait()
+	}
 
-		copyDev := make(map[string]model.MetricValue, len(dev.Metrics))
-		for k, v := range dev.Metrics {
-			copyDev[k] = v
+	size := 0
+	for _, part := range parts {
+		size += len(part.state)
+	}
+	snapshot := make(merger.FlushState, size)
+	evicted := make(map[string]int)
+	var outcomes outcomeCounts
+	m.statsMu.Lock()
+	evictions := m.evictions
+	m.evictions = nil
+	for _, part := range parts {
+		for vin, dev := range part.state {
+			snapshot[vin] = dev
 		}
-		snapshot[vin] = copyDev
+		for reason, n := range part.evicted {
+			evicted[reason] += n
+		}
+		evictions = append(evictions, part.evictions...)
+		outcomes.add(part.outcomes)
+	}
+	m.outcomeTotal.add(outcomes)
+	totals := m.outcomeTotal
+	if m.evictedTotal == nil {
+		m.evictedTotal = make(map[string]int64)
 	}
+	var evictLogs []string
+	for _, reason := range evictReasons {
+		if n := evicted[reason]; n > 0 {
+			m.evictedTotal[reason] += int64(n)
+			evictLogs = append(evictLogs, fmt.Sprintf("reason=%s count=%d total=%d", reason, n, m.evictedTotal[reason]))
+		}
+	}
+	m.statsMu.Unlock()
 
-	m.mu.Unlock()
+	for _, l := range evictLogs {
+		log.Printf("%s event=evict %s", logPrefix, l)
+	}
+	if !outcomes.empty() {
+		log.Printf("%s event=merge_outcomes applied=%d stale=%d duplicate=%d max_lateness_ms=%d applied_total=%d stale_total=%d duplicate_total=%d",
+			logPrefix, outcomes.Applied, outcomes.Stale, outcomes.Duplicate, outcomes.MaxLatenessMs,
+			totals.Applied, totals.Stale, totals.Duplicate)
+	}
 
 	vinCount := len(snapshot)
 	batch, err := m.Strategy.OnFlush(ctx, snapshot)
+	tombstones := 0
+	if l, ok := m.Strategy.(merger.EvictionListener); ok {
+		if err == nil {
+			var evictBatch service.MessageBatch
+			evictBatch, err = l.OnEvict(ctx, evictions)
+			tombstones = len(evictBatch)
+			batch = append(batch, evictBatch...)
+		}
+		if err != nil {
+			// Keep them for the next flush so the listener does not miss an eviction.
+			m.statsMu.Lock()
+			m.evictions = append(evictions, m.evictions...)
+			m.statsMu.Unlock()
+		}
+	}
+	if c, ok := m.Strategy.(merger.FlushCommitter); ok {
+		c.FlushDone(err)
+	}
 	durationMs := time.Since(start).Milliseconds()
 	msgCount := 0
 	if batch != nil {
 		msgCount = len(batch)
 	}
-	log.Printf("%s event=flush flush_duration_ms=%d vin_count=%d message_count=%d",
-		logPrefix, durationMs, vinCount, msgCount)
+	scope := ""
+	if opts.scope != nil {
+		scope = fmt.Sprintf(" scope_vin_count=%d", len(opts.scope))
+	}
+	log.Printf("%s event=flush flush_duration_ms=%d vin_count=%d message_count=%d tombstone_count=%d%s",
+		logPrefix, durationMs, vinCount, msgCount, tombstones, scope)
 	if err != nil {
+		for i, part := range parts {
+			m.shards[i].restoreDirty(part.dirty)
+		}
 		log.Printf("%s event=flush_error error=%v", logPrefix, err)
 		return batch, err
 	}
+	for i, part := range parts {
+		m.shards[i].markPublished(part.hashes)
+	}
+	if m.SnapshotPath != "" && m.SnapshotInterval <= 0 && m.initErr == nil {
+		_ = m.saveSnapshot()
+	}
 	return batch, nil
 }
@@ -0,0 +1,171 @@
+package processors
+
+import (
+	"bethos/internal/model"
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// decodedMessage is one message of a batch after decoding.
+type decodedMessage struct {
+	flush    bool
+	trigger  flushTrigger
+	payloads []model.Payload
+	err      error
+}
+
+// sourcedPayload is a payload with the source partition of its message.
+type sourcedPayload struct {
+	model.Payload
+	partition int32
+}
+
+// ProcessBatch is the batch variant of Process (registered as latest_merger_batch). The batch is decoded
+// in parallel, in a single JSON pass per message, then each shard merges its payloads under one lock
+// acquisition. Flush triggers split the batch: messages before a trigger are merged before it flushes,
+// messages after it are merged after. Messages that fail to decode are returned with their error set, and so
+// is a trigger whose flush fails, after what the flush returned; the rest of the batch is still merged.
+func (m *LatestMerger) ProcessBatch(ctx context.Context, batch service.MessageBatch) ([]service.MessageBatch, error) {
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+
+	decoded := decodeBatch(batch)
+
+	var out service.MessageBatch
+	var segment []sourcedPayload
+	for i, d := range decoded {
+		switch {
+		case d.err != nil:
+			batch[i].SetError(d.err)
+			out = append(out, batch[i])
+		case d.flush:
+			out = append(out, m.mergeBatch(segment)...)
+			segment = segment[:0]
+			flushed, err := m.flushWith(ctx, d.trigger)
+			out = append(out, flushed...)
+			if err != nil {
+				batch[i].SetError(err)
+				out = append(out, batch[i])
+			}
+		default:
+			partition := m.sourcePartition(batch[i])
+			for _, p := range d.payloads {
+				segment = append(segment, sourcedPayload{Payload: p, partition: partition})
+			}
+		}
+	}
+	out = append(out, m.mergeBatch(segment)...)
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return []service.MessageBatch{out}, nil
+}
+
+// decodeBatch decodes every message of batch, spreading the work over GOMAXPROCS goroutines.
+func decodeBatch(batch service.MessageBatch) []decodedMessage {
+	decoded := make([]decodedMessage, len(batch))
+	decode := func(from, to int) {
+		for i := from; i < to; i++ {
+			decoded[i] = decodeMessage(batch[i])
+		}
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	const minPerWorker = 64
+	if n := (len(batch) + minPerWorker - 1) / minPerWorker; n < workers {
+		workers = n
+	}
+	if workers <= 1 {
+		decode(0, len(batch))
+		return decoded
+	}
+
+	var wg sync.WaitGroup
+	chunk := (len(batch) + workers - 1) / workers
+	for from := 0; from < len(batch); from += chunk {
+		to := min(from+chunk, len(batch))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decode(from, to)
+		}()
+	}
+	wg.Wait()
+	return decoded
+}
+
+func decodeMessage(msg *service.Message) decodedMessage {
+	obj, err := msg.AsBytes()
+	if err != nil {
+		log.Printf("%s event=error error=as_bytes err=%v", logPrefix, err)
+		return decodedMessage{err: err}
+	}
+	if t, ok := parseFlushTrigger(obj); ok {
+		return decodedMessage{flush: true, trigger: t}
+	}
+	payloads, err := model.DecodePayloads(obj)
+	if err != nil {
+		log.Printf("%s event=error error=unmarshal err=%v", logPrefix, err)
+		return decodedMessage{err: err}
+	}
+	return decodedMessage{payloads: payloads}
+}
+
+// mergeBatch merges payloads grouped by shard, one goroutine and one lock acquisition per shard. Payloads
+// of the same VIN keep their batch order. Returns the rejected-update messages (RouteRejected).
+func (m *LatestMerger) mergeBatch(payloads []sourcedPayload) service.MessageBatch {
+	if len(payloads) == 0 {
+		return nil
+	}
+	m.initShards()
+
+	groups := make([][]int, len(m.shards))
+	for i, p := range payloads {
+		if p.Data.ID == "" {
+			log.Printf("%s event=skip reason=empty_vin hint=payload_must_have_data.id", logPrefix)
+			continue
+		}
+		idx := vinHash(p.Data.ID) % uint32(len(m.shards))
+		groups[idx] = append(groups[idx], i)
+	}
+
+	now := time.Now().UnixMilli()
+	rejected := make([][]rejectedUpdate, len(m.shards))
+	mergeShard := func(idx int) {
+		s := m.shards[idx]
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, i := range groups[idx] {
+			rejected[idx] = append(rejected[idx], m.mergeLocked(s, payloads[i].Payload, payloads[i].partition, now)...)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for idx, g := range groups {
+		if len(g) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			mergeShard(idx)
+		}(idx)
+	}
+	wg.Wait()
+
+	var all []rejectedUpdate
+	for _, r := range rejected {
+		all = append(all, r...)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	return rejectedMessages(all, now)
+}
@@ -0,0 +1,102 @@
+package processors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"bethos/internal/merger"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func TestLatestMerger_ProcessBatch_FlushTriggerSplitsBatch(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: merger.InlineFlushStrategy{}, Shards: 4}
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte(`{"num_of_data":1,"data":{"id":"VIN1","a":{"value":"1","received_at":1}},"produced_at":1}`)),
+		service.NewMessage([]byte(`{"_flush":true}`)),
+		service.NewMessage([]byte(`{"num_of_data":1,"data":{"id":"VIN2","a":{"value":"2","received_at":2}},"produced_at":2}`)),
+	}
+	out, err := m.ProcessBatch(ctx, batch)
+	if err != nil {
+		t.Fatalf("ProcessBatch: %v", err)
+	}
+	if len(out) != 1 || len(out[0]) != 1 {
+		t.Fatalf("expected one flushed device, got %v", out)
+	}
+	if vin, _ := out[0][0].MetaGet("vincode"); vin != "VIN1" {
+		t.Errorf("flushed vincode = %q, want VIN1 (VIN2 comes after the trigger)", vin)
+	}
+	if deviceOf(m, "VIN2") == nil {
+		t.Error("VIN2 not merged after the trigger")
+	}
+}
+
+func TestLatestMerger_ProcessBatch_InvalidMessageFlagged(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: merger.InlineFlushStrategy{}}
+
+	bad := service.NewMessage([]byte(`{invalid`))
+	out, err := m.ProcessBatch(ctx, service.MessageBatch{
+		service.NewMessage([]byte(`{"num_of_data":1,"data":{"id":"VIN1","a":{"value":"1","received_at":1}},"produced_at":1}`)),
+		bad,
+	})
+	if err != nil {
+		t.Fatalf("ProcessBatch: %v", err)
+	}
+	if len(out) != 1 || len(out[0]) != 1 || out[0][0] != bad || bad.GetError() == nil {
+		t.Fatalf("expected only the invalid message back, with its error set; got %v", out)
+	}
+	if deviceOf(m, "VIN1") == nil {
+		t.Error("VIN1 not merged")
+	}
+}
+
+func TestLatestMerger_ProcessBatch_FailedFlushKeepsBatch(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: &recordingStrategy{err: errors.New("broker down")}}
+
+	bad := service.NewMessage([]byte(`{invalid`))
+	trigger := service.NewMessage([]byte(`{"_flush":true}`))
+	out, err := m.ProcessBatch(ctx, service.MessageBatch{
+		bad,
+		trigger,
+		service.NewMessage([]byte(`{"num_of_data":1,"data":{"id":"VIN2","a":{"value":"2","received_at":2}},"produced_at":2}`)),
+	})
+	if err != nil {
+		t.Fatalf("ProcessBatch: %v", err)
+	}
+	if len(out) != 1 || len(out[0]) != 2 || out[0][0] != bad || out[0][1] != trigger {
+		t.Fatalf("expected the invalid message and the trigger back; got %v", out)
+	}
+	if bad.GetError() == nil || trigger.GetError() == nil {
+		t.Errorf("errors = %v, %v; want both set", bad.GetError(), trigger.GetError())
+	}
+	if deviceOf(m, "VIN2") == nil {
+		t.Error("VIN2 after the failed trigger not merged")
+	}
+}
+
+func TestLatestMerger_ProcessBatch_KeepsOrderPerVIN(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: merger.InlineFlushStrategy{}, Shards: 8}
+
+	// Equal received_at: the later message in the batch wins, as with per-message Process.
+	var batch service.MessageBatch
+	for i := 0; i < 500; i++ {
+		batch = append(batch, service.NewMessage([]byte(fmt.Sprintf(
+			`{"num_of_data":1,"data":{"id":"VIN%d","a":{"value":"%d","received_at":1}},"produced_at":1}`, i%10, i))))
+	}
+	if _, err := m.ProcessBatch(ctx, batch); err != nil {
+		t.Fatalf("ProcessBatch: %v", err)
+	}
+	for v := 0; v < 10; v++ {
+		want := fmt.Sprintf("%d", 490+v)
+		if got := deviceOf(m, fmt.Sprintf("VIN%d", v)).Metrics["a"].Value; got != want {
+			t.Errorf("VIN%d a = %v, want %s", v, got, want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"testing"
 
 	"bethos/internal/model"
@@ -76,3 +77,158 @@ func BenchmarkLatestMerger_Flush_LargeState(b *testing.B) {
 		_, _ = m.Process(ctx, flushMsg)
 	}
 }
+
+// BenchmarkLatestMerger_Process_ParallelProducers merges distinct VINs from parallel goroutines (like
+// pipeline threads), comparing one lock (shards=1) with sharded state.
+func BenchmarkLatestMerger_Process_ParallelProducers(b *testing.B) {
+	ctx := context.Background()
+	const numVINs = 10000
+	msgs := make([]*service.Message, numVINs)
+	for i := 0; i < numVINs; i++ {
+		p := model.Payload{
+			NumOfData:  1,
+			Data:       model.Data{ID: fmt.Sprintf("VIN%d", i), Metrics: map[string]model.MetricValue{"s1": {Value: "v", ReceivedAt: int64(100 + i)}}},
+			ProducedAt: 1,
+		}
+		raw, _ := json.Marshal(p)
+		msg := service.NewMessage(nil)
+		msg.SetBytes(raw)
+		msgs[i] = msg
+	}
+
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Shards: shards}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					_, _ = m.Process(ctx, msgs[i%numVINs])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkLatestMerger_Merge_ParallelProducersDuringFlush merges from parallel goroutines while a
+// background goroutine keeps flushing a 100k-device state, showing how long flushes stall ingestion.
+func BenchmarkLatestMerger_Merge_ParallelProducersDuringFlush(b *testing.B) {
+	ctx := context.Background()
+	const numVINs = 100000
+	payloads := make([]model.Payload, numVINs)
+	for i := 0; i < numVINs; i++ {
+		payloads[i] = model.Payload{
+			NumOfData: 1,
+			Data: model.Data{
+				ID:      fmt.Sprintf("VIN%d", i),
+				Metrics: map[string]model.MetricValue{"sensor_a": {Value: "x", ReceivedAt: int64(100 + i)}},
+			},
+		}
+	}
+
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			m := &LatestMerger{Strategy: merger.InlineFlushStrategy{}, Shards: shards}
+			for _, p := range payloads {
+				m.merge(p)
+			}
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						_, _ = m.flush(ctx)
+					}
+				}
+			}()
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					m.merge(payloads[next.Add(1)%numVINs])
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// benchmarkBatch builds size payload messages spread over numVINs devices with a few sensors each.
+func benchmarkBatch(size, numVINs int) service.MessageBatch {
+	batch := make(service.MessageBatch, size)
+	for i := 0; i < size; i++ {
+		p := model.Payload{
+			NumOfData: 1,
+			Data: model.Data{ID: fmt.Sprintf("VF37ARFZE%08d", i%numVINs), Metrics: map[string]model.MetricValue{
+				"vehicle_speed": {Value: "88", ReceivedAt: int64(1000 + i)},
+				"odometer":      {Value: "123456", ReceivedAt: int64(1000 + i)},
+				"door_status":   {Value: "Closed", ReceivedAt: int64(1000 + i)},
+			}},
+			ProducedAt: 1,
+		}
+		raw, _ := json.Marshal(p)
+		batch[i] = service.NewMessage(raw)
+	}
+	return batch
+}
+
+// BenchmarkLatestMerger_ProcessVsProcessBatch merges the same 10k-message batch through per-message Process
+// (latest_merger) and ProcessBatch (latest_merger_batch). Reports records/s; run with -benchmem for allocations.
+func BenchmarkLatestMerger_ProcessVsProcessBatch(b *testing.B) {
+	ctx := context.Background()
+	const batchSize, numVINs = 10000, 2000
+	batch := benchmarkBatch(batchSize, numVINs)
+
+	b.Run("process", func(b *testing.B) {
+		m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Shards: 16}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, msg := range batch {
+				_, _ = m.Process(ctx, msg)
+			}
+		}
+		b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "records/s")
+	})
+
+	b.Run("process_batch", func(b *testing.B) {
+		m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Shards: 16}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = m.ProcessBatch(ctx, batch)
+		}
+		b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "records/s")
+	})
+}
+
+// BenchmarkIsFlushTrigger_DataMessage measures the trigger check on a data message: the key pre-check
+// against the full JSON parse every data message used to pay before being decoded again as a payload.
+func BenchmarkIsFlushTrigger_DataMessage(b *testing.B) {
+	body := []byte(`{"num_of_data":1,"data":{"id":"VIN1","s1":{"value":"v","received_at":100}},"produced_at":1}`)
+
+	b.Run("precheck", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = isFlushTrigger(body)
+		}
+	})
+
+	b.Run("full_parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var v struct {
+				Flush *bool `json:"_flush"`
+			}
+			_ = json.Unmarshal(body, &v)
+		}
+	})
+}
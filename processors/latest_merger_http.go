@@ -0,0 +1,182 @@
+package processors
+
+import (
+	"bethos/internal/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats is the body of GET /stats.
+type Stats struct {
+	Devices      int              `json:"devices"`
+	Sensors      int              `json:"sensors"` // sensor values held across all devices
+	Shards       int              `json:"shards"`
+	EvictedTotal map[string]int64 `json:"evicted_total"`
+	Outcomes     struct {
+		Applied   int64 `json:"applied"`
+		Stale     int64 `json:"stale"`
+		Duplicate int64 `json:"duplicate"`
+	} `json:"outcomes_total"`
+}
+
+// StartAPI serves the read-only state API on addr until Close:
+//
+//	GET /latest/{vin}         current merged model.Payload of one device (404 if unknown)
+//	GET /latest?sensor=a,b    model.PayloadBatch of every device, projected to the given sensors (all if omitted)
+//	GET /stats                Stats
+//
+// /latest and /stats read the shards one after another, each under its own lock, so merges are never
+// blocked on more than one shard: every shard is consistent, but the result is not a point-in-time view
+// across shards (a message merged meanwhile may show in one shard and not yet in another).
+// Restore and bootstrap start right away rather than on the first message; until they have finished,
+// every endpoint answers 503.
+func (m *LatestMerger) StartAPI(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.api = &http.Server{Handler: m.apiHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := m.api.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s event=api_error error=%v", logPrefix, err)
+		}
+	}()
+	log.Printf("%s event=api_listening address=%s", logPrefix, ln.Addr())
+	go func() { _ = m.init() }()
+	return nil
+}
+
+func (m *LatestMerger) stopAPI(ctx context.Context) {
+	if m.api == nil {
+		return
+	}
+	if err := m.api.Shutdown(ctx); err != nil {
+		log.Printf("%s event=api_error op=shutdown error=%v", logPrefix, err)
+	}
+}
+
+func (m *LatestMerger) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /latest/{vin}", m.handleDevice)
+	mux.HandleFunc("GET /latest", m.handleProjection)
+	mux.HandleFunc("GET /stats", m.handleStats)
+	return m.whenReady(mux)
+}
+
+// whenReady answers 503 until init has restored and bootstrapped state, so clients never read a partial one.
+func (m *LatestMerger) whenReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.ready.Load() {
+			http.Error(w, "state loading", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *LatestMerger) handleDevice(w http.ResponseWriter, r *http.Request) {
+	vin := r.PathValue("vin")
+	s := m.shardFor(vin)
+	s.mu.Lock()
+	dev := s.devices[vin]
+	var metrics map[string]model.MetricValue
+	if dev != nil {
+		metrics = copyMetrics(dev.Metrics, nil)
+	}
+	s.mu.Unlock()
+
+	if dev == nil {
+		http.Error(w, "unknown vin", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, model.Payload{
+		NumOfData:  1,
+		Data:       model.Data{ID: vin, Metrics: metrics},
+		ProducedAt: time.Now().UnixMilli(),
+	})
+}
+
+func (m *LatestMerger) handleProjection(w http.ResponseWriter, r *http.Request) {
+	var sensors map[string]struct{}
+	for _, v := range r.URL.Query()["sensor"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if sensors == nil {
+					sensors = make(map[string]struct{})
+				}
+				sensors[name] = struct{}{}
+			}
+		}
+	}
+
+	var data []model.Data
+	m.initShards()
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for vin, dev := range s.devices {
+			metrics := copyMetrics(dev.Metrics, sensors)
+			if len(metrics) == 0 && sensors != nil {
+				continue
+			}
+			data = append(data, model.Data{ID: vin, Metrics: metrics})
+		}
+		s.mu.Unlock()
+	}
+
+	sort.Slice(data, func(i, j int) bool { return data[i].ID < data[j].ID })
+	writeJSON(w, model.PayloadBatch{NumOfData: len(data), Data: data, ProducedAt: time.Now().UnixMilli()})
+}
+
+func (m *LatestMerger) handleStats(w http.ResponseWriter, r *http.Request) {
+	var st Stats
+	m.initShards()
+	st.Shards = len(m.shards)
+	for _, s := range m.shards {
+		s.mu.Lock()
+		st.Devices += len(s.devices)
+		for _, dev := range s.devices {
+			st.Sensors += len(dev.Metrics)
+		}
+		s.mu.Unlock()
+	}
+
+	m.statsMu.Lock()
+	st.EvictedTotal = make(map[string]int64, len(m.evictedTotal))
+	for reason, n := range m.evictedTotal {
+		st.EvictedTotal[reason] = n
+	}
+	st.Outcomes.Applied = m.outcomeTotal.Applied
+	st.Outcomes.Stale = m.outcomeTotal.Stale
+	st.Outcomes.Duplicate = m.outcomeTotal.Duplicate
+	m.statsMu.Unlock()
+
+	writeJSON(w, st)
+}
+
+// copyMetrics copies metrics, keeping only the given sensors when sensors is non-nil.
+func copyMetrics(metrics map[string]model.MetricValue, sensors map[string]struct{}) map[string]model.MetricValue {
+	out := make(map[string]model.MetricValue, len(metrics))
+	for k, v := range metrics {
+		if sensors != nil {
+			if _, ok := sensors[k]; !ok {
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%s event=api_error op=encode error=%v", logPrefix, err)
+	}
+}
@@ -0,0 +1,89 @@
+package processors
+
+import (
+	"bethos/internal/model"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newAPITestMerger(t *testing.T) *LatestMerger {
+	t.Helper()
+	m := &LatestMerger{Shards: 4}
+	if err := m.init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+		"odometer": {Value: "1000", ReceivedAt: 100}, "door_status": {Value: "Open", ReceivedAt: 100},
+	}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN2", Metrics: map[string]model.MetricValue{
+		"door_status": {Value: "Closed", ReceivedAt: 200},
+	}}})
+	return m
+}
+
+func apiGet(t *testing.T, m *LatestMerger, path string, out any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if out != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("GET %s: decode %q: %v", path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestLatestMergerAPI_Device(t *testing.T) {
+	m := newAPITestMerger(t)
+
+	var p model.Payload
+	if code := apiGet(t, m, "/latest/VIN1", &p); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if p.Data.ID != "VIN1" || len(p.Data.Metrics) != 2 || p.Data.Metrics["odometer"].Value != "1000" {
+		t.Errorf("payload = %+v", p)
+	}
+
+	if code := apiGet(t, m, "/latest/VIN9", nil); code != http.StatusNotFound {
+		t.Errorf("unknown vin: status = %d, want 404", code)
+	}
+}
+
+func TestLatestMergerAPI_Projection(t *testing.T) {
+	m := newAPITestMerger(t)
+
+	var pb model.PayloadBatch
+	if code := apiGet(t, m, "/latest?sensor=odometer", &pb); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if pb.NumOfData != 1 || pb.Data[0].ID != "VIN1" || len(pb.Data[0].Metrics) != 1 {
+		t.Errorf("projection odometer = %+v, want VIN1 with odometer only", pb)
+	}
+
+	pb = model.PayloadBatch{}
+	apiGet(t, m, "/latest?sensor=door_status,odometer", &pb)
+	if pb.NumOfData != 2 || pb.Data[0].ID != "VIN1" || pb.Data[1].ID != "VIN2" {
+		t.Errorf("projection door_status,odometer = %+v, want VIN1 and VIN2 in order", pb)
+	}
+}
+
+func TestLatestMergerAPI_Stats(t *testing.T) {
+	m := newAPITestMerger(t)
+
+	var st Stats
+	if code := apiGet(t, m, "/stats", &st); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if st.Devices != 2 || st.Sensors != 3 || st.Shards != 4 {
+		t.Errorf("stats = %+v, want 2 devices, 3 sensors, 4 shards", st)
+	}
+}
+
+func TestLatestMergerAPI_UnavailableUntilInit(t *testing.T) {
+	m := &LatestMerger{}
+	if code := apiGet(t, m, "/stats", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("status before init = %d, want 503", code)
+	}
+}
@@ -0,0 +1,87 @@
+package processors
+
+import (
+	"bethos/internal/model"
+	"fmt"
+	"reflect"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// Update outcomes: what merge did with one incoming sensor value.
+const (
+	OutcomeApplied   = "applied"   // stored (new sensor, or accepted by the merge policy)
+	OutcomeStale     = "stale"     // rejected by the merge policy (e.g. older received_at than the stored value)
+	OutcomeDuplicate = "duplicate" // identical to the stored value (same value, received_at and received_at_ns)
+)
+
+// Metadata set on rejected updates routed by RouteRejected. The VIN goes in rejected_vincode, not
+// vincode: outputs key device records on vincode, so a rejected single-sensor payload reaching one
+// would overwrite the device's full record.
+const (
+	MetaOutcome     = "latest_merger_outcome"
+	MetaLatenessMs  = "lateness_ms"
+	MetaRejectedVIN = "rejected_vincode"
+)
+
+// outcomeCounts counts update outcomes; MaxLatenessMs is the largest lateness among stale updates.
+type outcomeCounts struct {
+	Applied, Stale, Duplicate int64
+	MaxLatenessMs             int64
+}
+
+func (c *outcomeCounts) add(o outcomeCounts) {
+	c.Applied += o.Applied
+	c.Stale += o.Stale
+	c.Duplicate += o.Duplicate
+	if o.MaxLatenessMs > c.MaxLatenessMs {
+		c.MaxLatenessMs = o.MaxLatenessMs
+	}
+}
+
+func (c outcomeCounts) empty() bool {
+	return c.Applied == 0 && c.Stale == 0 && c.Duplicate == 0
+}
+
+// rejectedUpdate is an incoming sensor value merge did not store.
+type rejectedUpdate struct {
+	vin        string
+	sensor     string
+	metric     model.MetricValue
+	outcome    string
+	latenessMs int64
+}
+
+// sameMetric reports whether two metric values are identical, so a redelivered message is a duplicate
+// rather than an update.
+func sameMetric(a, b model.MetricValue) bool {
+	return a.ReceivedAt == b.ReceivedAt && a.ReceivedAtNs == b.ReceivedAtNs && reflect.DeepEqual(a.Value, b.Value)
+}
+
+// latenessMs is how far incoming is behind stored by received_at (0 if not behind).
+func latenessMs(stored, incoming model.MetricValue) int64 {
+	if d := stored.ReceivedAt - incoming.ReceivedAt; d > 0 {
+		return d
+	}
+	return 0
+}
+
+// rejectedMessages turns rejected updates into one message per sensor, tagged so a switch output can route
+// them (e.g. to a late-data topic).
+func rejectedMessages(rejected []rejectedUpdate, now int64) service.MessageBatch {
+	batch := make(service.MessageBatch, 0, len(rejected))
+	for _, r := range rejected {
+		msg := service.NewMessage(nil)
+		msg.SetStructured(model.Payload{
+			NumOfData:  1,
+			Data:       model.Data{ID: r.vin, Metrics: map[string]model.MetricValue{r.sensor: r.metric}},
+			ProducedAt: now,
+		})
+		msg.MetaSet(MetaRejectedVIN, r.vin)
+		msg.MetaSet("sensor", r.sensor)
+		msg.MetaSet(MetaOutcome, r.outcome)
+		msg.MetaSet(MetaLatenessMs, fmt.Sprintf("%d", r.latenessMs))
+		batch = append(batch, msg)
+	}
+	return batch
+}
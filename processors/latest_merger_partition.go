@@ -0,0 +1,178 @@
+package processors
+
+import (
+	"bethos/internal/bootstrap"
+	"bethos/internal/model"
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// noPartition marks a device or message whose source Kafka partition is unknown.
+const noPartition int32 = -1
+
+// partitionState tracks one source partition this instance consumes.
+type partitionState struct {
+	lastSeen   atomic.Int64 // unix ms of the last message from the partition
+	rebuild    sync.Once
+	rebuilding atomic.Bool // its devices are being rebuilt from the bootstrap source; flushes hold them back
+	// rebuildFailedAt is the unix ms of the last failed rebuild while it still holds the partition (with
+	// BootstrapOnErrorHold), 0 otherwise; see retryRebuilds.
+	rebuildFailedAt atomic.Int64
+}
+
+// sourcePartition returns the kafka_partition of msg and, with PartitionAware, claims the partition:
+// the first message of a partition starts rebuilding its devices from the bootstrap source in the
+// background, and flushes leave the partition's devices out until the rebuild is over. Messages merged in
+// the meantime are not lost: the rebuild goes through the merge policy like any update.
+// Returns noPartition when not partition aware or the metadata is missing.
+func (m *LatestMerger) sourcePartition(msg *service.Message) int32 {
+	if !m.PartitionAware {
+		return noPartition
+	}
+	v, ok := msg.MetaGet("kafka_partition")
+	if !ok {
+		return noPartition
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 0 {
+		return noPartition
+	}
+	p := int32(n)
+	st := m.touchPartition(p, time.Now().UnixMilli())
+	if src, ok := m.Bootstrap.(bootstrap.PartitionSource); ok {
+		st.rebuild.Do(func() {
+			st.rebuilding.Store(true)
+			m.startRebuild(src, p, st)
+		})
+	}
+	return p
+}
+
+// startRebuild rebuilds partition p in the background. On success the partition is released to flushes.
+// A failed rebuild keeps holding it with BootstrapOnErrorHold (retryRebuilds starts it again) and releases
+// it with BootstrapOnErrorContinue.
+func (m *LatestMerger) startRebuild(src bootstrap.PartitionSource, p int32, st *partitionState) {
+	m.rebuildWG.Add(1)
+	go func() {
+		defer m.rebuildWG.Done()
+		err := m.rebuildPartition(src, p)
+		// Cut short by Close: keep holding the partial devices back from the shutdown flush.
+		if m.rebuildCtx.Err() != nil {
+			return
+		}
+		if err != nil && m.bootstrapOnError() == BootstrapOnErrorHold {
+			st.rebuildFailedAt.Store(time.Now().UnixMilli())
+			return
+		}
+		st.rebuilding.Store(false)
+	}()
+}
+
+// retryRebuilds starts again the failed rebuilds of owned partitions, each at most once per
+// BootstrapRetryInterval. The partitions stay held until their rebuild succeeds.
+func (m *LatestMerger) retryRebuilds(now int64) {
+	src, ok := m.Bootstrap.(bootstrap.PartitionSource)
+	if !ok || !m.PartitionAware || m.rebuildCtx.Err() != nil {
+		return
+	}
+	m.partMu.RLock()
+	defer m.partMu.RUnlock()
+	for p, st := range m.partitions {
+		failedAt := st.rebuildFailedAt.Load()
+		if failedAt == 0 || now-failedAt < m.BootstrapRetryInterval.Milliseconds() {
+			continue
+		}
+		if st.rebuildFailedAt.CompareAndSwap(failedAt, 0) {
+			log.Printf("%s event=partition_rebuild_retry partition=%d", logPrefix, p)
+			m.startRebuild(src, p, st)
+		}
+	}
+}
+
+// touchPartition records activity on p, registering it as owned if new.
+func (m *LatestMerger) touchPartition(p int32, now int64) *partitionState {
+	m.partMu.RLock()
+	st := m.partitions[p]
+	m.partMu.RUnlock()
+	if st == nil {
+		m.partMu.Lock()
+		if st = m.partitions[p]; st == nil {
+			if m.partitions == nil {
+				m.partitions = make(map[int32]*partitionState)
+			}
+			st = &partitionState{}
+			m.partitions[p] = st
+			log.Printf("%s event=partition_assigned partition=%d", logPrefix, p)
+		}
+		m.partMu.Unlock()
+	}
+	st.lastSeen.Store(now)
+	return st
+}
+
+// ownedPartitions returns the partitions still owned at now, and those of them being rebuilt. Only with a
+// PartitionIdleTimeout are partitions idle for longer treated as revoked by a consumer group rebalance and,
+// with forget, dropped: a partition can be quiet without having moved. Returns nil, nil when not partition
+// aware.
+func (m *LatestMerger) ownedPartitions(now int64, forget bool) (owned, rebuilding map[int32]struct{}) {
+	if !m.PartitionAware {
+		return nil, nil
+	}
+
+	m.partMu.Lock()
+	defer m.partMu.Unlock()
+	owned = make(map[int32]struct{}, len(m.partitions))
+	for p, st := range m.partitions {
+		idleMs := now - st.lastSeen.Load()
+		if m.PartitionIdleTimeout > 0 && idleMs > m.PartitionIdleTimeout.Milliseconds() {
+			if forget {
+				delete(m.partitions, p)
+				log.Printf("%s event=partition_revoked partition=%d idle_ms=%d", logPrefix, p, idleMs)
+			}
+			continue
+		}
+		owned[p] = struct{}{}
+		if st.rebuilding.Load() {
+			if rebuilding == nil {
+				rebuilding = make(map[int32]struct{})
+			}
+			rebuilding[p] = struct{}{}
+		}
+	}
+	return owned, rebuilding
+}
+
+// rebuildPartition seeds the devices of partition p from src through the normal merge path. A failure is
+// logged and returned (see startRebuild). Runs until Close cancels rebuildCtx.
+func (m *LatestMerger) rebuildPartition(src bootstrap.PartitionSource, p int32) error {
+	start := time.Now()
+	ctx := m.rebuildCtx
+	if m.BootstrapTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.BootstrapTimeout)
+		defer cancel()
+	}
+
+	seeded := 0
+	err := src.LoadPartition(ctx, p, func(pl model.Payload) error {
+		if pl.Data.ID == "" {
+			return nil
+		}
+		m.mergeFrom(pl, p)
+		seeded++
+		return nil
+	})
+	durationMs := time.Since(start).Milliseconds()
+	if err != nil {
+		log.Printf("%s event=partition_rebuild_error partition=%d vin_count=%d duration_ms=%d on_error=%s error=%v", logPrefix, p, seeded, durationMs, m.bootstrapOnError(), err)
+		return err
+	}
+	log.Printf("%s event=partition_rebuild partition=%d vin_count=%d duration_ms=%d", logPrefix, p, seeded, durationMs)
+	return nil
+}
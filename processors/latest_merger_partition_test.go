@@ -0,0 +1,228 @@
+package processors
+
+import (
+	"bethos/internal/merger"
+	"bethos/internal/model"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// stubPartitionSource serves payloads per partition and counts reads. A non-nil block delays every
+// partition read until it is closed; a non-nil err fails every partition read after serving its payloads.
+type stubPartitionSource struct {
+	byPartition map[int32][]model.Payload
+	fullLoads   int
+	loads       map[int32]int
+	block       chan struct{}
+	err         error
+}
+
+func (s *stubPartitionSource) Load(_ context.Context, fn func(model.Payload) error) error {
+	s.fullLoads++
+	return nil
+}
+
+func (s *stubPartitionSource) LoadPartition(_ context.Context, partition int32, fn func(model.Payload) error) error {
+	if s.loads == nil {
+		s.loads = make(map[int32]int)
+	}
+	s.loads[partition]++
+	if s.block != nil {
+		<-s.block
+	}
+	for _, p := range s.byPartition[partition] {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return s.err
+}
+
+func partitionMessage(body, partition string) *service.Message {
+	msg := service.NewMessage([]byte(body))
+	msg.MetaSet("kafka_partition", partition)
+	return msg
+}
+
+func TestLatestMerger_Partition_RevokedPartitionDropped(t *testing.T) {
+	ctx := context.Background()
+	strat := &recordingStrategy{}
+	m := &LatestMerger{Strategy: strat, PartitionAware: true, PartitionIdleTimeout: time.Minute, Shards: 4}
+
+	for _, msg := range []*service.Message{
+		partitionMessage(`{"data":{"id":"VIN1","a":{"value":"1","received_at":1}}}`, "0"),
+		partitionMessage(`{"data":{"id":"VIN2","a":{"value":"2","received_at":1}}}`, "1"),
+		service.NewMessage([]byte(`{"data":{"id":"VIN3","a":{"value":"3","received_at":1}}}`)), // no partition meta
+	} {
+		if _, err := m.Process(ctx, msg); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	// Partition 1 went quiet: reassigned to another replica.
+	m.partitions[1].lastSeen.Store(time.Now().Add(-2 * time.Minute).UnixMilli())
+
+	if _, err := m.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	state := strat.flushes[0]
+	if _, ok := state["VIN2"]; ok || len(state) != 2 {
+		t.Errorf("flush state = %v, want VIN1 and VIN3 only", state)
+	}
+	if deviceOf(m, "VIN2") != nil {
+		t.Error("VIN2 still in state after its partition was revoked")
+	}
+	if got := m.evictedTotal[merger.EvictReasonRevoked]; got != 1 {
+		t.Errorf("evicted revoked = %d, want 1", got)
+	}
+}
+
+func TestLatestMerger_Partition_RebuildOnAssignment(t *testing.T) {
+	ctx := context.Background()
+	src := &stubPartitionSource{byPartition: map[int32][]model.Payload{
+		2: {{Data: model.Data{ID: "VIN7", Metrics: map[string]model.MetricValue{"b": {Value: "old", ReceivedAt: 1}}}}},
+	}}
+	m := &LatestMerger{Strategy: &recordingStrategy{}, PartitionAware: true, Bootstrap: src}
+
+	for i := 0; i < 2; i++ {
+		msg := partitionMessage(`{"data":{"id":"VIN7","a":{"value":"1","received_at":5}}}`, "2")
+		if _, err := m.Process(ctx, msg); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+
+	m.rebuildWG.Wait()
+	if src.fullLoads != 0 {
+		t.Errorf("full bootstrap ran %d times, want 0 (per-partition rebuild instead)", src.fullLoads)
+	}
+	if src.loads[2] != 1 {
+		t.Errorf("partition 2 rebuilt %d times, want 1", src.loads[2])
+	}
+	dev := deviceOf(m, "VIN7")
+	if len(dev.Metrics) != 2 || dev.Partition != 2 {
+		t.Errorf("VIN7 = %+v, want rebuilt sensor b plus merged a on partition 2", dev)
+	}
+}
+
+func TestLatestMerger_Partition_QuietPartitionKeptByDefault(t *testing.T) {
+	ctx := context.Background()
+	strat := &recordingStrategy{}
+	m := &LatestMerger{Strategy: strat, PartitionAware: true}
+
+	if _, err := m.Process(ctx, partitionMessage(`{"data":{"id":"VIN1","a":{"value":"1","received_at":1}}}`, "0")); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	m.partitions[0].lastSeen.Store(time.Now().Add(-24 * time.Hour).UnixMilli())
+
+	if _, err := m.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if _, ok := strat.flushes[0]["VIN1"]; !ok {
+		t.Errorf("flush state = %v, want VIN1: without partition_idle_timeout a quiet partition is still owned", strat.flushes[0])
+	}
+}
+
+func TestLatestMerger_Partition_RebuildDoesNotBlockProcessing(t *testing.T) {
+	ctx := context.Background()
+	src := &stubPartitionSource{
+		byPartition: map[int32][]model.Payload{
+			2: {{Data: model.Data{ID: "VIN7", Metrics: map[string]model.MetricValue{"b": {Value: "old", ReceivedAt: 1}}}}},
+		},
+		block: make(chan struct{}),
+	}
+	strat := &recordingStrategy{}
+	m := &LatestMerger{Strategy: strat, PartitionAware: true, Bootstrap: src, FlushMode: merger.FlushModeChangedDevices}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Process(ctx, partitionMessage(`{"data":{"id":"VIN7","a":{"value":"1","received_at":5}}}`, "2"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process blocked on the partition rebuild")
+	}
+
+	// Partial VIN7 is held back while partition 2 is rebuilt.
+	if _, err := m.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if _, ok := strat.flushes[0]["VIN7"]; ok {
+		t.Errorf("flush during rebuild = %v, want VIN7 held back", strat.flushes[0])
+	}
+
+	close(src.block)
+	m.rebuildWG.Wait()
+	if _, err := m.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if dev := strat.flushes[1]["VIN7"]; len(dev) != 2 {
+		t.Errorf("flush after rebuild: VIN7 = %v, want rebuilt sensor b plus merged a", dev)
+	}
+}
+
+func TestLatestMerger_Partition_FailedRebuild(t *testing.T) {
+	ctx := context.Background()
+	newMerger := func(onError string) (*LatestMerger, *stubPartitionSource, *recordingStrategy) {
+		src := &stubPartitionSource{
+			byPartition: map[int32][]model.Payload{
+				2: {{Data: model.Data{ID: "VIN8", Metrics: map[string]model.MetricValue{"b": {Value: "old", ReceivedAt: 1}}}}},
+			},
+			err: errors.New("broker down"),
+		}
+		strat := &recordingStrategy{}
+		m := &LatestMerger{Strategy: strat, PartitionAware: true, Bootstrap: src, BootstrapOnError: onError}
+		if _, err := m.Process(ctx, partitionMessage(`{"data":{"id":"VIN7","a":{"value":"1","received_at":5}}}`, "2")); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+		m.rebuildWG.Wait()
+		return m, src, strat
+	}
+
+	t.Run("hold", func(t *testing.T) {
+		m, src, strat := newMerger(BootstrapOnErrorHold)
+		if _, err := m.flush(ctx); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if len(strat.flushes[0]) != 0 {
+			t.Errorf("flush after a failed rebuild = %v, want partition 2 still held", strat.flushes[0])
+		}
+		m.rebuildWG.Wait() // the retry started by the flush fails too
+		if src.loads[2] != 2 {
+			t.Errorf("partition 2 read %d times, want 2 (retried by the flush)", src.loads[2])
+		}
+
+		src.err = nil
+		if _, err := m.flush(ctx); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		m.rebuildWG.Wait()
+		if _, err := m.flush(ctx); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if got := strat.flushes[2]; len(got) != 2 {
+			t.Errorf("flush after a successful retry = %v, want VIN7 and VIN8", got)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		m, src, strat := newMerger(BootstrapOnErrorContinue)
+		if _, err := m.flush(ctx); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if got := strat.flushes[0]; len(got) != 2 {
+			t.Errorf("flush = %v, want the partial partition released", got)
+		}
+		m.rebuildWG.Wait()
+		if src.loads[2] != 1 {
+			t.Errorf("partition 2 read %d times, want 1 (no retry)", src.loads[2])
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package processors
+
+import (
+	"bethos/internal/model"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"bethos/internal/snapshot"
+)
+
+// What LatestMerger does when the bootstrap fails (BootstrapOnError).
+const (
+	BootstrapOnErrorHold     = "hold"     // hold every flush and retry the bootstrap on each trigger until it succeeds
+	BootstrapOnErrorContinue = "continue" // skip the bootstrap: flush whatever state the merger has
+)
+
+// runBootstrap seeds state from m.Bootstrap through the normal merge path, so a newer value already
+// restored from the snapshot is kept. What was seeded before a failure (e.g. complete partitions) is kept.
+func (m *LatestMerger) runBootstrap() error {
+	start := time.Now()
+	ctx := context.Background()
+	if m.BootstrapTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.BootstrapTimeout)
+		defer cancel()
+	}
+
+	seeded := 0
+	err := m.Bootstrap.Load(ctx, func(p model.Payload) error {
+		if p.Data.ID == "" {
+			return nil
+		}
+		m.merge(p)
+		seeded++
+		return nil
+	})
+	durationMs := time.Since(start).Milliseconds()
+	if err != nil {
+		log.Printf("%s event=bootstrap_error vin_count=%d duration_ms=%d on_error=%s error=%v", logPrefix, seeded, durationMs, m.bootstrapOnError(), err)
+		return err
+	}
+	log.Printf("%s event=bootstrap vin_count=%d duration_ms=%d", logPrefix, seeded, durationMs)
+	return nil
+}
+
+func (m *LatestMerger) bootstrapOnError() string {
+	if m.BootstrapOnError == "" {
+		return BootstrapOnErrorHold
+	}
+	return m.BootstrapOnError
+}
+
+// retryBootstrap runs again a bootstrap that failed, if any, at most once per BootstrapRetryInterval (a
+// nacked trigger may come straight back). Until it succeeds flushes are held (this returns an error), so
+// devices missing from the partial state are not emitted or evicted.
+func (m *LatestMerger) retryBootstrap() error {
+	if !m.bootstrapPending.Load() {
+		return nil
+	}
+	m.bootstrapMu.Lock()
+	defer m.bootstrapMu.Unlock()
+	if !m.bootstrapPending.Load() {
+		return nil
+	}
+	if wait := m.BootstrapRetryInterval - time.Since(m.bootstrapAt); wait > 0 {
+		return fmt.Errorf("flush held until bootstrap succeeds (next retry in %s): %w", wait.Round(time.Millisecond), m.bootstrapErr)
+	}
+	m.bootstrapAt = time.Now()
+	if err := m.runBootstrap(); err != nil {
+		m.bootstrapErr = err
+		return fmt.Errorf("flush held until bootstrap succeeds: %w", err)
+	}
+	m.bootstrapPending.Store(false)
+	return nil
+}
+
+func (m *LatestMerger) restoreSnapshot() error {
+	f, err := snapshot.Load(m.SnapshotPath)
+	if errors.Is(err, snapshot.ErrCorrupt) {
+		// Unreadable (e.g. truncated): keep it for inspection and start empty rather than failing every message.
+		aside, mvErr := snapshot.MoveAside(m.SnapshotPath)
+		if mvErr != nil {
+			log.Printf("%s event=snapshot_error op=move_aside path=%s error=%v", logPrefix, m.SnapshotPath, mvErr)
+			return err
+		}
+		log.Printf("%s event=snapshot_error op=load path=%s moved_to=%s note=starting_empty error=%v", logPrefix, m.SnapshotPath, aside, err)
+		return nil
+	}
+	if err != nil {
+		log.Printf("%s event=snapshot_error op=load path=%s error=%v", logPrefix, m.SnapshotPath, err)
+		return err
+	}
+	if f == nil {
+		log.Printf("%s event=snapshot_restore path=%s vin_count=0 note=no_snapshot", logPrefix, m.SnapshotPath)
+		return nil
+	}
+
+	// Oldest first, so the LRU order matches LastSeen.
+	vins := make([]string, 0, len(f.Devices))
+	for vin := range f.Devices {
+		vins = append(vins, vin)
+	}
+	sort.Slice(vins, func(i, j int) bool { return f.Devices[vins[i]].LastSeen < f.Devices[vins[j]].LastSeen })
+
+	now := time.Now().UnixMilli()
+	for _, vin := range vins {
+		d := f.Devices[vin]
+		if d.Partition != nil && m.PartitionAware {
+			// Owned until proven idle, so restored devices survive until their partition's messages resume.
+			m.touchPartition(*d.Partition, now)
+		}
+		s := m.shardFor(vin)
+		s.mu.Lock()
+		dev := s.upsertLocked(vin, d.LastSeen)
+		if d.Partition != nil {
+			dev.Partition = *d.Partition
+		}
+		delta := s.delta()
+		for k, v := range d.Metrics {
+			dev.Metrics[k] = v
+			if delta {
+				// The snapshot may be newer than the last flush; emit it again rather than risk a gap.
+				dev.markDirty(k)
+			}
+		}
+		dev.LastSeen = d.LastSeen
+		s.mu.Unlock()
+	}
+
+	log.Printf("%s event=snapshot_restore path=%s version=%d saved_at=%d vin_count=%d",
+		logPrefix, m.SnapshotPath, f.Version, f.SavedAt, len(f.Devices))
+	return nil
+}
+
+// saveSnapshot copies state one shard at a time and writes it outside the locks so ingestion is not
+// blocked by disk I/O.
+func (m *LatestMerger) saveSnapshot() error {
+	start := time.Now()
+
+	m.initShards()
+	f := &snapshot.File{
+		SavedAt: start.UnixMilli(),
+		Devices: make(map[string]snapshot.Device),
+	}
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for vin, dev := range s.devices {
+			copyDev := make(map[string]model.MetricValue, len(dev.Metrics))
+			for k, v := range dev.Metrics {
+				copyDev[k] = v
+			}
+			d := snapshot.Device{Metrics: copyDev, LastSeen: dev.LastSeen}
+			if dev.Partition != noPartition {
+				partition := dev.Partition
+				d.Partition = &partition
+			}
+			f.Devices[vin] = d
+		}
+		s.mu.Unlock()
+	}
+
+	if err := snapshot.Save(m.SnapshotPath, f); err != nil {
+		log.Printf("%s event=snapshot_error op=save path=%s error=%v", logPrefix, m.SnapshotPath, err)
+		return err
+	}
+	log.Printf("%s event=snapshot_save path=%s vin_count=%d duration_ms=%d",
+		logPrefix, m.SnapshotPath, len(f.Devices), time.Since(start).Milliseconds())
+	return nil
+}
+
+func (m *LatestMerger) snapshotLoop() {
+	defer m.snapshotWG.Done()
+	t := time.NewTicker(m.SnapshotInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stopSnapshot:
+			return
+		case <-t.C:
+			_ = m.saveSnapshot()
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package processors
+
+import (
+	"bethos/internal/merger"
+	"bethos/internal/model"
+	"container/list"
+	"sync"
+	"time"
+)
+
+type DeviceState struct {
+	Metrics   map[string]model.MetricValue
+	LastSeen  int64
+	Partition int32 // source Kafka partition; noPartition if unknown
+
+	elem      *list.Element       // position in mergerShard.lru
+	dirty     map[string]struct{} // sensors updated since the last successful flush; only tracked in changed_* flush modes
+	published string              // model.ContentHash of the device as last flushed; only tracked with SkipUnchanged
+}
+
+// markDirty records that sensor was updated since the last successful flush.
+func (d *DeviceState) markDirty(sensor string) {
+	if d.dirty == nil {
+		d.dirty = make(map[string]struct{})
+	}
+	d.dirty[sensor] = struct{}{}
+}
+
+// mergerShard holds the devices whose VIN hashes to it. Each shard has its own lock, so merges for
+// different shards never contend and a flush only holds one shard at a time.
+type mergerShard struct {
+	mu             sync.Mutex
+	devices        map[string]*DeviceState
+	lru            *list.List // of vin; front = most recently seen
+	maxDevices     int        // 0 = unlimited
+	trackEvictions bool       // keep Eviction records for a merger.EvictionListener
+	flushMode      string     // merger.FlushMode*; "" = full
+
+	evicted   map[string]int // reason -> count since last flush
+	evictions []merger.Eviction
+	outcomes  outcomeCounts // since last flush
+}
+
+// shardFlush is what one shard contributes to a flush.
+type shardFlush struct {
+	state     merger.FlushState
+	evicted   map[string]int
+	evictions []merger.Eviction
+	outcomes  outcomeCounts
+	dirty     map[string]map[string]struct{} // vin -> sensors taken from the devices, restored if the flush fails
+	hashes    map[string]string              // vin -> content hash of the device flushed (skipUnchanged), see markPublished
+}
+
+// vinHash is FNV-1a over the VIN, inlined to keep the merge path allocation free.
+func vinHash(vin string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(vin); i++ {
+		h ^= uint32(vin[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// initShards creates the shards on first use so a LatestMerger literal works without a constructor.
+// MaxDevices is split evenly across shards (rounded up), so the cap is approximate by at most Shards-1.
+func (m *LatestMerger) initShards() {
+	m.shardsOnce.Do(func() {
+		n := m.Shards
+		if n <= 0 {
+			n = 1
+		}
+		perShard := 0
+		if m.MaxDevices > 0 {
+			perShard = (m.MaxDevices + n - 1) / n
+		}
+		_, track := m.Strategy.(merger.EvictionListener)
+		m.shards = make([]*mergerShard, n)
+		for i := range m.shards {
+			m.shards[i] = &mergerShard{
+				devices:        make(map[string]*DeviceState),
+				lru:            list.New(),
+				maxDevices:     perShard,
+				trackEvictions: track,
+				flushMode:      m.FlushMode,
+			}
+		}
+	})
+}
+
+func (m *LatestMerger) shardFor(vin string) *mergerShard {
+	m.initShards()
+	return m.shards[vinHash(vin)%uint32(len(m.shards))]
+}
+
+// HasDevice reports whether vin is in state, whether or not the next flush carries it.
+func (m *LatestMerger) HasDevice(vin string) bool {
+	s := m.shardFor(vin)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[vin] != nil
+}
+
+// deviceCount returns the number of devices across all shards.
+func (m *LatestMerger) deviceCount() int {
+	m.initShards()
+	n := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		n += len(s.devices)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// upsertLocked returns the device for vin, creating it (and evicting over capacity) if needed, and marks it
+// most recently seen. Must hold s.mu.
+func (s *mergerShard) upsertLocked(vin string, now int64) *DeviceState {
+	dev := s.devices[vin]
+	if dev != nil {
+		s.lru.MoveToFront(dev.elem)
+		return dev
+	}
+	dev = &DeviceState{
+		Metrics:   make(map[string]model.MetricValue),
+		LastSeen:  now,
+		Partition: noPartition,
+	}
+	dev.elem = s.lru.PushFront(vin)
+	s.devices[vin] = dev
+	s.evictOverCapacityLocked()
+	return dev
+}
+
+// evictOverCapacityLocked drops least recently seen devices while the shard exceeds maxDevices. Must hold s.mu.
+func (s *mergerShard) evictOverCapacityLocked() {
+	if s.maxDevices <= 0 {
+		return
+	}
+	for len(s.devices) > s.maxDevices {
+		back := s.lru.Back()
+		if back == nil {
+			return
+		}
+		vin := back.Value.(string)
+		s.removeLocked(vin, s.devices[vin], merger.EvictReasonCapacity)
+	}
+}
+
+// removeLocked deletes a device and counts the eviction. Must hold s.mu.
+func (s *mergerShard) removeLocked(vin string, dev *DeviceState, reason string) {
+	delete(s.devices, vin)
+	if dev != nil && dev.elem != nil {
+		s.lru.Remove(dev.elem)
+	}
+	if s.evicted == nil {
+		s.evicted = make(map[string]int)
+	}
+	s.evicted[reason]++
+	if s.trackEvictions {
+		s.evictions = append(s.evictions, merger.Eviction{VIN: vin, Reason: reason, At: time.Now().UnixMilli()})
+	}
+}
+
+// delta reports whether the shard tracks dirty sensors (a changed_* flush mode).
+func (s *mergerShard) delta() bool {
+	return s.flushMode == merger.FlushModeChangedDevices || s.flushMode == merger.FlushModeChangedSensors
+}
+
+// collectOptions parameterizes mergerShard.collect for one flush.
+type collectOptions struct {
+	now, ttl   int64
+	basis      string
+	owned      map[int32]struct{}  // partitions still consumed; nil = not partition aware
+	rebuilding map[int32]struct{}  // owned partitions being rebuilt: their devices are held back
+	scope      map[string]struct{} // only these VINs; nil = all
+	full       bool                // ignore the changed_* flush mode and take whole devices
+	dryRun     bool                // count only: evict nothing and keep dirty marks and counters
+
+	skipUnchanged bool // leave out devices whose content hash equals the one last flushed
+}
+
+// collect evicts expired devices, and devices of partitions no longer owned, skips those of partitions being
+// rebuilt (keeping their dirty marks), then deep-copies the rest (or,
+// in a changed_* flush mode, the dirty part), holding only this shard's lock. Dirty marks move to the result;
+// see restoreDirty. With dryRun, the would-be evictions are only counted in the result.
+func (s *mergerShard) collect(opts collectOptions) shardFlush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delta := s.delta() && !opts.full
+	out := shardFlush{state: make(merger.FlushState)}
+	if s.delta() && !opts.dryRun {
+		out.dirty = make(map[string]map[string]struct{})
+	}
+	evict := func(vin string, dev *DeviceState, reason string) {
+		if opts.dryRun {
+			if out.evicted == nil {
+				out.evicted = make(map[string]int)
+			}
+			out.evicted[reason]++
+			return
+		}
+		s.removeLocked(vin, dev, reason)
+	}
+	for vin, dev := range s.devices {
+		if opts.scope != nil {
+			if _, ok := opts.scope[vin]; !ok {
+				continue
+			}
+		}
+		if deviceExpired(dev, opts.now, opts.ttl, opts.basis) {
+			evict(vin, dev, merger.EvictReasonTTL)
+			continue
+		}
+		if opts.owned != nil && dev.Partition != noPartition {
+			if _, ok := opts.owned[dev.Partition]; !ok {
+				evict(vin, dev, merger.EvictReasonRevoked)
+				continue
+			}
+			if _, ok := opts.rebuilding[dev.Partition]; ok {
+				continue
+			}
+		}
+		if delta && len(dev.dirty) == 0 {
+			continue
+		}
+		var hash string
+		if opts.skipUnchanged {
+			hash, _ = model.ContentHash(model.Data{ID: vin, Metrics: dev.Metrics})
+			if hash != "" && hash == dev.published {
+				if !opts.dryRun {
+					dev.dirty = nil
+				}
+				continue
+			}
+		}
+
+		copyDev := make(map[string]model.MetricValue, len(dev.Metrics))
+		for k, v := range dev.Metrics {
+			if delta && s.flushMode == merger.FlushModeChangedSensors {
+				if _, ok := dev.dirty[k]; !ok {
+					continue
+				}
+			}
+			copyDev[k] = v
+		}
+		out.state[vin] = copyDev
+		if hash != "" && !opts.dryRun {
+			if out.hashes == nil {
+				out.hashes = make(map[string]string)
+			}
+			out.hashes[vin] = hash
+		}
+		if out.dirty != nil && dev.dirty != nil {
+			out.dirty[vin] = dev.dirty
+			dev.dirty = nil
+		}
+	}
+	if opts.dryRun {
+		return out
+	}
+	out.evicted, out.evictions = s.evicted, s.evictions
+	s.evicted, s.evictions = nil, nil
+	out.outcomes, s.outcomes = s.outcomes, outcomeCounts{}
+	return out
+}
+
+// restoreDirty puts back dirty marks taken by a flush that failed, so the next flush emits them again.
+// Devices evicted in the meantime are skipped.
+func (s *mergerShard) restoreDirty(dirty map[string]map[string]struct{}) {
+	if len(dirty) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for vin, sensors := range dirty {
+		dev := s.devices[vin]
+		if dev == nil {
+			continue
+		}
+		for sensor := range sensors {
+			dev.markDirty(sensor)
+		}
+	}
+}
+
+// markPublished records the content hashes of a successful flush, so the next one can skip devices that
+// have not changed since. Devices evicted in the meantime are skipped.
+func (s *mergerShard) markPublished(hashes map[string]string) {
+	if len(hashes) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for vin, hash := range hashes {
+		if dev := s.devices[vin]; dev != nil {
+			dev.published = hash
+		}
+	}
+}
+
+// deviceExpired reports whether dev is older than ttl, measured per basis. Devices without metrics
+// fall back to LastSeen.
+func deviceExpired(dev *DeviceState, now, ttl int64, basis string) bool {
+	ref := dev.LastSeen
+	if basis == TTLBasisReceivedAt && len(dev.Metrics) > 0 {
+		ref = 0
+		for _, mv := range dev.Metrics {
+			if mv.ReceivedAt > ref {
+				ref = mv.ReceivedAt
+			}
+		}
+	}
+	return now-ref > ttl
+}
@@ -4,13 +4,28 @@ import (
 	"bethos/internal/model"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"bethos/internal/merger"
+	"bethos/internal/snapshot"
 
 	"github.com/warpstreamlabs/bento/public/service"
 )
 
+// deviceOf returns the merged state of vin (nil if absent), for assertions in tests.
+func deviceOf(m *LatestMerger, vin string) *DeviceState {
+	s := m.shardFor(vin)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[vin]
+}
+
 func TestIsFlushTrigger(t *testing.T) {
 	tests := []struct {
 		name string
@@ -149,7 +164,7 @@ func TestLatestMerger_Merge_LatestWins(t *testing.T) {
 }
 
 func TestLatestMerger_Merge_NewerReceivedAtWins(t *testing.T) {
-	m := &LatestMerger{state: make(map[string]*DeviceState)}
+	m := &LatestMerger{}
 
 	// Merge older first
 	m.merge(model.Payload{
@@ -170,9 +185,7 @@ func TestLatestMerger_Merge_NewerReceivedAtWins(t *testing.T) {
 		},
 	})
 
-	m.mu.Lock()
-	dev := m.state["VIN1"]
-	m.mu.Unlock()
+	dev := deviceOf(m, "VIN1")
 	if dev == nil {
 		t.Fatal("state[VIN1] is nil")
 	}
@@ -187,7 +200,7 @@ func TestLatestMerger_Merge_NewerReceivedAtWins(t *testing.T) {
 }
 
 func TestLatestMerger_Merge_OlderDoesNotOverwrite(t *testing.T) {
-	m := &LatestMerger{state: make(map[string]*DeviceState)}
+	m := &LatestMerger{}
 
 	m.merge(model.Payload{
 		Data: model.Data{
@@ -206,9 +219,7 @@ func TestLatestMerger_Merge_OlderDoesNotOverwrite(t *testing.T) {
 		},
 	})
 
-	m.mu.Lock()
-	dev := m.state["VIN1"]
-	m.mu.Unlock()
+	dev := deviceOf(m, "VIN1")
 	val, _ := dev.Metrics["sensor_x"].Value.(string)
 	if val != "newer" {
 		t.Errorf("older message overwrote newer: Value = %q, want \"newer\"", val)
@@ -264,14 +275,12 @@ func TestLatestMerger_Flush_TwoVINs(t *testing.T) {
 }
 
 func TestLatestMerger_Merge_EmptyVINIgnored(t *testing.T) {
-	m := &LatestMerger{state: make(map[string]*DeviceState)}
+	m := &LatestMerger{}
 
 	m.merge(model.Payload{Data: model.Data{ID: ""}})
 	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"s": {ReceivedAt: 1}}}})
 
-	m.mu.Lock()
-	n := len(m.state)
-	m.mu.Unlock()
+	n := m.deviceCount()
 	if n != 1 {
 		t.Errorf("expected 1 VIN in state (empty id ignored), got %d", n)
 	}
@@ -304,3 +313,592 @@ func TestPayloadRoundtrip(t *testing.T) {
 		t.Errorf("len(Metrics) = %d, want 1", len(decoded.Data.Metrics))
 	}
 }
+
+func TestLatestMerger_Snapshot_RestoredAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "latest_merger.json")
+
+	m1 := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, SnapshotPath: path}
+	body := `{"num_of_data":1,"data":{"id":"VIN1","sensor_a":{"value":"1","received_at":100}},"produced_at":1}`
+	if _, err := m1.Process(ctx, service.NewMessage([]byte(body))); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if err := m1.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// New instance (restart): flush must emit VIN1 without any new input.
+	m2 := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, SnapshotPath: path}
+	batch, err := m2.Process(ctx, service.NewMessage([]byte(`{"_flush":true}`)))
+	if err != nil {
+		t.Fatalf("flush after restart: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 message after restore, got %d", len(batch))
+	}
+	if vin, _ := batch[0].MetaGet("vincode"); vin != "VIN1" {
+		t.Errorf("vincode = %q, want VIN1", vin)
+	}
+}
+
+func TestLatestMerger_Snapshot_SavedWhenShutdownFlushFails(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "latest_merger.json")
+
+	m1 := &LatestMerger{Strategy: &recordingStrategy{err: errors.New("broker down")}, SnapshotPath: path}
+	body := `{"num_of_data":1,"data":{"id":"VIN1","sensor_a":{"value":"1","received_at":100}},"produced_at":1}`
+	if _, err := m1.Process(ctx, service.NewMessage([]byte(body))); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if err := m1.Close(ctx); err == nil {
+		t.Fatal("Close: want the shutdown flush error")
+	}
+
+	m2 := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, SnapshotPath: path}
+	batch, err := m2.Process(ctx, service.NewMessage([]byte(`{"_flush":true}`)))
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("flush after restart = %d messages, %v; want VIN1 from the snapshot", len(batch), err)
+	}
+}
+
+func TestLatestMerger_Snapshot_CorruptStartsEmpty(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "latest_merger.json")
+	if err := os.WriteFile(path, []byte(`{"version":2,"devi`), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, SnapshotPath: path}
+	body := `{"num_of_data":1,"data":{"id":"VIN1","sensor_a":{"value":"1","received_at":100}},"produced_at":1}`
+	if _, err := m.Process(ctx, service.NewMessage([]byte(body))); err != nil {
+		t.Fatalf("Process with a corrupt snapshot: %v", err)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt snapshot not moved aside: %v", err)
+	}
+	if err := m.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if f, err := snapshot.Load(path); err != nil || len(f.Devices) != 1 {
+		t.Errorf("snapshot after Close = %v, %v; want VIN1", f, err)
+	}
+}
+
+type stubBootstrap []model.Payload
+
+func (s stubBootstrap) Load(_ context.Context, fn func(model.Payload) error) error {
+	for _, p := range s {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLatestMerger_Bootstrap_SeedsBeforeFirstMessage(t *testing.T) {
+	ctx := context.Background()
+	seed := stubBootstrap{
+		{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+			"sensor_a": {Value: "seeded", ReceivedAt: 100},
+			"sensor_b": {Value: "seeded", ReceivedAt: 100},
+		}}},
+	}
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Bootstrap: seed}
+
+	// Live data newer than the seed wins; sensors only in the seed are kept.
+	body := `{"num_of_data":1,"data":{"id":"VIN1","sensor_a":{"value":"live","received_at":200}},"produced_at":2}`
+	if _, err := m.Process(ctx, service.NewMessage([]byte(body))); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	dev := deviceOf(m, "VIN1")
+	if dev == nil {
+		t.Fatal("state[VIN1] is nil")
+	}
+	if v, _ := dev.Metrics["sensor_a"].Value.(string); v != "live" {
+		t.Errorf("sensor_a = %q, want live", v)
+	}
+	if v, _ := dev.Metrics["sensor_b"].Value.(string); v != "seeded" {
+		t.Errorf("sensor_b = %q, want seeded", v)
+	}
+}
+
+// flakyBootstrap seeds its payloads after failing the first fails loads.
+type flakyBootstrap struct {
+	fails int
+	seed  stubBootstrap
+	loads int
+}
+
+func (s *flakyBootstrap) Load(ctx context.Context, fn func(model.Payload) error) error {
+	s.loads++
+	if s.loads <= s.fails {
+		return errors.New("bootstrap timeout")
+	}
+	return s.seed.Load(ctx, fn)
+}
+
+func TestLatestMerger_Bootstrap_FailureHoldsFlushes(t *testing.T) {
+	ctx := context.Background()
+	seed := stubBootstrap{{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"s": {Value: 1, ReceivedAt: 100}}}}}
+	boot := &flakyBootstrap{fails: 2, seed: seed}
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Bootstrap: boot}
+
+	body := `{"num_of_data":1,"data":{"id":"VIN2","s":{"value":2,"received_at":200}},"produced_at":2}`
+	if _, err := m.Process(ctx, service.NewMessage([]byte(body))); err != nil {
+		t.Fatalf("Process: %v (merging goes on while the bootstrap is pending)", err)
+	}
+	trigger := service.NewMessage([]byte(`{"_flush":true}`))
+	if batch, err := m.Process(ctx, trigger); err == nil || len(batch) != 0 {
+		t.Fatalf("flush with a failed bootstrap = %d messages, %v; want held", len(batch), err)
+	}
+	batch, err := m.Process(ctx, trigger)
+	if err != nil || len(batch) != 2 || boot.loads != 3 {
+		t.Fatalf("flush after the retried bootstrap = %d messages, %v (loads %d); want VIN1 and VIN2", len(batch), err, boot.loads)
+	}
+
+	// continue: the failure is logged and flushes go on with what was merged.
+	boot = &flakyBootstrap{fails: 1, seed: seed}
+	m = &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Bootstrap: boot, BootstrapOnError: BootstrapOnErrorContinue}
+	if _, err := m.Process(ctx, service.NewMessage([]byte(body))); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if batch, err := m.Process(ctx, trigger); err != nil || len(batch) != 1 || boot.loads != 1 {
+		t.Errorf("flush = %d messages, %v (loads %d); want VIN2 only, no retry", len(batch), err, boot.loads)
+	}
+}
+
+func TestLatestMerger_Bootstrap_RetryInterval(t *testing.T) {
+	ctx := context.Background()
+	boot := &flakyBootstrap{fails: 1}
+	m := &LatestMerger{Strategy: &recordingStrategy{}, Bootstrap: boot, BootstrapRetryInterval: time.Hour}
+
+	trigger := service.NewMessage([]byte(`{"_flush":true}`))
+	for i := 0; i < 3; i++ {
+		if _, err := m.Process(ctx, trigger); err == nil {
+			t.Fatalf("flush %d: want held", i)
+		}
+	}
+	if boot.loads != 1 {
+		t.Errorf("bootstrap loads = %d, want 1: no retry before bootstrap_retry_interval", boot.loads)
+	}
+}
+
+func TestLatestMerger_Flush_TTLEviction(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, DeviceTTL: 10 * time.Minute}
+	m.merge(model.Payload{Data: model.Data{ID: "VIN_FRESH", Metrics: map[string]model.MetricValue{"s": {ReceivedAt: now}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN_OLD", Metrics: map[string]model.MetricValue{"s": {ReceivedAt: now}}}})
+
+	deviceOf(m, "VIN_FRESH").LastSeen = now - (5 * time.Minute).Milliseconds()
+	deviceOf(m, "VIN_OLD").LastSeen = now - (11 * time.Minute).Milliseconds()
+
+	batch, err := m.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 message (VIN_OLD evicted), got %d", len(batch))
+	}
+	if vin, _ := batch[0].MetaGet("vincode"); vin != "VIN_FRESH" {
+		t.Errorf("vincode = %q, want VIN_FRESH", vin)
+	}
+	m.statsMu.Lock()
+	total := m.evictedTotal[merger.EvictReasonTTL]
+	m.statsMu.Unlock()
+	if total != 1 {
+		t.Errorf("ttl evictions = %d, want 1", total)
+	}
+}
+
+func TestLatestMerger_Flush_TTLBasisReceivedAt(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+	m := &LatestMerger{
+		Strategy:  &merger.LogCompactedFlushStrategy{},
+		DeviceTTL: 10 * time.Minute,
+		TTLBasis:  TTLBasisReceivedAt,
+	}
+	// Arrives now, but carries telemetry from an hour ago (e.g. replayed backlog).
+	stale := now - time.Hour.Milliseconds()
+	m.merge(model.Payload{Data: model.Data{ID: "VIN_REPLAY", Metrics: map[string]model.MetricValue{"s": {ReceivedAt: stale}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN_LIVE", Metrics: map[string]model.MetricValue{"s": {ReceivedAt: now}}}})
+
+	batch, err := m.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 message (VIN_REPLAY evicted), got %d", len(batch))
+	}
+	if vin, _ := batch[0].MetaGet("vincode"); vin != "VIN_LIVE" {
+		t.Errorf("vincode = %q, want VIN_LIVE", vin)
+	}
+}
+
+func TestLatestMerger_Merge_MaxDevicesEvictsLeastRecentlySeen(t *testing.T) {
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, MaxDevices: 2}
+	for _, vin := range []string{"VIN1", "VIN2", "VIN1", "VIN3"} {
+		m.merge(model.Payload{Data: model.Data{ID: vin, Metrics: map[string]model.MetricValue{"s": {ReceivedAt: 1}}}})
+	}
+
+	if n := m.deviceCount(); n != 2 {
+		t.Fatalf("device count = %d, want 2", n)
+	}
+	// VIN1 was touched again before VIN3 arrived, so VIN2 is the least recently seen.
+	if deviceOf(m, "VIN2") != nil {
+		t.Error("VIN2 should have been evicted")
+	}
+
+	// Per-reason counters are aggregated on flush.
+	if _, err := m.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	if m.evictedTotal[merger.EvictReasonCapacity] != 1 {
+		t.Errorf("capacity evictions = %d, want 1", m.evictedTotal[merger.EvictReasonCapacity])
+	}
+}
+
+func TestLatestMerger_Flush_TombstoneForExpiredDevice(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{Tombstones: true}}
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"s": {ReceivedAt: 1}}}})
+	deviceOf(m, "VIN1").LastSeen = time.Now().Add(-time.Hour).UnixMilli()
+
+	batch, err := m.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 tombstone, got %d messages", len(batch))
+	}
+	if v, _ := batch[0].MetaGet("tombstone"); v != "true" {
+		t.Errorf("meta tombstone = %q, want true", v)
+	}
+}
+
+func TestLatestMerger_Shards_ConcurrentMergeAndFlush(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{}, Shards: 8}
+
+	const producers, vinsPerProducer = 4, 250
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < vinsPerProducer; i++ {
+				m.merge(model.Payload{Data: model.Data{
+					ID:      fmt.Sprintf("VIN%d_%d", p, i),
+					Metrics: map[string]model.MetricValue{"s": {Value: i, ReceivedAt: int64(i)}},
+				}})
+				if i%50 == 0 {
+					_, _ = m.flush(ctx)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	batch, err := m.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(batch) != producers*vinsPerProducer {
+		t.Errorf("flush emitted %d devices, want %d", len(batch), producers*vinsPerProducer)
+	}
+}
+
+// recordingStrategy keeps the state of every flush and fails while err is set.
+type recordingStrategy struct {
+	err     error
+	flushes []merger.FlushState
+}
+
+func (s *recordingStrategy) Close(ctx context.Context) error { return nil }
+
+func (s *recordingStrategy) OnFlush(ctx context.Context, state merger.FlushState) (service.MessageBatch, error) {
+	s.flushes = append(s.flushes, state)
+	return nil, s.err
+}
+
+func TestLatestMerger_FlushMode_ChangedDevices(t *testing.T) {
+	ctx := context.Background()
+	strat := &recordingStrategy{}
+	m := &LatestMerger{Strategy: strat, FlushMode: merger.FlushModeChangedDevices, Shards: 4}
+
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 1, ReceivedAt: 1}, "b": {Value: 1, ReceivedAt: 1}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN2", Metrics: map[string]model.MetricValue{"a": {Value: 1, ReceivedAt: 1}}}})
+	_, _ = m.flush(ctx)
+	_, _ = m.flush(ctx)
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 2, ReceivedAt: 2}}}})
+	_, _ = m.flush(ctx)
+
+	if got := len(strat.flushes[0]); got != 2 {
+		t.Errorf("first flush: %d devices, want 2", got)
+	}
+	if got := len(strat.flushes[1]); got != 0 {
+		t.Errorf("flush without input: %d devices, want 0", got)
+	}
+	third := strat.flushes[2]
+	if len(third) != 1 || len(third["VIN1"]) != 2 {
+		t.Errorf("after VIN1 update: want VIN1 with both sensors only, got %v", third)
+	}
+}
+
+func TestLatestMerger_Diff_FailedFlushRetried(t *testing.T) {
+	ctx := context.Background()
+	other := &recordingStrategy{}
+	m := &LatestMerger{Strategy: &merger.MultiFlushStrategy{Children: []merger.MultiChild{
+		{Name: "diff", Strategy: &merger.DiffFlushStrategy{}},
+		{Name: "other", Strategy: other},
+	}}}
+	flushDiff := func() string {
+		batch, err := m.flush(ctx)
+		if err != nil {
+			return err.Error()
+		}
+		var types []string
+		for _, msg := range batch {
+			typ, _ := msg.MetaGet("diff_type")
+			types = append(types, typ)
+		}
+		return fmt.Sprint(types)
+	}
+
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 1, ReceivedAt: 1}}}})
+	if got := flushDiff(); got != "[keyframe]" {
+		t.Fatalf("first flush = %v, want a keyframe", got)
+	}
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 2, ReceivedAt: 2}}}})
+	other.err = errors.New("broker down")
+	if _, err := m.flush(ctx); err == nil {
+		t.Fatal("flush: want the other child's error")
+	}
+	other.err = nil
+	if got := flushDiff(); got != "[patch]" {
+		t.Errorf("retry of failed flush = %v, want the patch again", got)
+	}
+}
+func TestLatestMerger_FlushMode_ChangedSensors(t *testing.T) {
+	ctx := context.Background()
+	strat := &recordingStrategy{}
+	m := &LatestMerger{Strategy: strat, FlushMode: merger.FlushModeChangedSensors}
+
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 1, ReceivedAt: 1}, "b": {Value: 1, ReceivedAt: 1}}}})
+	_, _ = m.flush(ctx)
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 2, ReceivedAt: 2}, "b": {Value: 0, ReceivedAt: 0}}}})
+	_, _ = m.flush(ctx)
+
+	second := strat.flushes[1]["VIN1"]
+	if len(second) != 1 || second["a"].Value != 2 {
+		t.Errorf("want only the updated sensor a=2 (stale b ignored), got %v", second)
+	}
+	if got := len(deviceOf(m, "VIN1").Metrics); got != 2 {
+		t.Errorf("state must keep all sensors, got %d", got)
+	}
+}
+
+func TestLatestMerger_FlushMode_FailedFlushKeepsChanges(t *testing.T) {
+	ctx := context.Background()
+	strat := &recordingStrategy{err: fmt.Errorf("output down")}
+	m := &LatestMerger{Strategy: strat, FlushMode: merger.FlushModeChangedSensors}
+
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: 1, ReceivedAt: 1}}}})
+	if _, err := m.flush(ctx); err == nil {
+		t.Fatal("expected flush error")
+	}
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"b": {Value: 1, ReceivedAt: 1}}}})
+	strat.err = nil
+	if _, err := m.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if got := strat.flushes[1]["VIN1"]; len(got) != 2 {
+		t.Errorf("retry flush: want sensors a (from failed flush) and b, got %v", got)
+	}
+}
+
+func TestLatestMerger_Merge_PerSensorPolicy(t *testing.T) {
+	m := &LatestMerger{
+		Policy:   merger.FirstWritePolicy{},
+		Policies: map[string]merger.MergePolicy{"odometer": merger.MonotonicPolicy{}},
+	}
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+		"odometer": {Value: "1000", ReceivedAt: 100}, "door_status": {Value: "Open", ReceivedAt: 100},
+	}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+		"odometer": {Value: "990", ReceivedAt: 200}, "door_status": {Value: "Closed", ReceivedAt: 200},
+	}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{
+		"odometer": {Value: "1010", ReceivedAt: 300},
+	}}})
+
+	dev := deviceOf(m, "VIN1")
+	if got := dev.Metrics["odometer"].Value; got != "1010" {
+		t.Errorf("odometer = %v, want 1010 (990 rejected as going backwards)", got)
+	}
+	if got := dev.Metrics["door_status"].Value; got != "Open" {
+		t.Errorf("door_status = %v, want Open (first_write)", got)
+	}
+}
+
+func TestLatestMerger_Merge_Outcomes(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: &recordingStrategy{}}
+
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "1", ReceivedAt: 200}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "1", ReceivedAt: 200}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "0", ReceivedAt: 150}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "0", ReceivedAt: 50}}}})
+	_, _ = m.flush(ctx)
+
+	m.statsMu.Lock()
+	got := m.outcomeTotal
+	m.statsMu.Unlock()
+	want := outcomeCounts{Applied: 1, Duplicate: 1, Stale: 2, MaxLatenessMs: 150}
+	if got != want {
+		t.Errorf("outcomes = %+v, want %+v", got, want)
+	}
+}
+
+func TestLatestMerger_Process_RouteRejected(t *testing.T) {
+	ctx := context.Background()
+	m := &LatestMerger{Strategy: &recordingStrategy{}, RouteRejected: true}
+
+	batch, err := m.Process(ctx, service.NewMessage([]byte(
+		`{"num_of_data":1,"data":{"id":"VIN1","a":{"value":"new","received_at":200}},"produced_at":1}`)))
+	if err != nil || len(batch) != 0 {
+		t.Fatalf("first message: expected no side output, got %d (err=%v)", len(batch), err)
+	}
+
+	batch, err = m.Process(ctx, service.NewMessage([]byte(
+		`{"num_of_data":1,"data":{"id":"VIN1","a":{"value":"old","received_at":120},"b":{"value":"x","received_at":120}},"produced_at":2}`)))
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 rejected update (b is new), got %d", len(batch))
+	}
+	outcome, _ := batch[0].MetaGet(MetaOutcome)
+	lateness, _ := batch[0].MetaGet(MetaLatenessMs)
+	sensor, _ := batch[0].MetaGet("sensor")
+	if outcome != OutcomeStale || lateness != "80" || sensor != "a" {
+		t.Errorf("meta outcome=%q lateness_ms=%q sensor=%q, want stale/80/a", outcome, lateness, sensor)
+	}
+	if vin, _ := batch[0].MetaGet(MetaRejectedVIN); vin != "VIN1" {
+		t.Errorf("meta %s = %q, want VIN1", MetaRejectedVIN, vin)
+	}
+	if _, ok := batch[0].MetaGet("vincode"); ok {
+		t.Error("rejected update has meta vincode: it would be keyed like the device's full record")
+	}
+	if got := deviceOf(m, "VIN1").Metrics["a"].Value; got != "new" {
+		t.Errorf("a = %v, want new", got)
+	}
+}
+
+func TestLatestMerger_Process_PayloadBatchRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	upstream := &LatestMerger{Strategy: &merger.LogCompactedFlushStrategy{BatchSize: 3}}
+	for i := 0; i < 7; i++ {
+		upstream.merge(model.Payload{Data: model.Data{ID: fmt.Sprintf("VIN%d", i), Metrics: map[string]model.MetricValue{
+			"a": {Value: fmt.Sprintf("a%d", i), ReceivedAt: int64(100 + i)},
+			"b": {Value: float64(i), ReceivedAt: int64(200 + i), ReceivedAtNs: int64(i)},
+		}}})
+	}
+	batched, err := upstream.flush(ctx)
+	if err != nil {
+		t.Fatalf("upstream flush: %v", err)
+	}
+	if len(batched) != 3 {
+		t.Fatalf("expected 3 PayloadBatch messages (3+3+1), got %d", len(batched))
+	}
+
+	downstream := &LatestMerger{Strategy: &recordingStrategy{}}
+	for _, msg := range batched {
+		raw, err := msg.AsBytes()
+		if err != nil {
+			t.Fatalf("AsBytes: %v", err)
+		}
+		if _, err := downstream.Process(ctx, service.NewMessage(raw)); err != nil {
+			t.Fatalf("downstream Process: %v", err)
+		}
+	}
+	// A JSON array of payloads is accepted too.
+	if _, err := downstream.Process(ctx, service.NewMessage([]byte(
+		`[{"data":{"id":"VIN7","a":{"value":"a7","received_at":107}}},{"data":{"id":"VIN8","a":{"value":"a8","received_at":108}}}]`))); err != nil {
+		t.Fatalf("downstream Process array: %v", err)
+	}
+
+	if got := downstream.deviceCount(); got != 9 {
+		t.Fatalf("downstream has %d devices, want 9", got)
+	}
+	for i := 0; i < 7; i++ {
+		vin := fmt.Sprintf("VIN%d", i)
+		want := deviceOf(upstream, vin).Metrics
+		got := deviceOf(downstream, vin).Metrics
+		if len(got) != len(want) || got["a"] != want["a"] || got["b"] != want["b"] {
+			t.Errorf("%s: downstream %v, want %v", vin, got, want)
+		}
+	}
+}
+
+func TestLatestMerger_WindowStream_ObservesStaleValues(t *testing.T) {
+	ctx := context.Background()
+	w := merger.NewWindowStreamStrategy()
+	w.WindowSize = time.Minute
+	w.AllowedLateness = 30 * time.Second
+	m := &LatestMerger{Strategy: w}
+
+	// The 50s value is stale for the merged state but still belongs to window [0, 60s).
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "late", ReceivedAt: 50_000}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "new", ReceivedAt: 100_000}}}})
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "older", ReceivedAt: 40_000}}}})
+
+	batch, err := m.flush(ctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("got %d messages, want window [0, 60s) only", len(batch))
+	}
+	obj, _ := batch[0].AsStructured()
+	if got := obj.(model.Payload).Data.Metrics["a"].Value; got != "late" {
+		t.Errorf("window value = %v, want late (newest within the window)", got)
+	}
+	if got := deviceOf(m, "VIN1").Metrics["a"].Value; got != "new" {
+		t.Errorf("merged state = %v, want new", got)
+	}
+}
+
+func TestLatestMerger_SkipUnchanged(t *testing.T) {
+	strat := &recordingStrategy{}
+	m := triggerMerger(t, strat, merger.FlushModeFull)
+	m.SkipUnchanged = true
+
+	processTrigger(t, m, `{"_flush": true}`)
+	processTrigger(t, m, `{"_flush": true}`)
+	m.merge(model.Payload{Data: model.Data{ID: "VIN1", Metrics: map[string]model.MetricValue{"a": {Value: "2", ReceivedAt: time.Now().UnixMilli()}}}})
+	strat.err = fmt.Errorf("output down")
+	if _, err := m.Process(context.Background(), service.NewMessage([]byte(`{"_flush": true}`))); err == nil {
+		t.Fatal("expected flush error")
+	}
+	strat.err = nil
+	processTrigger(t, m, `{"_flush": true}`)
+	processTrigger(t, m, `{"_flush": true, "full": true}`)
+
+	var got []int
+	for _, f := range strat.flushes {
+		got = append(got, len(f))
+	}
+	// Both; none unchanged; VIN1 (failed); VIN1 again; both (full trigger).
+	if want := []int{2, 0, 1, 1, 2}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("devices per flush = %v, want %v", got, want)
+	}
+	if _, ok := strat.flushes[3]["VIN1"]; !ok {
+		t.Errorf("retry after failed flush: want VIN1, got %v", strat.flushes[3])
+	}
+}
@@ -0,0 +1,73 @@
+package processors
+
+import (
+	"bethos/internal/merger"
+	"log"
+)
+
+// dryRun logs what a flush with opts would emit and evict, without touching state or counters.
+// Pending evictions from earlier merges (e.g. capacity) are not included.
+func (m *LatestMerger) dryRun(opts collectOptions, t flushTrigger) {
+	opts.owned, opts.rebuilding = m.ownedPartitions(opts.now, false)
+	vins, sensors := 0, 0
+	evicted := make(map[string]int)
+	for _, s := range m.shards {
+		part := s.collect(opts)
+		vins += len(part.state)
+		for _, dev := range part.state {
+			sensors += len(dev)
+		}
+		for reason, n := range part.evicted {
+			evicted[reason] += n
+		}
+	}
+	log.Printf("%s event=flush dry_run=true vin_count=%d sensor_count=%d evict_ttl=%d evict_revoked=%d evict_manual=%d",
+		logPrefix, vins, sensors, evicted[merger.EvictReasonTTL], evicted[merger.EvictReasonRevoked], m.countDevices(t.Evict))
+}
+
+// reset discards the devices in scope (all if nil) without emitting them. Not an eviction: nothing is
+// counted or reported to the EvictionListener.
+func (m *LatestMerger) reset(scope map[string]struct{}) {
+	removed := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for vin, dev := range s.devices {
+			if scope != nil {
+				if _, ok := scope[vin]; !ok {
+					continue
+				}
+			}
+			delete(s.devices, vin)
+			s.lru.Remove(dev.elem)
+			removed++
+		}
+		s.mu.Unlock()
+	}
+	log.Printf("%s event=reset vin_count=%d scoped=%t", logPrefix, removed, scope != nil)
+}
+
+// evictManual removes the given devices with reason manual; the flush reports them like other evictions.
+func (m *LatestMerger) evictManual(vins []string) {
+	for _, vin := range vins {
+		s := m.shardFor(vin)
+		s.mu.Lock()
+		if dev := s.devices[vin]; dev != nil {
+			s.removeLocked(vin, dev, merger.EvictReasonManual)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// countDevices returns how many of vins are in state.
+func (m *LatestMerger) countDevices(vins []string) int {
+	n := 0
+	for _, vin := range vins {
+		s := m.shardFor(vin)
+		s.mu.Lock()
+		if s.devices[vin] != nil {
+			n++
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
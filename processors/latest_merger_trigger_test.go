@@ -0,0 +1,152 @@
+package processors
+
+import (
+	"bethos/internal/merger"
+	"bethos/internal/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func TestParseFlushTrigger_Options(t *testing.T) {
+	tests := []struct {
+		raw      string
+		ok       bool
+		complete bool
+	}{
+		{`{"_flush":true}`, true, true},
+		{`{"_flush":true,"full":true,"evict":["VIN1"]}`, true, true},
+		{`{"_flush":true,"vins":["VIN1","VIN2"]}`, true, false},
+		{`{"_flush":true,"dry_run":true}`, true, false},
+		{`{"_flush":true,"reset":true}`, true, false},
+		{`{"_flush":false,"vins":["VIN1"]}`, false, false},
+		{`{"vins":["VIN1"]}`, false, false},
+	}
+	for _, tt := range tests {
+		trig, ok := parseFlushTrigger([]byte(tt.raw))
+		if ok != tt.ok || (ok && trig.complete() != tt.complete) {
+			t.Errorf("parseFlushTrigger(%s) = ok %v complete %v, want %v %v", tt.raw, ok, trig.complete(), tt.ok, tt.complete)
+		}
+	}
+}
+
+// triggerMerger returns a merger holding VIN1 and VIN2 (a and b sensors), flushed once.
+func triggerMerger(t *testing.T, strat merger.FlushStrategy, mode string) *LatestMerger {
+	t.Helper()
+	m := &LatestMerger{Strategy: strat, FlushMode: mode, Shards: 4}
+	for _, vin := range []string{"VIN1", "VIN2"} {
+		m.merge(model.Payload{Data: model.Data{ID: vin, Metrics: map[string]model.MetricValue{
+			"a": {Value: "1", ReceivedAt: time.Now().UnixMilli()}, "b": {Value: "1", ReceivedAt: time.Now().UnixMilli()},
+		}}})
+	}
+	return m
+}
+
+func processTrigger(t *testing.T, m *LatestMerger, body string) service.MessageBatch {
+	t.Helper()
+	batch, err := m.Process(context.Background(), service.NewMessage([]byte(body)))
+	if err != nil {
+		t.Fatalf("Process(%s): %v", body, err)
+	}
+	return batch
+}
+
+func TestLatestMerger_Trigger_ScopedVINs(t *testing.T) {
+	strat := &recordingStrategy{}
+	m := triggerMerger(t, strat, merger.FlushModeChangedDevices)
+
+	processTrigger(t, m, `{"_flush":true,"vins":["VIN1"]}`)
+	processTrigger(t, m, `{"_flush":true}`)
+
+	if got := strat.flushes[0]; len(got) != 1 || got["VIN1"] == nil {
+		t.Errorf("scoped flush = %v, want VIN1 only", got)
+	}
+	if got := strat.flushes[1]; len(got) != 1 || got["VIN2"] == nil {
+		t.Errorf("next flush = %v, want VIN2 only (VIN1 already flushed)", got)
+	}
+}
+
+func TestLatestMerger_Trigger_FullInDeltaMode(t *testing.T) {
+	strat := &recordingStrategy{}
+	m := triggerMerger(t, strat, merger.FlushModeChangedSensors)
+
+	processTrigger(t, m, `{"_flush":true}`)
+	processTrigger(t, m, `{"_flush":true}`)
+	processTrigger(t, m, `{"_flush":true,"full":true}`)
+
+	if got := len(strat.flushes[1]); got != 0 {
+		t.Errorf("delta flush without changes = %d devices, want 0", got)
+	}
+	if got := strat.flushes[2]; len(got) != 2 || len(got["VIN1"]) != 2 {
+		t.Errorf("full flush = %v, want both devices with all sensors", got)
+	}
+}
+
+func TestLatestMerger_Trigger_DryRun(t *testing.T) {
+	strat := &recordingStrategy{}
+	m := triggerMerger(t, strat, merger.FlushModeChangedDevices)
+	m.merge(model.Payload{Data: model.Data{ID: "OLD", Metrics: map[string]model.MetricValue{"a": {Value: "1", ReceivedAt: 1}}}})
+	deviceOf(m, "OLD").LastSeen = time.Now().Add(-time.Hour).UnixMilli()
+
+	if batch := processTrigger(t, m, `{"_flush":true,"dry_run":true,"evict":["VIN1"]}`); batch != nil {
+		t.Errorf("dry run emitted %d messages", len(batch))
+	}
+	if len(strat.flushes) != 0 {
+		t.Error("dry run called the strategy")
+	}
+	if deviceOf(m, "OLD") == nil || deviceOf(m, "VIN1") == nil {
+		t.Error("dry run evicted devices")
+	}
+
+	processTrigger(t, m, `{"_flush":true}`)
+	if got := len(strat.flushes[0]); got != 2 {
+		t.Errorf("flush after dry run = %d devices, want 2 (dirty marks kept, OLD expired)", got)
+	}
+}
+
+func TestLatestMerger_Trigger_Reset(t *testing.T) {
+	strat := &recordingStrategy{}
+	m := triggerMerger(t, strat, merger.FlushModeFull)
+
+	processTrigger(t, m, `{"_flush":true,"reset":true,"vins":["VIN2"]}`)
+	if deviceOf(m, "VIN2") != nil || deviceOf(m, "VIN1") == nil {
+		t.Error("scoped reset: want VIN2 removed, VIN1 kept")
+	}
+	processTrigger(t, m, `{"_flush":true,"reset":true}`)
+	if m.deviceCount() != 0 || len(strat.flushes) != 0 {
+		t.Errorf("reset: %d devices left, %d flushes; want 0 and 0", m.deviceCount(), len(strat.flushes))
+	}
+	if len(m.evictedTotal) != 0 {
+		t.Errorf("reset counted evictions: %v", m.evictedTotal)
+	}
+}
+
+func TestLatestMerger_Trigger_EvictTombstone(t *testing.T) {
+	strat := &merger.LogCompactedFlushStrategy{Tombstones: true, TombstoneGrace: time.Hour}
+	m := triggerMerger(t, strat, merger.FlushModeFull)
+
+	batch := processTrigger(t, m, `{"_flush":true,"evict":["VIN1"]}`)
+
+	if deviceOf(m, "VIN1") != nil {
+		t.Error("VIN1 still in state")
+	}
+	var tombstones, devices int
+	for _, msg := range batch {
+		if v, _ := msg.MetaGet("tombstone"); v == "true" {
+			tombstones++
+			if vin, _ := msg.MetaGet("vincode"); vin != "VIN1" {
+				t.Errorf("tombstone for %q, want VIN1", vin)
+			}
+			continue
+		}
+		devices++
+	}
+	if tombstones != 1 || devices != 1 {
+		t.Errorf("batch: %d tombstones, %d devices; want 1 and 1 (no grace for manual eviction)", tombstones, devices)
+	}
+	if got := m.evictedTotal[merger.EvictReasonManual]; got != 1 {
+		t.Errorf("evicted manual = %d, want 1", got)
+	}
+}
@@ -59,8 +59,9 @@ func (a *Aggregator) ProcessBatch(
 			receivedAt = time.Now().UnixMilli()
 		}
 		v[resourceName] = model.MetricValue{
-			Value:      row.Value,
-			ReceivedAt: receivedAt,
+			Value:        row.Value,
+			ReceivedAt:   receivedAt,
+			ReceivedAtNs: row.NsTS,
 		}
 	}
 
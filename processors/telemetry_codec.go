@@ -0,0 +1,88 @@
+package processors
+
+import (
+	"bethos/internal/codec"
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+// RecordAuto makes TelemetryEncoder take the record from the message (see codec.DetectRecord).
+const RecordAuto = "auto"
+
+// TelemetryEncoder encodes a message holding a Payload, PayloadBatch, Data or CSVRow (as JSON, or set
+// structured by an earlier processor such as csv_reader) with Codec, setting meta encoding and, when the
+// schema is registered, schema_id.
+type TelemetryEncoder struct {
+	Codec  *codec.Codec
+	Record string // a codec.Record*, or RecordAuto
+}
+
+func (e *TelemetryEncoder) Close(ctx context.Context) error {
+	return nil
+}
+
+func (e *TelemetryEncoder) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	v, err := e.value(msg)
+	if err != nil {
+		return nil, err
+	}
+	b, id, err := e.Codec.Encode(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	msg.SetBytes(b)
+	msg.MetaSet("encoding", e.Codec.Encoding)
+	if id > 0 {
+		msg.MetaSet("schema_id", strconv.Itoa(id))
+	}
+	return service.MessageBatch{msg}, nil
+}
+
+// value returns the model value of msg: the structured value if it already is one, else its JSON decoded.
+func (e *TelemetryEncoder) value(msg *service.Message) (any, error) {
+	if v, err := msg.AsStructured(); err == nil {
+		if record, ok := codec.RecordOf(v); ok && (e.Record == RecordAuto || e.Record == record) {
+			return v, nil
+		}
+	}
+	b, err := msg.AsBytes()
+	if err != nil {
+		return nil, err
+	}
+	record := e.Record
+	if record == RecordAuto {
+		if record, err = codec.DetectRecord(b); err != nil {
+			return nil, fmt.Errorf("detect record: %w", err)
+		}
+	}
+	return codec.DecodeJSON(b, record)
+}
+
+// TelemetryDecoder decodes messages encoded by TelemetryEncoder (or an encoded flush strategy) back to the
+// model value, serialized as JSON downstream. With a registry, the record is the one of the message's schema
+// id; otherwise Record.
+type TelemetryDecoder struct {
+	Codec  *codec.Codec
+	Record string
+}
+
+func (d *TelemetryDecoder) Close(ctx context.Context) error {
+	return nil
+}
+
+func (d *TelemetryDecoder) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	b, err := msg.AsBytes()
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.Codec.Decode(ctx, b, d.Record)
+	if err != nil {
+		return nil, err
+	}
+	msg.SetStructured(v)
+	msg.MetaDelete("encoding")
+	return service.MessageBatch{msg}, nil
+}
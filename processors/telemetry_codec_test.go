@@ -0,0 +1,88 @@
+package processors
+
+import (
+	"bethos/internal/codec"
+	"bethos/internal/model"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/warpstreamlabs/bento/public/service"
+)
+
+func TestTelemetryCodec_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(&codec.MemoryRegistry{})
+	defer srv.Close()
+
+	inputs := []string{
+		`{"num_of_data":1,"data":{"id":"VIN1","speed":{"value":12.5,"received_at":1000}},"produced_at":2000}`,
+		`{"num_of_data":2,"data":[{"id":"VIN1","speed":{"value":1,"received_at":1}},{"id":"VIN2","door":{"value":"open","received_at":2}}],"produced_at":3}`,
+		`{"id":"VIN1","speed":{"value":"fast","received_at":1}}`,
+	}
+	for _, encoding := range []string{codec.EncodingAvro, codec.EncodingProtobuf} {
+		encCodec, _ := codec.New(encoding, []string{"speed"}, codec.NewRegistry(srv.URL))
+		decCodec, _ := codec.New(encoding, []string{"speed"}, codec.NewRegistry(srv.URL))
+		enc := &TelemetryEncoder{Codec: encCodec, Record: RecordAuto}
+		dec := &TelemetryDecoder{Codec: decCodec, Record: codec.RecordPayload}
+
+		for _, in := range inputs {
+			out, err := enc.Process(ctx, service.NewMessage([]byte(in)))
+			if err != nil {
+				t.Fatalf("%s encode %s: %v", encoding, in, err)
+			}
+			if id, _ := out[0].MetaGet("schema_id"); id == "" {
+				t.Errorf("%s: meta schema_id missing", encoding)
+			}
+			back, err := dec.Process(ctx, out[0])
+			if err != nil {
+				t.Fatalf("%s decode %s: %v", encoding, in, err)
+			}
+			b, _ := back[0].AsBytes()
+			if !jsonEqual(t, b, []byte(in)) {
+				t.Errorf("%s round trip:\n got %s\nwant %s", encoding, b, in)
+			}
+			if _, ok := back[0].MetaGet("encoding"); ok {
+				t.Errorf("%s: decoded message still has meta encoding", encoding)
+			}
+		}
+	}
+}
+
+func TestTelemetryEncoder_StructuredCSVRow(t *testing.T) {
+	ctx := context.Background()
+	c, _ := codec.New(codec.EncodingProtobuf, nil, nil)
+	enc := &TelemetryEncoder{Codec: c, Record: RecordAuto}
+
+	row := model.CSVRow{ID: "1", Vincode: "VIN1", ResourceName: "speed", Value: "12", TS: 5}
+	msg := service.NewMessage(nil)
+	msg.SetStructured(row)
+	out, err := enc.Process(ctx, msg)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	b, _ := out[0].AsBytes()
+	got, err := c.Decode(ctx, b, codec.RecordCSVRow)
+	if err != nil || got != row {
+		t.Errorf("decoded %+v (%v), want %+v", got, err, row)
+	}
+
+	if _, err := enc.Process(ctx, service.NewMessage([]byte(`{"foo":1}`))); err == nil {
+		t.Error("unknown shape: want error")
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatalf("unmarshal %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatalf("unmarshal %s: %v", b, err)
+	}
+	xb, _ := json.Marshal(x)
+	yb, _ := json.Marshal(y)
+	return string(xb) == string(yb)
+}